@@ -0,0 +1,292 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"os/signal"
+
+	"github.com/akhenakh/oureadb/importer"
+	"github.com/akhenakh/oureadb/index"
+	"github.com/akhenakh/oureadb/index/geodata"
+	"github.com/akhenakh/oureadb/store"
+	"github.com/akhenakh/oureadb/store/badger"
+	"github.com/akhenakh/oureadb/store/boltdb"
+	"github.com/akhenakh/oureadb/store/goleveldb"
+)
+
+const usage = `usage: ouretool <command> [flags]
+
+commands:
+  import    stream a GeoJSON FeatureCollection or GeoJSONSeq file into the store and a S2FlatIdx
+  rebuild   rebuild a S2FlatIdx at a new level into a new prefix, then swap its alias
+  repair    recount the entries of an index metadata
+`
+
+func main() {
+	log.SetFlags(log.LstdFlags | log.Lshortfile)
+
+	if len(os.Args) < 2 {
+		fmt.Fprint(os.Stderr, usage)
+		os.Exit(2)
+	}
+
+	switch os.Args[1] {
+	case "import":
+		importGeoJSON(os.Args[2:])
+	case "rebuild":
+		rebuild(os.Args[2:])
+	case "repair":
+		repair(os.Args[2:])
+	default:
+		fmt.Fprint(os.Stderr, usage)
+		os.Exit(2)
+	}
+}
+
+func importGeoJSON(args []string) {
+	fs := flag.NewFlagSet("import", flag.ExitOnError)
+	storeType := fs.String("store", "badger", "store type: badger, boltdb or goleveldb")
+	path := fs.String("path", "", "store path")
+	geoJSONPath := fs.String("geojson", "", "GeoJSON FeatureCollection or GeoJSONSeq file to import")
+	format := fs.String("format", "auto", "input format: auto, collection or seq")
+	dataPrefix := fs.String("data", "", "prefix to store the GeoData protobufs by id, not stored if empty")
+	prefix := fs.String("prefix", "", "prefix of the S2FlatIdx to feed, no index if empty")
+	level := fs.Int("level", 0, "s2 level of the index")
+	idProperty := fs.String("idProperty", "", "feature property used as id, the feature id by default")
+	checkpoint := fs.String("checkpoint", "", "key storing the import progress to resume an interrupted import")
+	skipErrors := fs.Bool("skipErrors", false, "log and skip the features that can't be imported")
+	_ = fs.Parse(args)
+
+	if *path == "" || *geoJSONPath == "" || (*dataPrefix == "" && *prefix == "") || (*prefix != "" && *level <= 0) {
+		fs.Usage()
+		os.Exit(2)
+	}
+
+	opts := &importer.Options{
+		IDProperty: *idProperty,
+		DataPrefix: []byte(*dataPrefix),
+		Checkpoint: []byte(*checkpoint),
+		Bulk: &index.BulkOptions{
+			Progress: func(stats index.BulkStats) {
+				log.Printf("%d keys written", stats.Keys)
+			},
+		},
+	}
+	switch *format {
+	case "auto":
+	case "collection":
+		opts.Format = importer.FormatFeatureCollection
+	case "seq":
+		opts.Format = importer.FormatSeq
+	default:
+		fs.Usage()
+		os.Exit(2)
+	}
+	if *skipErrors {
+		opts.OnError = func(err *importer.FeatureError) {
+			log.Printf("skipping %v", err)
+		}
+	}
+
+	s, err := openStore(*storeType, *path)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer s.Close()
+
+	if *prefix != "" {
+		idx, err := index.OpenOrCreateS2FlatIdx(s, []byte(*prefix), *level)
+		if err != nil {
+			log.Fatal(err)
+		}
+		opts.Indexes = append(opts.Indexes, idx)
+	}
+
+	f, err := os.Open(*geoJSONPath)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer f.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	c := make(chan os.Signal, 1)
+	signal.Notify(c, os.Interrupt)
+	go func() {
+		<-c
+		cancel()
+	}()
+
+	stats, err := importer.Import(ctx, s, f, opts)
+	if err != nil {
+		log.Fatal(err)
+	}
+	log.Printf("imported %d features, %d failed, %d already imported", stats.Imported, stats.Failed, stats.Skipped)
+}
+
+func rebuild(args []string) {
+	fs := flag.NewFlagSet("rebuild", flag.ExitOnError)
+	storeType := fs.String("store", "badger", "store type: badger, boltdb or goleveldb")
+	path := fs.String("path", "", "store path")
+	alias := fs.String("alias", "", "alias of the index")
+	prefix := fs.String("prefix", "", "new prefix of the index, must be empty")
+	level := fs.Int("level", 0, "new s2 level of the index")
+	dataPrefix := fs.String("data", "", "prefix of the GeoData protobufs stored by id to index")
+	geoJSONPath := fs.String("geojson", "", "GeoJSON FeatureCollection or GeoJSONSeq file to index instead of the stored data")
+	idProperty := fs.String("idProperty", "", "feature property used as id, the feature id by default")
+	skipErrors := fs.Bool("skipErrors", false, "log and skip the features that can't be indexed")
+	_ = fs.Parse(args)
+
+	if *path == "" || *alias == "" || *prefix == "" || *level <= 0 || (*dataPrefix == "") == (*geoJSONPath == "") {
+		fs.Usage()
+		os.Exit(2)
+	}
+
+	s, err := openStore(*storeType, *path)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer s.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	c := make(chan os.Signal, 1)
+	signal.Notify(c, os.Interrupt)
+	go func() {
+		<-c
+		cancel()
+	}()
+
+	opts := &index.RebuildOptions{
+		Bulk: &index.BulkOptions{
+			Progress: func(stats index.BulkStats) {
+				log.Printf("indexed %d features, %d keys written", stats.Features, stats.Keys)
+			},
+		},
+		OnSwap: func(idx *index.S2FlatIdx) {
+			log.Printf("alias %s now points to %s, deleting the previous index", *alias, *prefix)
+		},
+	}
+	if *skipErrors {
+		opts.OnError = func(id index.GeoID, err error) {
+			log.Printf("skipping %s: %v", id, err)
+		}
+	}
+
+	var src index.GeoDataSource
+	if *geoJSONPath != "" {
+		src, err = geoJSONSource(*geoJSONPath, *idProperty, opts.OnError)
+		if err != nil {
+			log.Fatal(err)
+		}
+	} else {
+		src = index.StoreGeoDataSource(s, []byte(*dataPrefix))
+	}
+
+	idx, err := index.RebuildS2FlatIdx(ctx, s, []byte(*alias), []byte(*prefix), *level, src, opts)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	md := idx.Metadata()
+	log.Printf("rebuilt %s at level %d with %d entries", *alias, md.Level, md.Entries)
+}
+
+func repair(args []string) {
+	fs := flag.NewFlagSet("repair", flag.ExitOnError)
+	storeType := fs.String("store", "badger", "store type: badger, boltdb or goleveldb")
+	path := fs.String("path", "", "store path")
+	prefix := fs.String("prefix", "", "prefix of the index")
+	_ = fs.Parse(args)
+
+	if *path == "" || *prefix == "" {
+		fs.Usage()
+		os.Exit(2)
+	}
+
+	s, err := openStore(*storeType, *path)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer s.Close()
+
+	md, err := index.RepairIndexMetadata(s, []byte(*prefix))
+	if err != nil {
+		log.Fatal(err)
+	}
+	log.Printf("%s index %s has %d entries", md.Type, *prefix, md.Entries)
+}
+
+// openStore opens the store of type t at path
+func openStore(t, path string) (store.KVStore, error) {
+	config := map[string]interface{}{"path": path}
+	switch t {
+	case "badger":
+		return badger.New(nil, config)
+	case "boltdb":
+		return boltdb.New(nil, config)
+	case "goleveldb":
+		config["create_if_missing"] = true
+		return goleveldb.New(nil, config)
+	default:
+		return nil, fmt.Errorf("unknown store type %s", t)
+	}
+}
+
+// geoJSONSource returns a GeoDataSource streaming the features of the FeatureCollection or GeoJSONSeq at path,
+// the features that can't be read or converted are passed to onError and skipped, or end the source if onError is nil
+func geoJSONSource(path, idProperty string, onError func(id index.GeoID, err error)) (index.GeoDataSource, error) {
+	if _, err := os.Stat(path); err != nil {
+		return nil, err
+	}
+
+	return func(fn func(id index.GeoID, gd *geodata.GeoData) error) error {
+		file, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+
+		r := importer.NewReader(file, importer.FormatAuto)
+		for {
+			f, pos, err := r.Next()
+			if err == io.EOF {
+				return nil
+			}
+			if ferr, ok := err.(*importer.FeatureError); ok && onError != nil {
+				onError(nil, ferr)
+				continue
+			}
+			if err != nil {
+				return err
+			}
+
+			id, err := importer.FeatureID(f, idProperty)
+			if err != nil {
+				err = fmt.Errorf("feature %d at line %d: %v", pos.Index, pos.Line, err)
+				if onError == nil {
+					return err
+				}
+				onError(nil, err)
+				continue
+			}
+
+			gd := &geodata.GeoData{}
+			if err := geodata.GeoJSONFeatureToGeoData(f, gd); err != nil {
+				if onError == nil {
+					return fmt.Errorf("feature %s: %v", id, err)
+				}
+				onError(index.GeoID(id), err)
+				continue
+			}
+
+			if err := fn(index.GeoID(id), gd); err != nil {
+				return err
+			}
+		}
+	}, nil
+}
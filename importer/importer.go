@@ -0,0 +1,247 @@
+// Package importer streams GeoJSON FeatureCollection and GeoJSONSeq inputs into a store and its indexes
+package importer
+
+import (
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"io"
+	"strconv"
+
+	"github.com/akhenakh/oureadb/index"
+	"github.com/akhenakh/oureadb/index/geodata"
+	"github.com/akhenakh/oureadb/store"
+	"github.com/golang/protobuf/proto"
+	"github.com/pkg/errors"
+	"github.com/twpayne/go-geom/encoding/geojson"
+)
+
+// defaultCheckpointEvery is the default number of features between two checkpoints
+const defaultCheckpointEvery = 1000
+
+// ErrNoFeatureID is returned for a feature without id or id property
+var ErrNoFeatureID = errors.New("feature has no id")
+
+// Indexer feeds an index with a feature, S2FlatIdx and S2AttrIdx are Indexers
+// a feature that can't be indexed is reported as an *index.FeatureIndexError, any other error stops the import
+type Indexer interface {
+	GeoIndexBulkContext(ctx context.Context, b *index.BulkIndexer, gd *geodata.GeoData, id index.GeoID) error
+}
+
+// IndexerFunc is a function used as an Indexer, for example S2PointIdx.GeoPointIndexBulkContext
+type IndexerFunc func(ctx context.Context, b *index.BulkIndexer, gd *geodata.GeoData, id index.GeoID) error
+
+// GeoIndexBulkContext calls f
+func (f IndexerFunc) GeoIndexBulkContext(ctx context.Context, b *index.BulkIndexer, gd *geodata.GeoData, id index.GeoID) error {
+	return f(ctx, b, gd, id)
+}
+
+// Options are the options of an import
+type Options struct {
+	// Format is the format of the input, detected by default
+	Format Format
+
+	// IDProperty is the feature property used as id, the feature id by default
+	IDProperty string
+
+	// DataPrefix if not empty stores the GeoData protobuf of every feature under DataPrefix+id,
+	// as read by index.StoreGeoDataSource
+	DataPrefix []byte
+
+	// Indexes are fed with every feature
+	Indexes []Indexer
+
+	// Bulk are the options of the bulk indexer writing the data and the index keys
+	Bulk *index.BulkOptions
+
+	// Checkpoint if not empty is the key where the number of features read is written,
+	// an import with the same Checkpoint resumes after the features already read,
+	// delete the key to import the input again
+	Checkpoint []byte
+
+	// CheckpointEvery is the number of features between two checkpoints, defaults to 1000
+	CheckpointEvery int
+
+	// OnError if not nil is called for every feature that can't be imported,
+	// otherwise the import stops at the first error
+	OnError func(err *FeatureError)
+}
+
+// Stats are the counters of an import
+type Stats struct {
+	// Skipped is the number of features skipped because they were read by a previous import
+	Skipped int
+
+	// Imported is the number of features stored and indexed
+	Imported int
+
+	// Failed is the number of features reported to OnError
+	Failed int
+}
+
+// Import reads the GeoJSON features of r, stores them and feeds the indexes
+// the keys of a feature may be written before it is checkpointed,
+// so after a failure the features following the last checkpoint are imported again
+// and the entries counts of the indexes metadata may count them twice
+func Import(ctx context.Context, s store.KVStore, r io.Reader, opts *Options) (*Stats, error) {
+	if opts == nil {
+		opts = &Options{}
+	}
+	every := opts.CheckpointEvery
+	if every <= 0 {
+		every = defaultCheckpointEvery
+	}
+
+	stats := &Stats{}
+
+	var done int
+	if len(opts.Checkpoint) > 0 {
+		var err error
+		done, err = ReadCheckpoint(s, opts.Checkpoint)
+		if err != nil {
+			return stats, err
+		}
+	}
+
+	fr := NewReader(r, opts.Format)
+	if err := fr.Skip(done); err != nil {
+		return stats, errors.Wrap(err, "resuming import failed")
+	}
+	stats.Skipped = done
+
+	b := index.NewBulkIndexer(s, opts.Bulk)
+	checkpoint := func(n int) error {
+		if len(opts.Checkpoint) > 0 {
+			if err := b.PutContext(ctx, opts.Checkpoint, encodeCheckpoint(n)); err != nil {
+				return err
+			}
+		}
+		return b.FlushContext(ctx)
+	}
+
+	for {
+		if err := ctx.Err(); err != nil {
+			return stats, err
+		}
+
+		f, pos, err := fr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err == nil {
+			err = importFeature(ctx, b, f, pos, opts)
+		}
+		if err != nil {
+			ferr, ok := err.(*FeatureError)
+			if !ok || opts.OnError == nil || ctx.Err() != nil {
+				return stats, err
+			}
+			opts.OnError(ferr)
+			stats.Failed++
+		} else {
+			stats.Imported++
+		}
+
+		if (pos.Index+1)%every == 0 {
+			if err := checkpoint(pos.Index + 1); err != nil {
+				return stats, errors.Wrap(err, "writing checkpoint failed")
+			}
+		}
+	}
+
+	if err := checkpoint(stats.Skipped + stats.Imported + stats.Failed); err != nil {
+		return stats, errors.Wrap(err, "writing checkpoint failed")
+	}
+	return stats, nil
+}
+
+// FeatureID returns the id of f, the value of its idProperty if not empty,
+// a property id must be a string or a number, returns ErrNoFeatureID if f has no id
+func FeatureID(f *geojson.Feature, idProperty string) (string, error) {
+	if idProperty == "" {
+		if f.ID == "" {
+			return "", ErrNoFeatureID
+		}
+		return f.ID, nil
+	}
+
+	switch v := f.Properties[idProperty].(type) {
+	case nil:
+		return "", ErrNoFeatureID
+	case string:
+		if v == "" {
+			return "", ErrNoFeatureID
+		}
+		return v, nil
+	case json.Number:
+		return v.String(), nil
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64), nil
+	default:
+		return "", errors.Errorf("invalid id property %s of type %T", idProperty, v)
+	}
+}
+
+// importFeature stores f and feeds the indexes, the feature errors are returned as *FeatureError
+func importFeature(ctx context.Context, b *index.BulkIndexer, f *geojson.Feature, pos Position, opts *Options) error {
+	id, err := FeatureID(f, opts.IDProperty)
+	if err != nil {
+		return &FeatureError{Position: pos, Err: err}
+	}
+
+	gd := &geodata.GeoData{}
+	if err := geodata.GeoJSONFeatureToGeoData(f, gd); err != nil {
+		return &FeatureError{Position: pos, ID: id, Err: err}
+	}
+
+	if len(opts.DataPrefix) > 0 {
+		v, err := proto.Marshal(gd)
+		if err != nil {
+			return &FeatureError{Position: pos, ID: id, Err: errors.Wrap(err, "encoding geo data failed")}
+		}
+		k := make([]byte, 0, len(opts.DataPrefix)+len(id))
+		k = append(append(k, opts.DataPrefix...), id...)
+		if err := b.PutContext(ctx, k, v); err != nil {
+			return err
+		}
+	}
+
+	for _, idx := range opts.Indexes {
+		if err := idx.GeoIndexBulkContext(ctx, b, gd, index.GeoID(id)); err != nil {
+			// the write errors are not errors of f
+			if ferr, ok := err.(*index.FeatureIndexError); ok {
+				return &FeatureError{Position: pos, ID: id, Err: ferr.Err}
+			}
+			return err
+		}
+	}
+	return nil
+}
+
+// ReadCheckpoint returns the number of features read by the imports using the key checkpoint, 0 if none
+func ReadCheckpoint(s store.KVStore, checkpoint []byte) (int, error) {
+	kv, err := s.Reader()
+	if err != nil {
+		return 0, err
+	}
+	defer kv.Close()
+
+	v, err := kv.Get(checkpoint)
+	if err != nil {
+		return 0, errors.Wrap(err, "reading checkpoint failed")
+	}
+	if v == nil {
+		return 0, nil
+	}
+	if len(v) != 8 {
+		return 0, errors.Errorf("invalid checkpoint %x", v)
+	}
+	return int(binary.BigEndian.Uint64(v)), nil
+}
+
+// encodeCheckpoint returns the checkpoint value for n features read
+func encodeCheckpoint(n int) []byte {
+	v := make([]byte, 8)
+	binary.BigEndian.PutUint64(v, uint64(n))
+	return v
+}
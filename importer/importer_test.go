@@ -0,0 +1,199 @@
+package importer
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"strings"
+	"testing"
+
+	"github.com/akhenakh/oureadb/index"
+	"github.com/akhenakh/oureadb/index/geodata"
+	"github.com/akhenakh/oureadb/store"
+	"github.com/akhenakh/oureadb/store/gtreap"
+	"github.com/stretchr/testify/require"
+	"github.com/twpayne/go-geom/encoding/geojson"
+)
+
+func openStore(t testing.TB) store.KVStore {
+	rv, err := gtreap.New(nil, map[string]interface{}{
+		"path": "",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return rv
+}
+
+func cleanup(t testing.TB, s store.KVStore) {
+	err := s.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestImport(t *testing.T) {
+	s := openStore(t)
+	defer cleanup(t, s)
+
+	flat, err := index.OpenOrCreateS2FlatIdx(s, []byte("F"), 16)
+	require.NoError(t, err)
+	points, err := index.OpenOrCreateS2PointIdx(s, []byte("P"))
+	require.NoError(t, err)
+
+	var errs []*FeatureError
+	stats, err := Import(context.Background(), s, strings.NewReader(collection), &Options{
+		IDProperty: "name",
+		DataPrefix: []byte("D"),
+		Indexes:    []Indexer{flat, IndexerFunc(points.GeoPointIndexBulkContext)},
+		OnError:    func(err *FeatureError) { errs = append(errs, err) },
+	})
+	require.NoError(t, err)
+	require.Equal(t, &Stats{Imported: 2, Failed: 1}, stats)
+	require.Len(t, errs, 1)
+	require.Equal(t, Position{1, 6}, errs[0].Position)
+
+	var ids []string
+	err = index.StoreGeoDataSource(s, []byte("D"))(func(id index.GeoID, gd *geodata.GeoData) error {
+		ids = append(ids, string(id))
+		return nil
+	})
+	require.NoError(t, err)
+	require.Equal(t, []string{"a", "c"}, ids)
+
+	res, err := flat.GeoIdsRadiusQuery(46.8105, -71.2199, 100)
+	require.NoError(t, err)
+	require.Equal(t, []index.GeoID{index.GeoID("c")}, res)
+	res, err = points.GeoIdsRadiusQuery(46.7984, -71.2275, 100)
+	require.NoError(t, err)
+	require.Equal(t, []index.GeoID{index.GeoID("a")}, res)
+
+	// stops at the first error without OnError
+	_, err = Import(context.Background(), s, strings.NewReader(collection), &Options{Indexes: []Indexer{flat}})
+	require.Error(t, err)
+	require.IsType(t, &FeatureError{}, err)
+
+	// no id
+	_, err = Import(context.Background(), s, strings.NewReader(collection), &Options{IDProperty: "missing"})
+	require.Error(t, err)
+
+	// the indexing errors are feature errors, not the write errors
+	invalid := IndexerFunc(func(ctx context.Context, b *index.BulkIndexer, gd *geodata.GeoData, id index.GeoID) error {
+		return &index.FeatureIndexError{ID: id, Err: errors.New("invalid")}
+	})
+	errs = nil
+	stats, err = Import(context.Background(), s, strings.NewReader(seq), &Options{
+		Indexes: []Indexer{invalid},
+		OnError: func(err *FeatureError) { errs = append(errs, err) },
+	})
+	require.NoError(t, err)
+	require.Equal(t, &Stats{Failed: 3}, stats)
+	require.Equal(t, "a", errs[0].ID)
+
+	failing := IndexerFunc(func(ctx context.Context, b *index.BulkIndexer, gd *geodata.GeoData, id index.GeoID) error {
+		return errors.New("write failed")
+	})
+	_, err = Import(context.Background(), s, strings.NewReader(seq), &Options{
+		Indexes: []Indexer{failing},
+		OnError: func(err *FeatureError) { t.Fatal(err) },
+	})
+	require.EqualError(t, err, "write failed")
+}
+
+func TestFeatureID(t *testing.T) {
+	f := &geojson.Feature{ID: "way/4242", Properties: map[string]interface{}{
+		"name":   "stop",
+		"osm_id": json.Number("9007199254740993"),
+		"ref":    42.0,
+		"empty":  "",
+		"null":   nil,
+		"tags":   map[string]interface{}{},
+	}}
+
+	tests := []struct {
+		property string
+		expected string
+	}{
+		{"", "way/4242"},
+		{"name", "stop"},
+		{"osm_id", "9007199254740993"},
+		{"ref", "42"},
+	}
+	for _, test := range tests {
+		id, err := FeatureID(f, test.property)
+		require.NoError(t, err)
+		require.Equal(t, test.expected, id)
+	}
+
+	for _, p := range []string{"empty", "null", "missing"} {
+		_, err := FeatureID(f, p)
+		require.Equal(t, ErrNoFeatureID, err)
+	}
+	_, err := FeatureID(f, "tags")
+	require.Error(t, err)
+	_, err = FeatureID(&geojson.Feature{}, "")
+	require.Equal(t, ErrNoFeatureID, err)
+}
+
+// failingReader returns an error once n bytes are read
+type failingReader struct {
+	r io.Reader
+	n int
+}
+
+func (fr *failingReader) Read(p []byte) (int, error) {
+	if fr.n <= 0 {
+		return 0, errors.New("read failed")
+	}
+	if len(p) > fr.n {
+		p = p[:fr.n]
+	}
+	n, err := fr.r.Read(p)
+	fr.n -= n
+	return n, err
+}
+
+func TestImportResume(t *testing.T) {
+	s := openStore(t)
+	defer cleanup(t, s)
+
+	opts := &Options{
+		Format:          FormatSeq,
+		DataPrefix:      []byte("D"),
+		Checkpoint:      []byte("checkpoint"),
+		CheckpointEvery: 1,
+		OnError:         func(err *FeatureError) {},
+	}
+
+	// fails after the 2 first lines
+	n := strings.Index(seq, "\n\n") + 1
+	stats, err := Import(context.Background(), s, &failingReader{r: strings.NewReader(seq), n: n}, opts)
+	require.Error(t, err)
+	require.Equal(t, &Stats{Imported: 1, Failed: 1}, stats)
+
+	done, err := ReadCheckpoint(s, opts.Checkpoint)
+	require.NoError(t, err)
+	require.Equal(t, 2, done)
+
+	stats, err = Import(context.Background(), s, strings.NewReader(seq), opts)
+	require.NoError(t, err)
+	require.Equal(t, &Stats{Skipped: 2, Imported: 1}, stats)
+
+	done, err = ReadCheckpoint(s, opts.Checkpoint)
+	require.NoError(t, err)
+	require.Equal(t, 3, done)
+
+	var ids []string
+	err = index.StoreGeoDataSource(s, []byte("D"))(func(id index.GeoID, gd *geodata.GeoData) error {
+		ids = append(ids, string(id))
+		return nil
+	})
+	require.NoError(t, err)
+	require.Equal(t, []string{"a", "c"}, ids)
+
+	// nothing left to import
+	stats, err = Import(context.Background(), s, strings.NewReader(seq), opts)
+	require.NoError(t, err)
+	require.Equal(t, &Stats{Skipped: 3}, stats)
+}
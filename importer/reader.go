@@ -0,0 +1,372 @@
+package importer
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"io"
+
+	"github.com/akhenakh/oureadb/index/geodata"
+	"github.com/pkg/errors"
+	"github.com/twpayne/go-geom/encoding/geojson"
+)
+
+// Format is the format of a GeoJSON input
+type Format int
+
+const (
+	// FormatAuto detects the format: a GeoJSONSeq starts with a record separator
+	// or has a complete Feature on its first line, anything else is read as a FeatureCollection
+	FormatAuto Format = iota
+
+	// FormatFeatureCollection is a GeoJSON FeatureCollection, possibly on a single line
+	FormatFeatureCollection
+
+	// FormatSeq is a sequence of GeoJSON features as described in RFC 8142,
+	// or one feature per line without record separators
+	FormatSeq
+)
+
+const (
+	// recordSeparator starts every text of a RFC 8142 GeoJSONSeq
+	recordSeparator = 0x1E
+
+	// detectSize is the size of the input looked at by FormatAuto
+	detectSize = 64 << 10
+)
+
+// Position is the position of a feature in the input
+type Position struct {
+	// Index is the 0 based number of the feature, the invalid ones included
+	Index int
+
+	// Line is the 1 based line where the feature starts
+	Line int
+}
+
+// FeatureError is the error of one feature, the following features can still be read
+type FeatureError struct {
+	Position
+	ID  string
+	Err error
+}
+
+func (e *FeatureError) Error() string {
+	if e.ID != "" {
+		return errors.Wrapf(e.Err, "feature %d (%s) at line %d", e.Index, e.ID, e.Line).Error()
+	}
+	return errors.Wrapf(e.Err, "feature %d at line %d", e.Index, e.Line).Error()
+}
+
+// Reader streams the features of a GeoJSON FeatureCollection or GeoJSONSeq input,
+// only one feature is kept in memory at a time
+type Reader struct {
+	br     *bufio.Reader
+	format Format
+	index  int
+
+	// FeatureCollection
+	lr      *lineReader
+	dec     *json.Decoder
+	started bool
+	done    bool
+
+	// GeoJSONSeq
+	line    int
+	seen    bool
+	rs      bool
+	pending []byte
+	pline   int
+}
+
+// NewReader returns a Reader of the features in r
+func NewReader(r io.Reader, format Format) *Reader {
+	return &Reader{
+		br:     bufio.NewReaderSize(r, detectSize),
+		format: format,
+	}
+}
+
+// Format returns the format of the input, detected on the first read for FormatAuto
+func (r *Reader) Format() Format {
+	return r.format
+}
+
+// Next returns the next feature and its position, io.EOF at the end of the input
+// the numbers of the feature properties are json.Number, see geodata.UnmarshalGeoJSONFeature
+// a *FeatureError is returned for a feature that can't be decoded, Next can be called again to read the following ones,
+// any other error is fatal
+func (r *Reader) Next() (*geojson.Feature, Position, error) {
+	raw, pos, err := r.next()
+	if err != nil {
+		return nil, pos, err
+	}
+
+	f := &geojson.Feature{}
+	if err := geodata.UnmarshalGeoJSONFeature(raw, f); err != nil {
+		return nil, pos, &FeatureError{Position: pos, Err: errors.Wrap(err, "invalid feature")}
+	}
+	return f, pos, nil
+}
+
+// Skip reads n features without decoding them, to resume a previous import
+func (r *Reader) Skip(n int) error {
+	for i := 0; i < n; i++ {
+		_, _, err := r.next()
+		if err == io.EOF {
+			return errors.Errorf("input has only %d features, can't skip %d", i, n)
+		}
+		if _, ok := err.(*FeatureError); err != nil && !ok {
+			return err
+		}
+	}
+	return nil
+}
+
+// next returns the raw JSON of the next feature
+func (r *Reader) next() (json.RawMessage, Position, error) {
+	if r.format == FormatAuto {
+		f, err := r.detect()
+		if err != nil {
+			return nil, Position{}, err
+		}
+		r.format = f
+	}
+
+	var raw json.RawMessage
+	var pos Position
+	var err error
+	if r.format == FormatSeq {
+		raw, pos, err = r.nextText()
+	} else {
+		raw, pos, err = r.nextFeature()
+	}
+	if err == nil || isFeatureError(err) {
+		r.index++
+	}
+	return raw, pos, err
+}
+
+// detect returns the format of the input
+func (r *Reader) detect() (Format, error) {
+	b, err := r.br.Peek(detectSize)
+	if err != nil && err != io.EOF && err != bufio.ErrBufferFull {
+		return FormatAuto, errors.Wrap(err, "reading input failed")
+	}
+
+	b = bytes.TrimLeft(b, " \t\r\n")
+	if len(b) > 0 && b[0] == recordSeparator {
+		return FormatSeq, nil
+	}
+
+	i := bytes.IndexByte(b, '\n')
+	if i < 0 {
+		return FormatFeatureCollection, nil
+	}
+
+	var head struct {
+		Type string `json:"type"`
+	}
+	if err := json.Unmarshal(b[:i], &head); err == nil && head.Type == "Feature" {
+		return FormatSeq, nil
+	}
+	return FormatFeatureCollection, nil
+}
+
+// nextFeature returns the next feature of a FeatureCollection
+func (r *Reader) nextFeature() (json.RawMessage, Position, error) {
+	if r.done {
+		return nil, Position{Index: r.index}, io.EOF
+	}
+
+	if !r.started {
+		r.started = true
+		r.lr = &lineReader{r: r.br, line: 1}
+		r.dec = json.NewDecoder(r.lr)
+		if err := r.openFeatures(); err != nil {
+			return nil, Position{}, err
+		}
+	}
+
+	if !r.dec.More() {
+		if err := r.closeFeatures(); err != nil {
+			return nil, Position{}, err
+		}
+		r.done = true
+		return nil, Position{Index: r.index}, io.EOF
+	}
+
+	pos := Position{Index: r.index, Line: r.lr.lineAt(r.dec.InputOffset())}
+	var raw json.RawMessage
+	if err := r.dec.Decode(&raw); err != nil {
+		return nil, pos, errors.Wrapf(err, "invalid FeatureCollection at line %d", pos.Line)
+	}
+	return raw, pos, nil
+}
+
+// openFeatures reads the FeatureCollection tokens up to the opening of the features array
+func (r *Reader) openFeatures() error {
+	if err := r.expectDelim('{'); err != nil {
+		return err
+	}
+
+	for {
+		t, err := r.dec.Token()
+		if err != nil {
+			return r.syntaxError(err)
+		}
+		key, ok := t.(string)
+		if !ok {
+			return errors.New("no features in FeatureCollection")
+		}
+
+		switch key {
+		case "features":
+			return r.expectDelim('[')
+		case "type":
+			var typ string
+			if err := r.dec.Decode(&typ); err != nil {
+				return r.syntaxError(err)
+			}
+			if typ != "FeatureCollection" {
+				return errors.Errorf("input is a %s not a FeatureCollection", typ)
+			}
+		default:
+			var v json.RawMessage
+			if err := r.dec.Decode(&v); err != nil {
+				return r.syntaxError(err)
+			}
+		}
+	}
+}
+
+// closeFeatures reads the end of the features array and the remaining FeatureCollection members
+func (r *Reader) closeFeatures() error {
+	if err := r.expectDelim(']'); err != nil {
+		return err
+	}
+
+	for r.dec.More() {
+		if _, err := r.dec.Token(); err != nil {
+			return r.syntaxError(err)
+		}
+		var v json.RawMessage
+		if err := r.dec.Decode(&v); err != nil {
+			return r.syntaxError(err)
+		}
+	}
+	return r.expectDelim('}')
+}
+
+// expectDelim reads the delimiter d
+func (r *Reader) expectDelim(d json.Delim) error {
+	t, err := r.dec.Token()
+	if err != nil {
+		return r.syntaxError(err)
+	}
+	if t != d {
+		return errors.Errorf("invalid FeatureCollection at line %d: expected %s got %v", r.lr.lineAt(r.dec.InputOffset()), d, t)
+	}
+	return nil
+}
+
+func (r *Reader) syntaxError(err error) error {
+	return errors.Wrapf(err, "invalid FeatureCollection at line %d", r.lr.lineAt(r.dec.InputOffset()))
+}
+
+// nextText returns the next text of a GeoJSONSeq, texts are separated by a record separator
+// or by a new line if the input does not use record separators
+func (r *Reader) nextText() (json.RawMessage, Position, error) {
+	for {
+		line, err := r.br.ReadBytes('\n')
+		if err != nil && err != io.EOF {
+			return nil, Position{}, errors.Wrap(err, "reading input failed")
+		}
+		eof := err == io.EOF
+		if len(line) > 0 {
+			r.line++
+		}
+
+		trimmed := bytes.TrimSpace(line)
+		if !r.seen && len(trimmed) > 0 {
+			r.seen = true
+			r.rs = trimmed[0] == recordSeparator
+		}
+
+		var text []byte
+		var textLine int
+		switch {
+		case r.rs && len(trimmed) > 0 && trimmed[0] == recordSeparator:
+			// a new text starts, the pending one is complete
+			text, textLine = r.pending, r.pline
+			r.pending = append([]byte(nil), trimmed[1:]...)
+			r.pline = r.line
+		case r.rs:
+			r.pending = append(r.pending, line...)
+		default:
+			text, textLine = trimmed, r.line
+		}
+
+		if eof && r.rs && text == nil {
+			text, textLine = r.pending, r.pline
+			r.pending = nil
+		}
+
+		if len(bytes.TrimSpace(text)) > 0 {
+			raw := json.RawMessage(text)
+			pos := Position{Index: r.index, Line: textLine}
+			if !json.Valid(raw) {
+				return nil, pos, &FeatureError{Position: pos, Err: errors.New("invalid JSON text")}
+			}
+			return raw, pos, nil
+		}
+
+		if eof && len(r.pending) == 0 {
+			return nil, Position{Index: r.index}, io.EOF
+		}
+	}
+}
+
+func isFeatureError(err error) bool {
+	_, ok := err.(*FeatureError)
+	return ok
+}
+
+// lineReader counts the lines of the data read by a json.Decoder,
+// only the data read but not yet accounted for is kept
+type lineReader struct {
+	r    io.Reader
+	buf  []byte
+	base int64
+	line int
+}
+
+func (lr *lineReader) Read(p []byte) (int, error) {
+	n, err := lr.r.Read(p)
+	lr.buf = append(lr.buf, p[:n]...)
+	return n, err
+}
+
+// lineAt returns the line of the first non blank byte at or after offset,
+// offsets must be increasing
+func (lr *lineReader) lineAt(offset int64) int {
+	i := int(offset - lr.base)
+	if i > len(lr.buf) {
+		i = len(lr.buf)
+	}
+	lr.line += bytes.Count(lr.buf[:i], []byte{'\n'})
+	lr.buf = lr.buf[i:]
+	lr.base += int64(i)
+
+	line := lr.line
+	for _, c := range lr.buf {
+		switch c {
+		case '\n':
+			line++
+		case ' ', '\t', '\r', ',':
+		default:
+			return line
+		}
+	}
+	return line
+}
@@ -0,0 +1,122 @@
+package importer
+
+import (
+	"io"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+const (
+	collection = `{
+  "type": "FeatureCollection",
+  "name": "stops",
+  "features": [
+    {"type": "Feature", "id": "a", "properties": {"name": "a"}, "geometry": {"type": "Point", "coordinates": [-71.2275, 46.7984]}},
+    {"type": "Feature", "id": "b", "properties": {"name": "b"}, "geometry": {"type": "Bad", "coordinates": [-71.2301, 46.8012]}},
+    {
+      "type": "Feature", "id": "c", "properties": {"name": "c"},
+      "geometry": {"type": "Point", "coordinates": [-71.2199, 46.8105]}
+    }
+  ],
+  "crs": {"type": "name"}
+}`
+
+	seq = `{"type": "Feature", "id": "a", "properties": {"name": "a"}, "geometry": {"type": "Point", "coordinates": [-71.2275, 46.7984]}}
+{"type": "Feature", "id": "b", "properties": {"name": "b"}, "geometry": {"type": "Point", "coordinates": [-71.2301
+
+{"type": "Feature", "id": "c", "properties": {"name": "c"}, "geometry": {"type": "Point", "coordinates": [-71.2199, 46.8105]}}
+`
+
+	rsSeq = "\x1e{\"type\": \"Feature\", \"id\": \"a\", \"properties\": {},\n\"geometry\": {\"type\": \"Point\", \"coordinates\": [-71.2275, 46.7984]}}\n" +
+		"\x1e{\"type\": \"Feature\", \"id\": \"b\", \"properties\": {}, \"geometry\": {\"type\": \"Point\", \"coordinates\": [-71.2301, 46.8012]}}\n"
+)
+
+// readAll returns the ids or the errors of all the features of r
+func readAll(t *testing.T, r *Reader) ([]string, []Position) {
+	var ids []string
+	var positions []Position
+	for {
+		f, pos, err := r.Next()
+		if err == io.EOF {
+			return ids, positions
+		}
+		if err != nil {
+			require.IsType(t, &FeatureError{}, err)
+			ids = append(ids, "error")
+		} else {
+			ids = append(ids, f.ID)
+		}
+		positions = append(positions, pos)
+	}
+}
+
+func TestReaderFeatureCollection(t *testing.T) {
+	r := NewReader(strings.NewReader(collection), FormatAuto)
+	ids, positions := readAll(t, r)
+	require.Equal(t, FormatFeatureCollection, r.Format())
+	require.Equal(t, []string{"a", "error", "c"}, ids)
+	require.Equal(t, []Position{{0, 5}, {1, 6}, {2, 7}}, positions)
+
+	// on a single line
+	r = NewReader(strings.NewReader(strings.Replace(collection, "\n", "", -1)), FormatAuto)
+	ids, positions = readAll(t, r)
+	require.Equal(t, []string{"a", "error", "c"}, ids)
+	require.Equal(t, Position{2, 1}, positions[2])
+
+	r = NewReader(strings.NewReader(collection), FormatFeatureCollection)
+	require.NoError(t, r.Skip(2))
+	f, pos, err := r.Next()
+	require.NoError(t, err)
+	require.Equal(t, "c", f.ID)
+	require.Equal(t, Position{2, 7}, pos)
+	require.Error(t, r.Skip(1))
+
+	// a feature is not a FeatureCollection
+	r = NewReader(strings.NewReader(`{"type": "Feature", "id": "a"}`), FormatAuto)
+	_, _, err = r.Next()
+	require.Error(t, err)
+	require.False(t, isFeatureError(err))
+
+	// truncated
+	r = NewReader(strings.NewReader(collection[:300]), FormatAuto)
+	_, _, err = r.Next()
+	require.NoError(t, err)
+	_, _, err = r.Next()
+	require.Error(t, err)
+	require.False(t, isFeatureError(err))
+}
+
+func TestReaderSeq(t *testing.T) {
+	r := NewReader(strings.NewReader(seq), FormatAuto)
+	ids, positions := readAll(t, r)
+	require.Equal(t, FormatSeq, r.Format())
+	require.Equal(t, []string{"a", "error", "c"}, ids)
+	require.Equal(t, []Position{{0, 1}, {1, 2}, {2, 4}}, positions)
+
+	r = NewReader(strings.NewReader(seq), FormatSeq)
+	require.NoError(t, r.Skip(2))
+	f, pos, err := r.Next()
+	require.NoError(t, err)
+	require.Equal(t, "c", f.ID)
+	require.Equal(t, Position{2, 4}, pos)
+
+	// RFC 8142 texts can span lines
+	r = NewReader(strings.NewReader(rsSeq), FormatAuto)
+	ids, positions = readAll(t, r)
+	require.Equal(t, FormatSeq, r.Format())
+	require.Equal(t, []string{"a", "b"}, ids)
+	require.Equal(t, []Position{{0, 1}, {1, 3}}, positions)
+}
+
+func TestReaderNumericIDs(t *testing.T) {
+	ids := `{"type": "Feature", "id": 42, "properties": {"osm_id": 9007199254740993}, "geometry": {"type": "Point", "coordinates": [-71.2275, 46.7984]}}
+{"type": "Feature", "id": 4.5, "properties": null, "geometry": {"type": "Point", "coordinates": [-71.2301, 46.8012]}}
+{"type": "Feature", "properties": {}, "geometry": {"type": "Point", "coordinates": [-71.2199, 46.8105]}}
+{"type": "Feature", "id": [1], "properties": {}, "geometry": {"type": "Point", "coordinates": [-71.2199, 46.8105]}}
+`
+	r := NewReader(strings.NewReader(ids), FormatSeq)
+	got, _ := readAll(t, r)
+	require.Equal(t, []string{"42", "4.5", "", "error"}, got)
+}
@@ -0,0 +1,295 @@
+package index
+
+import (
+	"bytes"
+	"context"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/akhenakh/oureadb/index/geodata"
+	"github.com/akhenakh/oureadb/store"
+	"github.com/pkg/errors"
+)
+
+const (
+	// defaultBulkBatchBytes keeps the batches well under the badger transaction size limit
+	defaultBulkBatchBytes = 4 << 20
+
+	// defaultBulkBatchCount is the default maximum number of keys in one batch
+	defaultBulkBatchCount = 10000
+)
+
+// BulkOptions are the options of a BulkIndexer
+type BulkOptions struct {
+	// MaxBatchBytes is the maximum size of the keys and values written in one batch, defaults to 4MB
+	MaxBatchBytes int
+
+	// MaxBatchCount is the maximum number of keys written in one batch, defaults to 10000
+	MaxBatchCount int
+
+	// Progress if not nil is called after every written batch
+	Progress func(stats BulkStats)
+}
+
+// BulkStats are the counters of a BulkIndexer
+type BulkStats struct {
+	// Features is the number of features added
+	Features int
+
+	// Failed is the number of features that could not be added
+	Failed int
+
+	// Keys is the number of keys written
+	Keys int
+
+	// Batches is the number of batches written
+	Batches int
+}
+
+// BulkIndexer accumulates the keys of many features, possibly for several indexes of the same store,
+// then writes them sorted in size bounded batches
+// it is safe to feed it from multiple goroutines, Close must be called to write the remaining keys
+// the keys of a feature may be split over two batches, a failed batch is not retried
+type BulkIndexer struct {
+	kvs  store.KVStore
+	opts BulkOptions
+
+	// protects pending, size and stats
+	mu      sync.Mutex
+	pending []bulkEntry
+	size    int
+	stats   BulkStats
+
+	// serializes the writes
+	flushMu sync.Mutex
+}
+
+// FeatureIndexError is returned by the bulk indexing methods for a feature that can't be indexed,
+// the feature is counted as failed and the following ones can still be added,
+// any other error is an error writing a batch
+type FeatureIndexError struct {
+	ID  GeoID
+	Err error
+}
+
+func (e *FeatureIndexError) Error() string {
+	return errors.Wrapf(e.Err, "indexing %s failed", e.ID).Error()
+}
+
+// Cause returns the error of the feature
+func (e *FeatureIndexError) Cause() error {
+	return e.Err
+}
+
+// bulkEntry is a key value to be written
+// meta is the metadata of the index counting the key, if any
+type bulkEntry struct {
+	k, v []byte
+	meta *metadata
+}
+
+// NewBulkIndexer returns a BulkIndexer writing to s
+func NewBulkIndexer(s store.KVStore, opts *BulkOptions) *BulkIndexer {
+	b := &BulkIndexer{kvs: s}
+	if opts != nil {
+		b.opts = *opts
+	}
+	if b.opts.MaxBatchBytes <= 0 {
+		b.opts.MaxBatchBytes = defaultBulkBatchBytes
+	}
+	if b.opts.MaxBatchCount <= 0 {
+		b.opts.MaxBatchCount = defaultBulkBatchCount
+	}
+	return b
+}
+
+// Stats returns the current counters
+func (b *BulkIndexer) Stats() BulkStats {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.stats
+}
+
+// Flush writes all the pending keys
+func (b *BulkIndexer) Flush() error {
+	return b.FlushContext(context.Background())
+}
+
+// FlushContext is Flush with a context
+func (b *BulkIndexer) FlushContext(ctx context.Context) error {
+	b.mu.Lock()
+	entries := b.pending
+	b.pending = nil
+	b.size = 0
+	b.mu.Unlock()
+
+	return b.write(ctx, entries)
+}
+
+// Close writes all the pending keys
+func (b *BulkIndexer) Close() error {
+	return b.Flush()
+}
+
+// add queues the entries of the feature id, err is the error of the feature returned as a *FeatureIndexError
+// the full batches are written before returning
+func (b *BulkIndexer) add(ctx context.Context, id GeoID, entries []bulkEntry, err error) error {
+	if err != nil {
+		b.mu.Lock()
+		b.stats.Failed++
+		b.mu.Unlock()
+		return &FeatureIndexError{ID: id, Err: err}
+	}
+
+	b.mu.Lock()
+	b.stats.Features++
+	b.mu.Unlock()
+
+	return b.queue(ctx, entries)
+}
+
+// Put queues k v to be written with the index keys, for example the stored data of a feature
+// it is not counted as a feature
+func (b *BulkIndexer) Put(k, v []byte) error {
+	return b.PutContext(context.Background(), k, v)
+}
+
+// PutContext is Put with a context
+func (b *BulkIndexer) PutContext(ctx context.Context, k, v []byte) error {
+	return b.queue(ctx, []bulkEntry{{k: k, v: v}})
+}
+
+// queue adds entries to the pending keys, the full batches are written before returning
+func (b *BulkIndexer) queue(ctx context.Context, entries []bulkEntry) error {
+	var full [][]bulkEntry
+
+	b.mu.Lock()
+	for _, e := range entries {
+		b.pending = append(b.pending, e)
+		b.size += len(e.k) + len(e.v)
+		if b.size >= b.opts.MaxBatchBytes || len(b.pending) >= b.opts.MaxBatchCount {
+			full = append(full, b.pending)
+			b.pending = nil
+			b.size = 0
+		}
+	}
+	b.mu.Unlock()
+
+	for _, entries := range full {
+		if err := b.write(ctx, entries); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// write sorts and writes entries in one batch
+func (b *BulkIndexer) write(ctx context.Context, entries []bulkEntry) error {
+	if len(entries) == 0 {
+		return nil
+	}
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	sort.Slice(entries, func(i, j int) bool { return bytes.Compare(entries[i].k, entries[j].k) < 0 })
+
+	b.flushMu.Lock()
+	defer b.flushMu.Unlock()
+
+	kv, err := b.kvs.Writer()
+	if err != nil {
+		return err
+	}
+	defer kv.Close()
+
+	batch := kv.NewBatch()
+	defer batch.Close()
+
+	for _, e := range entries {
+		batch.Set(e.k, e.v)
+	}
+	commit := addEntries(batch, entries)
+
+	if err := kv.ExecuteBatch(batch); err != nil {
+		return errors.Wrap(err, "writing bulk batch failed")
+	}
+	commit()
+
+	b.mu.Lock()
+	b.stats.Keys += len(entries)
+	b.stats.Batches++
+	stats := b.stats
+	b.mu.Unlock()
+
+	if b.opts.Progress != nil {
+		b.opts.Progress(stats)
+	}
+	return nil
+}
+
+// GeoIndexBulk is GeoIndex adding the keys to b instead of writing them
+// the keys are written when b is flushed, GeoIndexBulk does not replace a previous cover, see GeoReindex
+func (idx *S2FlatIdx) GeoIndexBulk(b *BulkIndexer, gd *geodata.GeoData, id GeoID) error {
+	return idx.GeoIndexBulkContext(context.Background(), b, gd, id)
+}
+
+// GeoIndexBulkContext is GeoIndexBulk with a context
+func (idx *S2FlatIdx) GeoIndexBulkContext(ctx context.Context, b *BulkIndexer, gd *geodata.GeoData, id GeoID) error {
+	entries, err := idx.indexEntries(gd, id)
+	return b.add(ctx, id, entries, err)
+}
+
+// GeoIndexBulk is GeoIndex adding the keys to b instead of writing them
+// the keys are written when b is flushed, GeoIndexBulk does not replace a previous value or cover, see GeoReindex
+func (idx *S2AttrIdx) GeoIndexBulk(b *BulkIndexer, gd *geodata.GeoData, id GeoID) error {
+	return idx.GeoIndexBulkContext(context.Background(), b, gd, id)
+}
+
+// GeoIndexBulkContext is GeoIndexBulk with a context
+func (idx *S2AttrIdx) GeoIndexBulkContext(ctx context.Context, b *BulkIndexer, gd *geodata.GeoData, id GeoID) error {
+	entries, err := idx.indexEntries(gd, id)
+	return b.add(ctx, id, entries, err)
+}
+
+// GeoTimeIndexBulk is GeoTimeIndex adding the keys to b instead of writing them
+// the keys are written when b is flushed
+func (idx *S2FlatTimeIdx) GeoTimeIndexBulk(b *BulkIndexer, gd *geodata.GeoData, t time.Time, id GeoID) error {
+	return idx.GeoTimeIndexBulkContext(context.Background(), b, gd, t, id)
+}
+
+// GeoTimeIndexBulkContext is GeoTimeIndexBulk with a context
+func (idx *S2FlatTimeIdx) GeoTimeIndexBulkContext(ctx context.Context, b *BulkIndexer, gd *geodata.GeoData, t time.Time, id GeoID) error {
+	cu, err := idx.Covering(gd)
+	if err != nil {
+		return b.add(ctx, id, nil, errors.Wrap(err, "generating cover failed"))
+	}
+
+	entries := make([]bulkEntry, len(cu))
+	for i, c := range cu {
+		entries[i] = bulkEntry{k: idx.valuesToKey(c, t, id), meta: idx.meta}
+	}
+	return b.add(ctx, id, entries, nil)
+}
+
+// GeoPointIndexBulk is GeoPointIndex adding the key to b instead of writing it
+// the key is written when b is flushed
+func (idx *S2PointIdx) GeoPointIndexBulk(b *BulkIndexer, gd *geodata.GeoData, id GeoID) error {
+	return idx.GeoPointIndexBulkContext(context.Background(), b, gd, id)
+}
+
+// GeoPointIndexBulkContext is GeoPointIndexBulk with a context
+func (idx *S2PointIdx) GeoPointIndexBulkContext(ctx context.Context, b *BulkIndexer, gd *geodata.GeoData, id GeoID) error {
+	k, err := idx.GeoPointKey(gd, id)
+	if err != nil {
+		return b.add(ctx, id, nil, err)
+	}
+	return b.add(ctx, id, []bulkEntry{{k: k, meta: idx.meta}}, nil)
+}
+
+// PointIndexBulk is PointIndex adding the key to b instead of writing it
+// the key is written when b is flushed
+func (idx *S2PointIdx) PointIndexBulk(b *BulkIndexer, lat, lng float64, id GeoID) error {
+	return b.add(context.Background(), id, []bulkEntry{{k: idx.PointKey(lat, lng, id), meta: idx.meta}}, nil)
+}
@@ -0,0 +1,121 @@
+package index
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/akhenakh/oureadb/index/geodata"
+	"github.com/stretchr/testify/require"
+)
+
+func TestBulkIndexer(t *testing.T) {
+	s := openStore(t)
+	defer cleanup(t, s)
+
+	flat := NewS2FlatIdx(s, []byte("BULKFLAT"), s2Level)
+	timed := NewS2FlatTimeIdx(s, []byte("BULKTIME"), s2Level)
+	point := NewS2PointIdx(s, []byte("BULKPOINT"))
+
+	var progress int
+	b := NewBulkIndexer(s, &BulkOptions{
+		MaxBatchCount: 50,
+		Progress: func(stats BulkStats) {
+			progress++
+		},
+	})
+
+	now := time.Now()
+
+	// feeding from several goroutines, the errors are checked once they are done
+	var wg sync.WaitGroup
+	errs := make(chan error, 4)
+	for w := 0; w < 4; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			errs <- func() error {
+				for i := 0; i < 25; i++ {
+					gd := &geodata.GeoData{
+						Geometry: &geodata.Geometry{
+							Type:        geodata.Geometry_POINT,
+							Coordinates: []float64{quebec[0] + float64(i)*0.0001, quebec[1] + float64(w)*0.0001},
+						},
+					}
+					id := []byte(fmt.Sprintf("%d-%d", w, i))
+					if err := flat.GeoIndexBulk(b, gd, id); err != nil {
+						return err
+					}
+					if err := timed.GeoTimeIndexBulk(b, gd, now, id); err != nil {
+						return err
+					}
+					if err := point.GeoPointIndexBulk(b, gd, id); err != nil {
+						return err
+					}
+				}
+				return nil
+			}()
+		}(w)
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		require.NoError(t, err)
+	}
+
+	// a per feature error
+	err := flat.GeoIndexBulk(b, &geodata.GeoData{}, []byte("invalid"))
+	require.IsType(t, &FeatureIndexError{}, err)
+	require.Equal(t, GeoID("invalid"), err.(*FeatureIndexError).ID)
+
+	require.NoError(t, b.Close())
+
+	stats := b.Stats()
+	require.Equal(t, 300, stats.Features)
+	require.Equal(t, 1, stats.Failed)
+	// flat cell + reverse mapping, time cell, point
+	require.Equal(t, 400, stats.Keys)
+	require.Equal(t, stats.Batches, progress)
+	require.Equal(t, 8, stats.Batches)
+
+	res, err := flat.GeoIdsRadiusQuery(quebec[1], quebec[0], 1000)
+	require.NoError(t, err)
+	require.Len(t, res, 100)
+
+	res, err = timed.GeoTimeIdsRadiusQuery(MaxGeoTime, MinGeoTime, quebec[1], quebec[0], 1000)
+	require.NoError(t, err)
+	require.Len(t, res, 100)
+
+	res, err = point.GeoIdsRadiusQuery(quebec[1], quebec[0], 1000)
+	require.NoError(t, err)
+	require.Len(t, res, 100)
+
+	// bulk indexed ids have their reverse mapping
+	require.NoError(t, flat.GeoUnindex([]byte("0-0")))
+	res, err = flat.GeoIdsRadiusQuery(quebec[1], quebec[0], 1000)
+	require.NoError(t, err)
+	require.Len(t, res, 99)
+}
+
+func TestBulkIndexerBatchBytes(t *testing.T) {
+	s := openStore(t)
+	defer cleanup(t, s)
+
+	point := NewS2PointIdx(s, []byte("BULKPOINT"))
+	b := NewBulkIndexer(s, &BulkOptions{MaxBatchBytes: 1024})
+
+	for i := 0; i < 100; i++ {
+		require.NoError(t, point.PointIndexBulk(b, quebec[1], quebec[0], []byte(fmt.Sprintf("%03d", i))))
+	}
+	require.NoError(t, b.Flush())
+
+	// 9 bytes prefix + 8 bytes cell + 3 bytes id per key
+	stats := b.Stats()
+	require.Equal(t, 100, stats.Keys)
+	require.Equal(t, 2, stats.Batches)
+
+	res, err := point.GeoIdsRadiusQuery(quebec[1], quebec[0], 10)
+	require.NoError(t, err)
+	require.Len(t, res, 100)
+}
@@ -0,0 +1,131 @@
+package index
+
+import (
+	"github.com/golang/geo/s2"
+)
+
+// defaultAdaptiveMaxCells is the cells target of an adaptive cover without MaxCells
+const defaultAdaptiveMaxCells = 8
+
+// CoverParams are the s2.RegionCoverer parameters used to cover the queried regions
+type CoverParams struct {
+	MinLevel int
+	MaxLevel int
+	LevelMod int
+	MaxCells int
+
+	// Adaptive lowers MaxLevel, for every query, to the level whose average cell area
+	// is the closest to the area of the queried region divided by MaxCells
+	// fine cells are used for small regions and coarse ones for large regions,
+	// MinLevel and MaxLevel are the bounds of the picked level
+	Adaptive bool
+}
+
+// coverer returns the s2.RegionCoverer used to cover region
+func (p CoverParams) coverer(region s2.Region) *s2.RegionCoverer {
+	rc := &s2.RegionCoverer{MinLevel: p.MinLevel, MaxLevel: p.MaxLevel, LevelMod: p.LevelMod, MaxCells: p.MaxCells}
+	if !p.Adaptive {
+		return rc
+	}
+
+	cells := p.MaxCells
+	if cells <= 0 {
+		cells = defaultAdaptiveMaxCells
+	}
+	l := s2.AvgAreaMetric.ClosestLevel(region.CapBound().Area() / float64(cells))
+	if l < p.MinLevel {
+		l = p.MinLevel
+	}
+	if l < p.MaxLevel {
+		rc.MaxLevel = l
+	}
+	return rc
+}
+
+// covering returns the cover of region
+func (p CoverParams) covering(region s2.Region) s2.CellUnion {
+	return p.coverer(region).Covering(region)
+}
+
+// atMostLevel returns p with levels not finer than level
+func (p CoverParams) atMostLevel(level int) CoverParams {
+	if p.MinLevel > level {
+		p.MinLevel = level
+	}
+	if p.MaxLevel > level {
+		p.MaxLevel = level
+	}
+	return p
+}
+
+// options are the options shared by the indexes
+type options struct {
+	cover   CoverParams
+	workers int
+	level   int
+}
+
+// Option is an index option, passed to the index constructors
+type Option func(*options)
+
+// WithCoverParams sets all the parameters used to cover the queried regions
+func WithCoverParams(p CoverParams) Option {
+	return func(o *options) {
+		o.cover = p
+	}
+}
+
+// WithCoverLevels sets the min and max levels used to cover the queried regions
+// flat indexes never use cells finer than their level
+func WithCoverLevels(minLevel, maxLevel int) Option {
+	return func(o *options) {
+		o.cover.MinLevel = minLevel
+		o.cover.MaxLevel = maxLevel
+	}
+}
+
+// WithCoverLevelMod sets the level mod used to cover the queried regions
+func WithCoverLevelMod(levelMod int) Option {
+	return func(o *options) {
+		o.cover.LevelMod = levelMod
+	}
+}
+
+// WithCoverMaxCells sets the maximum number of cells used to cover the queried regions
+func WithCoverMaxCells(maxCells int) Option {
+	return func(o *options) {
+		o.cover.MaxCells = maxCells
+	}
+}
+
+// WithAdaptiveCover picks the cover levels from the area of the queried regions
+// see CoverParams.Adaptive
+func WithAdaptiveCover() Option {
+	return func(o *options) {
+		o.cover.Adaptive = true
+	}
+}
+
+// WithScanWorkers sets the number of goroutines scanning the cells of multi cells lookups
+// see SetScanWorkers
+func WithScanWorkers(n int) Option {
+	return func(o *options) {
+		o.workers = n
+	}
+}
+
+// WithLevel sets the level of an index opened without metadata, see OpenS2FlatIdxAlias
+func WithLevel(level int) Option {
+	return func(o *options) {
+		o.level = level
+	}
+}
+
+// newOptions returns the options with defaults cover applied before opts
+func newOptions(cover CoverParams, opts []Option) options {
+	o := options{cover: cover}
+	for _, opt := range opts {
+		opt(&o)
+	}
+	return o
+}
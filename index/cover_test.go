@@ -0,0 +1,117 @@
+package index
+
+import (
+	"testing"
+
+	"github.com/akhenakh/oureadb/index/geodata"
+	"github.com/golang/geo/s2"
+	"github.com/stretchr/testify/require"
+)
+
+func TestAdaptiveCover(t *testing.T) {
+	p := CoverParams{MaxLevel: 30, MaxCells: 8, Adaptive: true}
+	center := s2.PointFromLatLng(s2.LatLngFromDegrees(quebec[1], quebec[0]))
+
+	city := s2.CapFromCenterAngle(center, metersToAngle(1000))
+	continent := s2.CapFromCenterAngle(center, metersToAngle(2000000))
+
+	cityLevel := p.coverer(city).MaxLevel
+	continentLevel := p.coverer(continent).MaxLevel
+	require.True(t, cityLevel > continentLevel)
+	require.True(t, cityLevel < 30)
+
+	for _, c := range p.covering(city) {
+		require.True(t, c.Level() <= cityLevel)
+	}
+
+	// bounded by MinLevel and MaxLevel
+	p.MinLevel = 20
+	require.Equal(t, 20, p.coverer(continent).MaxLevel)
+	p.MinLevel, p.MaxLevel = 0, 4
+	require.Equal(t, 4, p.coverer(city).MaxLevel)
+}
+
+func TestFlatIdxCoverOptions(t *testing.T) {
+	s := openStore(t)
+	defer cleanup(t, s)
+
+	idx := NewS2FlatIdx(s, []byte("COVEROPTS"), s2Level, WithCoverLevels(10, 30), WithCoverMaxCells(4))
+	cells := indexGrid(t, idx, 5)
+	require.Equal(t, CoverParams{MinLevel: 10, MaxLevel: 30, MaxCells: 4}, idx.cover)
+
+	// a coarse cover finds at least the ids of the default cover
+	def := idx.WithCover(CoverParams{MinLevel: s2Level, MaxLevel: s2Level})
+	expected, err := def.GeoIdsRadiusQuery(quebec[1], quebec[0], 200)
+	require.NoError(t, err)
+	require.NotEmpty(t, expected)
+
+	res, err := idx.GeoIdsRadiusQuery(quebec[1], quebec[0], 200)
+	require.NoError(t, err)
+	require.Subset(t, res, expected)
+	require.True(t, len(res) >= len(expected))
+
+	// a cover of the whole grid
+	rect := s2.EmptyRect()
+	for _, c := range cells {
+		rect = rect.AddPoint(c.LatLng())
+	}
+	res, err = idx.GeoIdsRegionQuery(rect)
+	require.NoError(t, err)
+	require.Len(t, res, len(cells))
+
+	matches, err := idx.GeoMatchesRegionQuery(rect)
+	require.NoError(t, err)
+	require.Len(t, matches, len(cells))
+}
+
+func TestPointIdxCoverOptions(t *testing.T) {
+	s := openStore(t)
+	defer cleanup(t, s)
+
+	idx := NewS2PointIdx(s, []byte("COVEROPTS"), WithAdaptiveCover())
+	for i := 0; i < 10; i++ {
+		_, err := idx.PointIndex(quebec[1]+float64(i)*0.001, quebec[0], []byte{byte('a' + i)})
+		require.NoError(t, err)
+	}
+
+	res, err := idx.GeoIdsRadiusQuery(quebec[1], quebec[0], 500)
+	require.NoError(t, err)
+	require.Len(t, res, 5)
+
+	// points are exactly filtered, any cover gives the same result
+	fine := idx.WithCover(CoverParams{MaxLevel: 30, MaxCells: 64})
+	fres, err := fine.GeoIdsRadiusQuery(quebec[1], quebec[0], 500)
+	require.NoError(t, err)
+	require.ElementsMatch(t, res, fres)
+
+	nearest, err := fine.GeoIdsNearest(quebec[1], quebec[0], 3, 1000)
+	require.NoError(t, err)
+	require.Len(t, nearest, 3)
+	require.Equal(t, GeoID("a"), nearest[0].ID)
+}
+
+func TestFlatTimeIdxCoverOptions(t *testing.T) {
+	s := openStore(t)
+	defer cleanup(t, s)
+
+	idx := NewS2FlatTimeIdx(s, []byte("COVEROPTS"), s2Level, WithCoverLevels(12, 30), WithCoverMaxCells(4))
+
+	geo := &geodata.GeoData{
+		Geometry: &geodata.Geometry{
+			Coordinates: paris,
+			Type:        geodata.Geometry_POINT,
+		},
+	}
+	err := idx.GeoTimeIndex(geo, MaxGeoTime.Add(-1), []byte("ID"))
+	require.NoError(t, err)
+
+	cu, err := idx.regionCells(s2.CapFromCenterAngle(s2.PointFromLatLng(s2.LatLngFromDegrees(paris[1], paris[0])), metersToAngle(2000)))
+	require.NoError(t, err)
+	for _, c := range cu {
+		require.Equal(t, s2Level, c.Level())
+	}
+
+	res, err := idx.GeoTimeIdsRadiusQuery(MaxGeoTime, MinGeoTime, 48.850, 2.348, 2000)
+	require.NoError(t, err)
+	require.Len(t, res, 1)
+}
@@ -0,0 +1,102 @@
+package index
+
+import (
+	"context"
+	"time"
+
+	"github.com/golang/geo/s2"
+	"github.com/pkg/errors"
+)
+
+// TimeCellBucket is a parent cell and the start of a time bucket
+type TimeCellBucket struct {
+	Cell s2.CellID
+	Time time.Time
+}
+
+// CountAtLevel returns the number of points inside region per parent cell at level
+// computed by scanning the keys only, use s2tools.CellCountsToGeoJSON to display it
+func (idx *S2PointIdx) CountAtLevel(region s2.Region, level int) (map[s2.CellID]int, error) {
+	return idx.CountAtLevelContext(context.Background(), region, level)
+}
+
+// CountAtLevelContext is CountAtLevel with a context
+func (idx *S2PointIdx) CountAtLevelContext(ctx context.Context, region s2.Region, level int) (map[s2.CellID]int, error) {
+	if level < 0 || level > 30 {
+		return nil, errors.New("invalid level")
+	}
+
+	cu := idx.cover.covering(region)
+
+	ranges := make([]keyRange, len(cu))
+	for i, c := range cu {
+		ranges[i] = leafKeyRange(idx.prefix, c)
+	}
+
+	res := make(map[s2.CellID]int)
+	err := scanCells(ctx, idx.KVStore, idx.prefix, ranges, func(c s2.CellID, _, _ []byte) error {
+		if region.ContainsPoint(c.Point()) {
+			res[c.Parent(level)]++
+		}
+		return nil
+	})
+	return res, err
+}
+
+// CountAtLevel returns the number of index entries intersecting the cover of region per parent cell at level
+// level must be lower or equal to the index level
+// note a geo object indexed in several cells is counted once per cell
+func (idx *S2FlatIdx) CountAtLevel(region s2.Region, level int) (map[s2.CellID]int, error) {
+	return idx.CountAtLevelContext(context.Background(), region, level)
+}
+
+// CountAtLevelContext is CountAtLevel with a context
+func (idx *S2FlatIdx) CountAtLevelContext(ctx context.Context, region s2.Region, level int) (map[s2.CellID]int, error) {
+	if level < 0 || level > idx.level {
+		return nil, errors.New("invalid level, must be lower or equal to the index level")
+	}
+
+	res := make(map[s2.CellID]int)
+	err := scanCells(ctx, idx.KVStore, idx.prefix, idx.regionRanges(region), func(c s2.CellID, _, _ []byte) error {
+		res[c.Parent(level)]++
+		return nil
+	})
+	return res, err
+}
+
+// CountAtLevelByTime returns the number of index entries intersecting the cover of region within time range,
+// per parent cell at level and per time bucket of duration bucket
+// a bucket of 0 counts the whole time range in one bucket with a zero Time
+// note a geo object indexed in several cells is counted once per cell
+func (idx *S2FlatTimeIdx) CountAtLevelByTime(from time.Time, to time.Time, region s2.Region, level int, bucket time.Duration) (map[TimeCellBucket]int, error) {
+	return idx.CountAtLevelByTimeContext(context.Background(), from, to, region, level, bucket)
+}
+
+// CountAtLevelByTimeContext is CountAtLevelByTime with a context
+func (idx *S2FlatTimeIdx) CountAtLevelByTimeContext(ctx context.Context, from time.Time, to time.Time, region s2.Region, level int, bucket time.Duration) (map[TimeCellBucket]int, error) {
+	if level < 0 || level > idx.level {
+		return nil, errors.New("invalid level, must be lower or equal to the index level")
+	}
+
+	// the coarse cells are scanned for all times
+	res := make(map[TimeCellBucket]int)
+	err := scanCells(ctx, idx.KVStore, idx.prefix, idx.regionRanges(region), func(c s2.CellID, k, _ []byte) error {
+		_, t, _, err := idx.keyToValues(k)
+		if err != nil {
+			return errors.Wrap(err, "read back failed key from db")
+		}
+		if t.After(from) || !t.After(to) {
+			return nil
+		}
+		b := TimeCellBucket{Cell: c.Parent(level)}
+		if bucket > 0 {
+			b.Time = t.Truncate(bucket)
+		}
+		res[b]++
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return res, nil
+}
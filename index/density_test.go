@@ -0,0 +1,101 @@
+package index
+
+import (
+	"testing"
+	"time"
+
+	"github.com/akhenakh/oureadb/index/geodata"
+	"github.com/golang/geo/s2"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPointCountAtLevel(t *testing.T) {
+	s := openStore(t)
+	defer cleanup(t, s)
+
+	idx := NewS2PointIdx(s, []byte("DENSITY"))
+
+	for i := 0; i < 10; i++ {
+		_, err := idx.PointIndex(quebec[1]+float64(i)*0.001, quebec[0], []byte{byte('a' + i)})
+		require.NoError(t, err)
+	}
+	_, err := idx.PointIndex(paris[1], paris[0], []byte("paris"))
+	require.NoError(t, err)
+
+	center := s2.PointFromLatLng(s2.LatLngFromDegrees(quebec[1], quebec[0]))
+	cap := s2.CapFromCenterArea(center, s2RadialAreaMeters(5000))
+
+	counts, err := idx.CountAtLevel(cap, 8)
+	require.NoError(t, err)
+	require.Len(t, counts, 1)
+	for c, n := range counts {
+		require.Equal(t, 8, c.Level())
+		require.Equal(t, 10, n)
+	}
+
+	counts, err = idx.CountAtLevel(cap, 16)
+	require.NoError(t, err)
+	var total int
+	for _, n := range counts {
+		total += n
+	}
+	require.Equal(t, 10, total)
+	require.True(t, len(counts) > 1)
+}
+
+func TestTimeCountAtLevel(t *testing.T) {
+	s := openStore(t)
+	defer cleanup(t, s)
+
+	idx := NewS2FlatTimeIdx(s, []byte("DENSITYTIME"), s2Level)
+
+	geo := &geodata.GeoData{
+		Geometry: &geodata.Geometry{
+			Coordinates: paris,
+			Type:        geodata.Geometry_POINT,
+		},
+	}
+
+	now := time.Now().Truncate(time.Hour)
+	for i := 0; i < 6; i++ {
+		err := idx.GeoTimeIndex(geo, now.Add(time.Duration(i)*20*time.Minute), []byte{byte('a' + i)})
+		require.NoError(t, err)
+	}
+
+	center := s2.PointFromLatLng(s2.LatLngFromDegrees(paris[1], paris[0]))
+	cap := s2.CapFromCenterArea(center, s2RadialAreaMeters(1000))
+
+	counts, err := idx.CountAtLevelByTime(MaxGeoTime, MinGeoTime, cap, 10, time.Hour)
+	require.NoError(t, err)
+	require.Len(t, counts, 2)
+	cell := s2.CellIDFromLatLng(s2.LatLngFromDegrees(paris[1], paris[0])).Parent(10)
+	require.Equal(t, 3, counts[TimeCellBucket{Cell: cell, Time: now}])
+	require.Equal(t, 3, counts[TimeCellBucket{Cell: cell, Time: now.Add(time.Hour)}])
+
+	_, err = idx.CountAtLevelByTime(MaxGeoTime, MinGeoTime, cap, 20, time.Hour)
+	require.Error(t, err)
+}
+
+func TestFlatCountAtLevel(t *testing.T) {
+	s := openStore(t)
+	defer cleanup(t, s)
+
+	idx := NewS2FlatIdx(s, []byte("DENSITYFLAT"), s2Level)
+
+	geo := &geodata.GeoData{
+		Geometry: &geodata.Geometry{
+			Coordinates: quebec,
+			Type:        geodata.Geometry_POINT,
+		},
+	}
+	require.NoError(t, idx.GeoIndex(geo, []byte("a")))
+	require.NoError(t, idx.GeoIndex(geo, []byte("b")))
+
+	center := s2.PointFromLatLng(s2.LatLngFromDegrees(quebec[1], quebec[0]))
+	cap := s2.CapFromCenterArea(center, s2RadialAreaMeters(1000))
+
+	counts, err := idx.CountAtLevel(cap, 12)
+	require.NoError(t, err)
+	require.Len(t, counts, 1)
+	require.Equal(t, 2, counts[s2.CellID(quebecCellID).Parent(12)])
+}
@@ -33,10 +33,13 @@ const _ = proto.ProtoPackageIsVersion2 // please upgrade the proto package
 type Geometry_Type int32
 
 const (
-	Geometry_POINT        Geometry_Type = 0
-	Geometry_POLYGON      Geometry_Type = 1
-	Geometry_MULTIPOLYGON Geometry_Type = 2
-	Geometry_LINESTRING   Geometry_Type = 3
+	Geometry_POINT              Geometry_Type = 0
+	Geometry_POLYGON            Geometry_Type = 1
+	Geometry_MULTIPOLYGON       Geometry_Type = 2
+	Geometry_LINESTRING         Geometry_Type = 3
+	Geometry_MULTIPOINT         Geometry_Type = 4
+	Geometry_MULTILINESTRING    Geometry_Type = 5
+	Geometry_GEOMETRYCOLLECTION Geometry_Type = 6
 )
 
 var Geometry_Type_name = map[int32]string{
@@ -44,12 +47,18 @@ var Geometry_Type_name = map[int32]string{
 	1: "POLYGON",
 	2: "MULTIPOLYGON",
 	3: "LINESTRING",
+	4: "MULTIPOINT",
+	5: "MULTILINESTRING",
+	6: "GEOMETRYCOLLECTION",
 }
 var Geometry_Type_value = map[string]int32{
-	"POINT":        0,
-	"POLYGON":      1,
-	"MULTIPOLYGON": 2,
-	"LINESTRING":   3,
+	"POINT":              0,
+	"POLYGON":            1,
+	"MULTIPOLYGON":       2,
+	"LINESTRING":         3,
+	"MULTIPOINT":         4,
+	"MULTILINESTRING":    5,
+	"GEOMETRYCOLLECTION": 6,
 }
 
 func (x Geometry_Type) String() string {
@@ -57,10 +66,39 @@ func (x Geometry_Type) String() string {
 }
 func (Geometry_Type) EnumDescriptor() ([]byte, []int) { return fileDescriptor0, []int{0, 0} }
 
+type Geometry_Layout int32
+
+const (
+	Geometry_XY   Geometry_Layout = 0
+	Geometry_XYZ  Geometry_Layout = 1
+	Geometry_XYM  Geometry_Layout = 2
+	Geometry_XYZM Geometry_Layout = 3
+)
+
+var Geometry_Layout_name = map[int32]string{
+	0: "XY",
+	1: "XYZ",
+	2: "XYM",
+	3: "XYZM",
+}
+var Geometry_Layout_value = map[string]int32{
+	"XY":   0,
+	"XYZ":  1,
+	"XYM":  2,
+	"XYZM": 3,
+}
+
+func (x Geometry_Layout) String() string {
+	return proto.EnumName(Geometry_Layout_name, int32(x))
+}
+func (Geometry_Layout) EnumDescriptor() ([]byte, []int) { return fileDescriptor0, []int{0, 1} }
+
 type Geometry struct {
-	Type        Geometry_Type `protobuf:"varint,1,opt,name=type,enum=geodata.Geometry_Type" json:"type,omitempty"`
-	Geometries  []*Geometry   `protobuf:"bytes,2,rep,name=geometries" json:"geometries,omitempty"`
-	Coordinates []float64     `protobuf:"fixed64,3,rep,packed,name=coordinates" json:"coordinates,omitempty"`
+	Type        Geometry_Type   `protobuf:"varint,1,opt,name=type,enum=geodata.Geometry_Type" json:"type,omitempty"`
+	Geometries  []*Geometry     `protobuf:"bytes,2,rep,name=geometries" json:"geometries,omitempty"`
+	Coordinates []float64       `protobuf:"fixed64,3,rep,packed,name=coordinates" json:"coordinates,omitempty"`
+	Ends        []int32         `protobuf:"varint,4,rep,packed,name=ends" json:"ends,omitempty"`
+	Layout      Geometry_Layout `protobuf:"varint,5,opt,name=layout,enum=geodata.Geometry_Layout" json:"layout,omitempty"`
 }
 
 func (m *Geometry) Reset()                    { *m = Geometry{} }
@@ -76,8 +114,9 @@ func (m *Geometry) GetGeometries() []*Geometry {
 }
 
 type GeoData struct {
-	Geometry   *Geometry                         `protobuf:"bytes,1,opt,name=geometry" json:"geometry,omitempty"`
-	Properties map[string]*google_protobuf.Value `protobuf:"bytes,2,rep,name=properties" json:"properties,omitempty" protobuf_key:"bytes,1,opt,name=key" protobuf_val:"bytes,2,opt,name=value"`
+	Geometry     *Geometry                         `protobuf:"bytes,1,opt,name=geometry" json:"geometry,omitempty"`
+	Properties   map[string]*google_protobuf.Value `protobuf:"bytes,2,rep,name=properties" json:"properties,omitempty" protobuf_key:"bytes,1,opt,name=key" protobuf_val:"bytes,2,opt,name=value"`
+	ExactNumbers map[string]string                 `protobuf:"bytes,3,rep,name=exact_numbers,json=exactNumbers" json:"exact_numbers,omitempty" protobuf_key:"bytes,1,opt,name=key" protobuf_val:"bytes,2,opt,name=value"`
 }
 
 func (m *GeoData) Reset()                    { *m = GeoData{} }
@@ -99,34 +138,51 @@ func (m *GeoData) GetProperties() map[string]*google_protobuf.Value {
 	return nil
 }
 
+func (m *GeoData) GetExactNumbers() map[string]string {
+	if m != nil {
+		return m.ExactNumbers
+	}
+	return nil
+}
+
 func init() {
 	proto.RegisterType((*Geometry)(nil), "geodata.Geometry")
 	proto.RegisterType((*GeoData)(nil), "geodata.GeoData")
 	proto.RegisterEnum("geodata.Geometry_Type", Geometry_Type_name, Geometry_Type_value)
+	proto.RegisterEnum("geodata.Geometry_Layout", Geometry_Layout_name, Geometry_Layout_value)
 }
 
 func init() { proto.RegisterFile("geodata.proto", fileDescriptor0) }
 
 var fileDescriptor0 = []byte{
-	// 314 bytes of a gzipped FileDescriptorProto
-	0x1f, 0x8b, 0x08, 0x00, 0x00, 0x09, 0x6e, 0x88, 0x02, 0xff, 0x6c, 0x91, 0x41, 0x4f, 0xfa, 0x40,
-	0x10, 0xc5, 0xff, 0xdb, 0xc2, 0x1f, 0x18, 0x14, 0xeb, 0x1c, 0x48, 0x43, 0x3c, 0x34, 0x9c, 0x88,
-	0xd1, 0x25, 0xe2, 0xc5, 0x78, 0xe2, 0x20, 0x69, 0x9a, 0x60, 0x21, 0xb5, 0x98, 0x78, 0x2c, 0x30,
-	0x36, 0x44, 0x64, 0x9b, 0x65, 0x31, 0xe9, 0x87, 0xf4, 0xe0, 0x37, 0x32, 0xdd, 0x52, 0x68, 0xd4,
-	0xdb, 0xee, 0x9b, 0xdf, 0xcc, 0x9b, 0x97, 0x81, 0xd3, 0x98, 0xc4, 0x32, 0x52, 0x11, 0x4f, 0xa4,
-	0x50, 0x02, 0x6b, 0xfb, 0x6f, 0xe7, 0x22, 0x16, 0x22, 0x5e, 0x53, 0x5f, 0xcb, 0xf3, 0xdd, 0x6b,
-	0x7f, 0xab, 0xe4, 0x6e, 0xa1, 0x72, 0xac, 0xfb, 0xc9, 0xa0, 0xee, 0x92, 0x78, 0x27, 0x25, 0x53,
-	0xbc, 0x84, 0x8a, 0x4a, 0x13, 0xb2, 0x99, 0xc3, 0x7a, 0xad, 0x41, 0x9b, 0x17, 0x13, 0x0b, 0x80,
-	0x87, 0x69, 0x42, 0x81, 0x66, 0xf0, 0x06, 0x20, 0xce, 0xe5, 0x15, 0x6d, 0x6d, 0xc3, 0x31, 0x7b,
-	0xcd, 0xc1, 0xf9, 0xaf, 0x8e, 0xa0, 0x04, 0xa1, 0x03, 0xcd, 0x85, 0x10, 0x72, 0xb9, 0xda, 0x44,
-	0x8a, 0xb6, 0xb6, 0xe9, 0x98, 0x3d, 0x16, 0x94, 0xa5, 0xee, 0x10, 0x2a, 0x99, 0x05, 0x36, 0xa0,
-	0x3a, 0x9d, 0x78, 0x7e, 0x68, 0xfd, 0xc3, 0x26, 0xd4, 0xa6, 0x93, 0xf1, 0x8b, 0x3b, 0xf1, 0x2d,
-	0x86, 0x16, 0x9c, 0x3c, 0xce, 0xc6, 0xa1, 0x57, 0x28, 0x06, 0xb6, 0x00, 0xc6, 0x9e, 0x3f, 0x7a,
-	0x0a, 0x03, 0xcf, 0x77, 0x2d, 0xb3, 0xfb, 0xc5, 0xa0, 0xe6, 0x92, 0x78, 0x88, 0x54, 0x84, 0xd7,
-	0x50, 0xdf, 0xbb, 0xa7, 0x3a, 0xd2, 0x9f, 0x0b, 0x1e, 0x10, 0x1c, 0x02, 0x24, 0x52, 0x24, 0x24,
-	0xd5, 0x31, 0x91, 0x53, 0x6e, 0xc8, 0x86, 0xf2, 0xe9, 0x01, 0x19, 0x6d, 0x74, 0xc0, 0x63, 0x4f,
-	0x67, 0x06, 0x67, 0x3f, 0xca, 0x68, 0x81, 0xf9, 0x46, 0xb9, 0x7d, 0x23, 0xc8, 0x9e, 0x78, 0x05,
-	0xd5, 0x8f, 0x68, 0xbd, 0x23, 0xdb, 0xd0, 0x2b, 0xb5, 0x79, 0x7e, 0x1f, 0x5e, 0xdc, 0x87, 0x3f,
-	0x67, 0xd5, 0x20, 0x87, 0xee, 0x8d, 0x3b, 0x36, 0xff, 0xaf, 0x4b, 0xb7, 0xdf, 0x01, 0x00, 0x00,
-	0xff, 0xff, 0x6d, 0x38, 0x0e, 0xdc, 0xe2, 0x01, 0x00, 0x00,
+	// 455 bytes of a gzipped FileDescriptorProto
+	0x1f, 0x8b, 0x08, 0x00, 0x00, 0x00, 0x00, 0x00, 0x02, 0xff, 0x6c, 0x92, 0x4d, 0x6f, 0xd3, 0x40,
+	0x10, 0x86, 0xeb, 0xcf, 0x24, 0x93, 0x7e, 0x6c, 0x07, 0x14, 0x59, 0x11, 0x07, 0xcb, 0xa7, 0x08,
+	0x15, 0x17, 0xc2, 0x05, 0x71, 0x01, 0xa9, 0x58, 0x96, 0x25, 0xc7, 0x8e, 0x8c, 0x8b, 0xe2, 0x5e,
+	0x90, 0x93, 0x2c, 0x51, 0x45, 0x9a, 0xb5, 0x9c, 0x35, 0xc2, 0x07, 0x7e, 0x29, 0xff, 0x05, 0x21,
+	0xef, 0x26, 0xad, 0xd5, 0xe4, 0x36, 0xf3, 0xee, 0x33, 0xef, 0xce, 0xee, 0x0c, 0x9c, 0xad, 0x28,
+	0x5b, 0xe6, 0x3c, 0x77, 0x8b, 0x92, 0x71, 0x86, 0x9d, 0x5d, 0x3a, 0x7c, 0xb5, 0x62, 0x6c, 0xb5,
+	0xa6, 0xd7, 0x42, 0x9e, 0x57, 0x3f, 0xae, 0xb7, 0xbc, 0xac, 0x16, 0x5c, 0x62, 0xce, 0x3f, 0x15,
+	0xba, 0x3e, 0x65, 0x0f, 0x94, 0x97, 0x35, 0xbe, 0x06, 0x9d, 0xd7, 0x05, 0xb5, 0x14, 0x5b, 0x19,
+	0x9d, 0x8f, 0x07, 0xee, 0xde, 0x71, 0x0f, 0xb8, 0x69, 0x5d, 0xd0, 0x44, 0x30, 0xf8, 0x0e, 0x60,
+	0x25, 0xe5, 0x7b, 0xba, 0xb5, 0x54, 0x5b, 0x1b, 0xf5, 0xc7, 0x97, 0x07, 0x15, 0x49, 0x0b, 0x42,
+	0x1b, 0xfa, 0x0b, 0xc6, 0xca, 0xe5, 0xfd, 0x26, 0xe7, 0x74, 0x6b, 0x69, 0xb6, 0x36, 0x52, 0x92,
+	0xb6, 0x84, 0x08, 0x3a, 0xdd, 0x2c, 0xb7, 0x96, 0x6e, 0x6b, 0x23, 0x23, 0x11, 0x31, 0xbe, 0x05,
+	0x73, 0x9d, 0xd7, 0xac, 0xe2, 0x96, 0x21, 0xda, 0xb2, 0x0e, 0xdb, 0x0a, 0xc5, 0x79, 0xb2, 0xe3,
+	0x9c, 0x3f, 0xa0, 0x37, 0x8d, 0x62, 0x0f, 0x8c, 0x69, 0x1c, 0x44, 0x29, 0x39, 0xc1, 0x3e, 0x74,
+	0xa6, 0x71, 0x98, 0xf9, 0x71, 0x44, 0x14, 0x24, 0x70, 0x3a, 0xb9, 0x0d, 0xd3, 0x60, 0xaf, 0xa8,
+	0x78, 0x0e, 0x10, 0x06, 0x91, 0xf7, 0x35, 0x4d, 0x82, 0xc8, 0x27, 0x5a, 0x93, 0xef, 0x88, 0xa6,
+	0x5c, 0xc7, 0x17, 0x70, 0x21, 0xf2, 0x16, 0x64, 0xe0, 0x00, 0xd0, 0xf7, 0xe2, 0x89, 0x97, 0x26,
+	0xd9, 0x4d, 0x1c, 0x86, 0xde, 0x4d, 0x1a, 0xc4, 0x11, 0x31, 0x9d, 0x2b, 0x30, 0x65, 0x43, 0x68,
+	0x82, 0x3a, 0xcb, 0xc8, 0x09, 0x76, 0x40, 0x9b, 0x65, 0x77, 0x44, 0x91, 0xc1, 0x84, 0xa8, 0xd8,
+	0x05, 0x7d, 0x96, 0xdd, 0x4d, 0x88, 0xe6, 0xfc, 0x55, 0xa1, 0xe3, 0x53, 0xf6, 0x25, 0xe7, 0x39,
+	0xbe, 0x81, 0xee, 0xee, 0xbb, 0x6a, 0x31, 0x83, 0xa3, 0x3f, 0xfa, 0x88, 0xe0, 0x67, 0x80, 0xa2,
+	0x64, 0x05, 0x2d, 0xf9, 0xd3, 0x08, 0xec, 0x76, 0x41, 0x63, 0xea, 0x4e, 0x1f, 0x11, 0x6f, 0x23,
+	0x26, 0xf2, 0x54, 0x83, 0x3e, 0x9c, 0xd1, 0xdf, 0xf9, 0x82, 0x7f, 0xdf, 0x54, 0x0f, 0x73, 0x5a,
+	0xca, 0x99, 0xf4, 0xc7, 0xce, 0x81, 0x89, 0xd7, 0x50, 0x91, 0x84, 0xa4, 0xcd, 0x29, 0x6d, 0x49,
+	0xc3, 0x5b, 0xb8, 0x78, 0x76, 0x0f, 0x12, 0xd0, 0x7e, 0x52, 0xf9, 0x8e, 0x5e, 0xd2, 0x84, 0x78,
+	0x05, 0xc6, 0xaf, 0x7c, 0x5d, 0x51, 0x4b, 0x15, 0x6f, 0x1b, 0xb8, 0x72, 0x33, 0xdd, 0xfd, 0x66,
+	0xba, 0xdf, 0x9a, 0xd3, 0x44, 0x42, 0x1f, 0xd5, 0x0f, 0xca, 0xf0, 0x13, 0x5c, 0x1e, 0xdc, 0x7c,
+	0xc4, 0xf8, 0x65, 0xdb, 0xb8, 0xd7, 0x32, 0x98, 0x9b, 0xc2, 0xfb, 0xfd, 0xff, 0x01, 0x00, 0x15,
+	0xd6, 0x7e, 0x5d, 0x1d, 0x03, 0x00, 0x00,
 }
@@ -0,0 +1,61 @@
+package geodata
+
+import (
+	"github.com/pkg/errors"
+	"github.com/twpayne/go-geom"
+)
+
+// Stride returns the number of values of each position in g.Coordinates
+func (g *Geometry) Stride() int {
+	return g.geomLayout().Stride()
+}
+
+// XYCoordinates returns the lng lat of every position in g.Coordinates, the altitudes and measures removed
+func (g *Geometry) XYCoordinates() ([]float64, error) {
+	return xyCoordinates(g.Coordinates, g.Stride())
+}
+
+// geomLayout returns the geom.Layout of g
+func (g *Geometry) geomLayout() geom.Layout {
+	switch g.Layout {
+	case Geometry_XYZ:
+		return geom.XYZ
+	case Geometry_XYM:
+		return geom.XYM
+	case Geometry_XYZM:
+		return geom.XYZM
+	default:
+		return geom.XY
+	}
+}
+
+// layoutFromGeom returns the Geometry layout of l, no layout is XY
+func layoutFromGeom(l geom.Layout) (Geometry_Layout, error) {
+	switch l {
+	case geom.NoLayout, geom.XY:
+		return Geometry_XY, nil
+	case geom.XYZ:
+		return Geometry_XYZ, nil
+	case geom.XYM:
+		return Geometry_XYM, nil
+	case geom.XYZM:
+		return Geometry_XYZM, nil
+	default:
+		return Geometry_XY, errors.Errorf("unsupported layout %s", l)
+	}
+}
+
+// xyCoordinates returns the lng lat of every position of c, c is returned for a stride of 2
+func xyCoordinates(c []float64, stride int) ([]float64, error) {
+	if len(c)%stride != 0 {
+		return nil, errors.Errorf("invalid coordinates count %d for a stride of %d", len(c), stride)
+	}
+	if stride == 2 {
+		return c, nil
+	}
+	xy := make([]float64, 0, len(c)/stride*2)
+	for i := 0; i < len(c); i += stride {
+		xy = append(xy, c[i], c[i+1])
+	}
+	return xy, nil
+}
@@ -0,0 +1,120 @@
+package geodata
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/golang/geo/s2"
+	"github.com/golang/protobuf/proto"
+	"github.com/stretchr/testify/require"
+	"github.com/twpayne/go-geom"
+	"github.com/twpayne/go-geom/encoding/geojson"
+)
+
+const droneGeoJSON = `{"type":"FeatureCollection","features":[
+{"type":"Feature","properties":{"name":"track"},"geometry":{"type":"LineString","coordinates":[[-71.2641,46.8373,120.5],[-71.2504,46.8432,130],[-71.2368,46.8491,95.25]]}},
+{"type":"Feature","properties":{"name":"zone"},"geometry":{"type":"Polygon","coordinates":[[[-71.24,46.79,10],[-71.22,46.79,10],[-71.22,46.81,12],[-71.24,46.81,12],[-71.24,46.79,10]],[[-71.235,46.795,11],[-71.235,46.805,11],[-71.225,46.805,11],[-71.225,46.795,11],[-71.235,46.795,11]]]}},
+{"type":"Feature","properties":{"name":"stops"},"geometry":{"type":"MultiPoint","coordinates":[[-71.2275,46.7984,50,1],[-71.2301,46.8012,60,2]]}}]}`
+
+func TestLayouts(t *testing.T) {
+	var fc geojson.FeatureCollection
+	require.NoError(t, json.Unmarshal([]byte(droneGeoJSON), &fc))
+
+	layouts := []Geometry_Layout{Geometry_XYZ, Geometry_XYZ, Geometry_XYZM}
+	var geos []*GeoData
+	for i, f := range fc.Features {
+		gd := &GeoData{}
+		require.NoError(t, GeoJSONFeatureToGeoData(f, gd))
+		require.Equal(t, layouts[i], gd.Geometry.Layout)
+		geos = append(geos, gd)
+
+		// the 2D geometry
+		xy := geom.T(nil)
+		switch g := f.Geometry.(type) {
+		case *geom.LineString:
+			xy = geom.NewLineStringFlat(geom.XY, dropDims(g.FlatCoords(), g.Stride()))
+		case *geom.Polygon:
+			xy = geom.NewPolygonFlat(geom.XY, dropDims(g.FlatCoords(), g.Stride()), []int{10, 20})
+		case *geom.MultiPoint:
+			xy = geom.NewMultiPointFlat(geom.XY, dropDims(g.FlatCoords(), g.Stride()))
+		}
+		gdxy := &GeoData{}
+		require.NoError(t, GeomToGeoData(xy, gdxy))
+
+		// covers only use lng lat
+		coverer := &s2.RegionCoverer{MinLevel: 10, MaxLevel: 16, MaxCells: 16}
+		cu, err := gd.Cover(coverer)
+		require.NoError(t, err)
+		cuxy, err := gdxy.Cover(coverer)
+		require.NoError(t, err)
+		require.Equal(t, cuxy, cu)
+
+		rect, err := GeoDataToRect(gd)
+		require.NoError(t, err)
+		rectxy, err := GeoDataToRect(gdxy)
+		require.NoError(t, err)
+		require.True(t, rect.ApproxEqual(rectxy))
+
+		// the extra dimensions are kept
+		g, err := GeoDataToGeom(gd)
+		require.NoError(t, err)
+		require.Equal(t, f.Geometry.Layout(), g.Layout())
+		require.Equal(t, membersCoords(f.Geometry), membersCoords(g))
+
+		// protobuf round trip
+		b, err := proto.Marshal(gd)
+		require.NoError(t, err)
+		gd2 := &GeoData{}
+		require.NoError(t, proto.Unmarshal(b, gd2))
+		require.True(t, proto.Equal(gd, gd2))
+	}
+
+	xyz, err := geos[0].Geometry.XYCoordinates()
+	require.NoError(t, err)
+	require.Equal(t, []float64{-71.2641, 46.8373, -71.2504, 46.8432, -71.2368, 46.8491}, xyz)
+	require.Equal(t, []int32{15, 30}, geos[1].Geometry.Ends)
+	require.Equal(t, 4, geos[2].Geometry.Geometries[1].Stride())
+
+	// the hole is not covered
+	region, err := GeoDataToRegion(geos[1])
+	require.NoError(t, err)
+	require.False(t, region.ContainsPoint(s2.PointFromLatLng(s2.LatLngFromDegrees(46.8, -71.23))))
+	require.True(t, region.ContainsPoint(s2.PointFromLatLng(s2.LatLngFromDegrees(46.8, -71.238))))
+
+	// GeoJSON output keeps the altitudes
+	out, err := ToGeoJSONFeatureCollection(geos[:2])
+	require.NoError(t, err)
+	var fc2 geojson.FeatureCollection
+	require.NoError(t, json.Unmarshal(out, &fc2))
+	require.Equal(t, geom.XYZ, fc2.Features[0].Geometry.Layout())
+	require.Equal(t, fc.Features[0].Geometry.FlatCoords(), fc2.Features[0].Geometry.FlatCoords())
+
+	points := []*GeoData{
+		{Geometry: &Geometry{Type: Geometry_POINT, Coordinates: []float64{-71.2641, 46.8373, 120.5}, Layout: Geometry_XYZ}},
+		{Geometry: &Geometry{Type: Geometry_POINT, Coordinates: []float64{-71.2504, 46.8432, 130}, Layout: Geometry_XYZ}},
+	}
+	out, err = PointsToGeoJSONPolyLines(points)
+	require.NoError(t, err)
+	var f geojson.Feature
+	require.NoError(t, json.Unmarshal(out, &f))
+	require.Equal(t, geom.XYZ, f.Geometry.Layout())
+	require.Equal(t, []float64{-71.2641, 46.8373, 120.5, -71.2504, 46.8432, 130}, f.Geometry.FlatCoords())
+
+	points[1].Geometry.Layout = Geometry_XY
+	_, err = PointsToGeoJSONPolyLines(points)
+	require.Error(t, err)
+
+	// a coordinates count not matching the layout
+	bad := &GeoData{Geometry: &Geometry{Type: Geometry_LINESTRING, Coordinates: []float64{-71.2641, 46.8373, 120.5, -71.2504}, Layout: Geometry_XYZ}}
+	_, err = bad.Cover(&s2.RegionCoverer{MinLevel: 10, MaxLevel: 16})
+	require.Error(t, err)
+}
+
+// dropDims returns the lng lat of the flat coordinates c
+func dropDims(c []float64, stride int) []float64 {
+	var xy []float64
+	for i := 0; i < len(c); i += stride {
+		xy = append(xy, c[i], c[i+1])
+	}
+	return xy
+}
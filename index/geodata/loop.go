@@ -1,6 +1,9 @@
 package geodata
 
-import "github.com/golang/geo/s2"
+import (
+	"github.com/golang/geo/s2"
+	"github.com/pkg/errors"
+)
 
 // LoopFromCoordinates creates a LoopFence from a list of lng lat
 func LoopFromCoordinates(c []float64) *s2.Loop {
@@ -35,3 +38,71 @@ func LoopFromCoordinatesAndCCW(c []float64, checkCCW bool) *s2.Loop {
 	loop := s2.LoopFromPoints(points)
 	return loop
 }
+
+// RingEnds returns the offsets in g.Coordinates where each ring of a polygon ends,
+// a polygon without Ends is a single ring
+func (g *Geometry) RingEnds() []int {
+	if len(g.Ends) == 0 {
+		return []int{len(g.Coordinates)}
+	}
+	ends := make([]int, len(g.Ends))
+	for i, e := range g.Ends {
+		ends[i] = int(e)
+	}
+	return ends
+}
+
+// rings returns the lng lat coordinates of every ring of a polygon, the outer ring first
+func (g *Geometry) rings() ([][]float64, error) {
+	var rings [][]float64
+	var start int
+	for _, end := range g.RingEnds() {
+		if end <= start || end > len(g.Coordinates) {
+			return nil, errors.Errorf("invalid ring end %d", end)
+		}
+		r, err := xyCoordinates(g.Coordinates[start:end], g.Stride())
+		if err != nil {
+			return nil, err
+		}
+		rings = append(rings, r)
+		start = end
+	}
+	if start != len(g.Coordinates) {
+		return nil, errors.New("coordinates after the last ring end")
+	}
+	return rings, nil
+}
+
+// polygonFromRings returns a polygon from a list of lng, lat rings, the first one being the outer ring
+// the others the holes, every loop is normalized so the rings orientation does not matter
+func polygonFromRings(rings [][]float64) (*s2.Polygon, error) {
+	loops := make([]*s2.Loop, len(rings))
+	for i, r := range rings {
+		if len(r) < 6 {
+			return nil, errors.New("invalid polygons not enough coordinates for a closed polygon")
+		}
+		if len(r)%2 != 0 {
+			return nil, errors.New("invalid polygons odd coordinates number")
+		}
+
+		l, err := normalizedLoop(r)
+		if err != nil {
+			return nil, err
+		}
+		loops[i] = l
+	}
+	return s2.PolygonFromLoops(loops), nil
+}
+
+// ringsEnds returns the ends to store in Geometry.Ends for a polygon with ring ends,
+// nil for a polygon without holes
+func ringsEnds(ends []int) []int32 {
+	if len(ends) <= 1 {
+		return nil
+	}
+	res := make([]int32, len(ends))
+	for i, e := range ends {
+		res[i] = int32(e)
+	}
+	return res
+}
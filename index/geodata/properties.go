@@ -0,0 +1,227 @@
+package geodata
+
+import (
+	"bytes"
+	"encoding/json"
+	"math"
+	"math/big"
+	"strconv"
+	"strings"
+
+	spb "github.com/golang/protobuf/ptypes/struct"
+	"github.com/pkg/errors"
+	"github.com/twpayne/go-geom/encoding/geojson"
+)
+
+// UnmarshalGeoJSONFeature decodes the GeoJSON feature data into f,
+// the numbers of the properties are decoded as json.Number so large integers are not rounded
+// and a numeric id is kept as its JSON text
+func UnmarshalGeoJSONFeature(data []byte, f *geojson.Feature) error {
+	var raw map[string]json.RawMessage
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return err
+	}
+	id, props := raw["id"], raw["properties"]
+
+	// geojson.Feature only decodes string ids
+	delete(raw, "id")
+	delete(raw, "properties")
+	b, err := json.Marshal(raw)
+	if err != nil {
+		return err
+	}
+	if err := json.Unmarshal(b, f); err != nil {
+		return err
+	}
+
+	f.ID, err = featureID(id)
+	if err != nil {
+		return err
+	}
+
+	f.Properties = nil
+	if len(props) == 0 {
+		return nil
+	}
+	dec := json.NewDecoder(bytes.NewReader(props))
+	dec.UseNumber()
+	return dec.Decode(&f.Properties)
+}
+
+// featureID returns the id of a feature from its raw JSON value, a string or a number
+func featureID(raw json.RawMessage) (string, error) {
+	if len(raw) == 0 {
+		return "", nil
+	}
+
+	dec := json.NewDecoder(bytes.NewReader(raw))
+	dec.UseNumber()
+	var v interface{}
+	if err := dec.Decode(&v); err != nil {
+		return "", err
+	}
+	switch id := v.(type) {
+	case nil:
+		return "", nil
+	case string:
+		return id, nil
+	case json.Number:
+		return id.String(), nil
+	default:
+		return "", errors.Errorf("invalid feature id %s, must be a string or a number", raw)
+	}
+}
+
+// jsonToValue converts a decoded JSON value at the JSON Pointer path to a protobuf Value,
+// lists and objects are converted recursively
+// integers that can't be represented exactly by a float64, like large ids, are stored as their nearest float64
+// and their decimal text is added to exact under their path
+func jsonToValue(v interface{}, path string, exact map[string]string) (*spb.Value, error) {
+	switch tv := v.(type) {
+	case nil:
+		return &spb.Value{Kind: &spb.Value_NullValue{}}, nil
+	case bool:
+		return &spb.Value{Kind: &spb.Value_BoolValue{BoolValue: tv}}, nil
+	case string:
+		return &spb.Value{Kind: &spb.Value_StringValue{StringValue: tv}}, nil
+	case float64:
+		return numberValue(tv), nil
+	case float32:
+		return numberValue(float64(tv)), nil
+	case int:
+		return integerValue(strconv.FormatInt(int64(tv), 10), path, exact), nil
+	case int8:
+		return numberValue(float64(tv)), nil
+	case int16:
+		return numberValue(float64(tv)), nil
+	case int32:
+		return numberValue(float64(tv)), nil
+	case int64:
+		return integerValue(strconv.FormatInt(tv, 10), path, exact), nil
+	case uint:
+		return integerValue(strconv.FormatUint(uint64(tv), 10), path, exact), nil
+	case uint8:
+		return numberValue(float64(tv)), nil
+	case uint16:
+		return numberValue(float64(tv)), nil
+	case uint32:
+		return numberValue(float64(tv)), nil
+	case uint64:
+		return integerValue(strconv.FormatUint(tv, 10), path, exact), nil
+	case json.Number:
+		s := tv.String()
+		if isInteger(s) {
+			return integerValue(s, path, exact), nil
+		}
+		f, err := tv.Float64()
+		if err != nil {
+			return nil, errors.Wrapf(err, "invalid number %s", s)
+		}
+		return numberValue(f), nil
+	case []interface{}:
+		l := &spb.ListValue{Values: make([]*spb.Value, len(tv))}
+		for i, e := range tv {
+			ev, err := jsonToValue(e, path+"/"+strconv.Itoa(i), exact)
+			if err != nil {
+				return nil, errors.Wrapf(err, "list element %d", i)
+			}
+			l.Values[i] = ev
+		}
+		return &spb.Value{Kind: &spb.Value_ListValue{ListValue: l}}, nil
+	case map[string]interface{}:
+		s := &spb.Struct{Fields: make(map[string]*spb.Value, len(tv))}
+		for k, e := range tv {
+			ev, err := jsonToValue(e, pointer(path, k), exact)
+			if err != nil {
+				return nil, errors.Wrapf(err, "field %s", k)
+			}
+			s.Fields[k] = ev
+		}
+		return &spb.Value{Kind: &spb.Value_StructValue{StructValue: s}}, nil
+	default:
+		return nil, errors.Errorf("unsupported type %T", tv)
+	}
+}
+
+// valueToJSON converts a protobuf Value at the JSON Pointer path to its JSON serializable equivalent,
+// lists and structs are converted recursively
+// the numbers found in exact are returned as a json.Number of their decimal text, the others as float64
+func valueToJSON(v *spb.Value, path string, exact map[string]string) interface{} {
+	switch x := v.GetKind().(type) {
+	case *spb.Value_NumberValue:
+		if s, ok := exact[path]; ok {
+			return json.Number(s)
+		}
+		return x.NumberValue
+	case *spb.Value_StringValue:
+		return x.StringValue
+	case *spb.Value_BoolValue:
+		return x.BoolValue
+	case *spb.Value_ListValue:
+		l := make([]interface{}, len(x.ListValue.GetValues()))
+		for i, e := range x.ListValue.GetValues() {
+			var ep string
+			if len(exact) > 0 {
+				ep = path + "/" + strconv.Itoa(i)
+			}
+			l[i] = valueToJSON(e, ep, exact)
+		}
+		return l
+	case *spb.Value_StructValue:
+		m := make(map[string]interface{}, len(x.StructValue.GetFields()))
+		for k, e := range x.StructValue.GetFields() {
+			var ep string
+			if len(exact) > 0 {
+				ep = pointer(path, k)
+			}
+			m[k] = valueToJSON(e, ep, exact)
+		}
+		return m
+	default:
+		return nil
+	}
+}
+
+// pointerEscaper escapes a JSON Pointer reference token
+var pointerEscaper = strings.NewReplacer("~", "~0", "/", "~1")
+
+// pointer returns the JSON Pointer of the member k of the object at path
+func pointer(path, k string) string {
+	return path + "/" + pointerEscaper.Replace(k)
+}
+
+// numberValue returns a number Value
+func numberValue(f float64) *spb.Value {
+	return &spb.Value{Kind: &spb.Value_NumberValue{NumberValue: f}}
+}
+
+// integerValue returns a number Value for the decimal integer s,
+// if a float64 can't hold it exactly the Value is the nearest float64 and s is added to exact under path
+// an integer out of the float64 range is returned as a string Value
+func integerValue(s, path string, exact map[string]string) *spb.Value {
+	i, ok := new(big.Int).SetString(s, 10)
+	if !ok {
+		return &spb.Value{Kind: &spb.Value_StringValue{StringValue: s}}
+	}
+	f, acc := new(big.Float).SetInt(i).Float64()
+	if math.IsInf(f, 0) {
+		return &spb.Value{Kind: &spb.Value_StringValue{StringValue: s}}
+	}
+	if acc != big.Exact {
+		exact[path] = s
+	}
+	return numberValue(f)
+}
+
+// isInteger returns true if the JSON number s has no fraction nor exponent
+func isInteger(s string) bool {
+	for i, c := range s {
+		if c == '-' && i == 0 {
+			continue
+		}
+		if c < '0' || c > '9' {
+			return false
+		}
+	}
+	return len(s) > 0
+}
@@ -0,0 +1,185 @@
+package geodata
+
+import (
+	"bytes"
+	"encoding/json"
+	"testing"
+
+	"github.com/golang/protobuf/proto"
+	spb "github.com/golang/protobuf/ptypes/struct"
+	"github.com/stretchr/testify/require"
+	"github.com/twpayne/go-geom/encoding/geojson"
+)
+
+const propertiesGeoJSON = `{"type":"Feature","id":"way/4242","geometry":{"type":"Point","coordinates":[-71.2275,46.7984]},"properties":{
+"name":"Chemin Sainte-Foy",
+"oneway":true,
+"lanes":2,
+"maxspeed":50.5,
+"osm_id":9007199254740993,
+"big":1152921504606846976,
+"negative":-12,
+"exp":1.5e300,
+"removed":null,
+"refs":[1,"two",3.5,false,null,[4,5],{"six":6}],
+"tags":{"highway":"secondary","surface":{"type":"asphalt","smoothness":["good","excellent"]},"lit":false,"width":7.25,"node":9007199254740995,"empty":{},"none":[]}
+}}`
+
+// decodeNumbers decodes b with json.Number numbers
+func decodeNumbers(t *testing.T, b []byte) map[string]interface{} {
+	dec := json.NewDecoder(bytes.NewReader(b))
+	dec.UseNumber()
+	var m map[string]interface{}
+	require.NoError(t, dec.Decode(&m))
+	return m
+}
+
+func TestPropertiesRoundTrip(t *testing.T) {
+	f := &geojson.Feature{}
+	require.NoError(t, UnmarshalGeoJSONFeature([]byte(propertiesGeoJSON), f))
+	require.Equal(t, json.Number("9007199254740993"), f.Properties["osm_id"])
+
+	gd := &GeoData{}
+	require.NoError(t, GeoJSONFeatureToGeoData(f, gd))
+
+	// protobuf round trip
+	b, err := proto.Marshal(gd)
+	require.NoError(t, err)
+	gd2 := &GeoData{}
+	require.NoError(t, proto.Unmarshal(b, gd2))
+	require.True(t, proto.Equal(gd, gd2))
+
+	p := gd2.Properties
+	require.NotContains(t, p, "removed")
+	require.Equal(t, 2.0, p["lanes"].GetNumberValue())
+	require.Equal(t, -12.0, p["negative"].GetNumberValue())
+	require.Equal(t, 1.5e300, p["exp"].GetNumberValue())
+	require.Equal(t, 1152921504606846976.0, p["big"].GetNumberValue())
+	// can't be represented by a float64, the nearest one is stored with the exact digits
+	require.Equal(t, 9007199254740992.0, p["osm_id"].GetNumberValue())
+	require.Equal(t, map[string]string{
+		"/osm_id":    "9007199254740993",
+		"/tags/node": "9007199254740995",
+	}, gd2.ExactNumbers)
+
+	refs := p["refs"].GetListValue().GetValues()
+	require.Len(t, refs, 7)
+	require.Equal(t, "two", refs[1].GetStringValue())
+	require.IsType(t, &spb.Value_NullValue{}, refs[4].Kind)
+	require.Len(t, refs[5].GetListValue().GetValues(), 2)
+	require.Equal(t, 6.0, refs[6].GetStructValue().GetFields()["six"].GetNumberValue())
+
+	tags := p["tags"].GetStructValue().GetFields()
+	require.Equal(t, "secondary", tags["highway"].GetStringValue())
+	surface := tags["surface"].GetStructValue().GetFields()
+	require.Equal(t, "excellent", surface["smoothness"].GetListValue().GetValues()[1].GetStringValue())
+	require.Equal(t, 9007199254740996.0, tags["node"].GetNumberValue())
+
+	// GeoJSON round trip
+	out, err := ToGeoJSONFeatureCollection([]*GeoData{gd2})
+	require.NoError(t, err)
+	var fc struct {
+		Features []json.RawMessage
+	}
+	require.NoError(t, json.Unmarshal(out, &fc))
+	require.Len(t, fc.Features, 1)
+	var feature struct {
+		Properties json.RawMessage
+	}
+	require.NoError(t, json.Unmarshal(fc.Features[0], &feature))
+
+	var in struct {
+		Properties json.RawMessage
+	}
+	require.NoError(t, json.Unmarshal([]byte(propertiesGeoJSON), &in))
+	expected := decodeNumbers(t, in.Properties)
+	delete(expected, "removed")
+
+	expectedJSON, err := json.Marshal(expected)
+	require.NoError(t, err)
+	gotJSON, err := json.Marshal(decodeNumbers(t, feature.Properties))
+	require.NoError(t, err)
+	require.JSONEq(t, string(expectedJSON), string(gotJSON))
+	// a float64 holds big exactly, it's not an exact number and is encoded with the shortest float64 digits
+	require.Contains(t, string(feature.Properties), `"big":1152921504606847000`)
+	require.Contains(t, string(feature.Properties), `"osm_id":9007199254740993`)
+
+	// without the exact numbers
+	m := PropertiesToJSONMap(gd2.Properties)
+	require.Equal(t, 9007199254740992.0, m["osm_id"])
+
+	// replacing a property removes its exact numbers
+	require.NoError(t, PropertiesToGeoData(&geojson.Feature{Properties: map[string]interface{}{"tags": "none"}}, gd2))
+	require.Equal(t, map[string]string{"/osm_id": "9007199254740993"}, gd2.ExactNumbers)
+
+	// properties decoded as float64 are supported too
+	f = &geojson.Feature{}
+	require.NoError(t, json.Unmarshal([]byte(propertiesGeoJSON), f))
+	gd = &GeoData{}
+	require.NoError(t, PropertiesToGeoData(f, gd))
+	require.Equal(t, 2, len(gd.Properties["refs"].GetListValue().GetValues()[5].GetListValue().GetValues()))
+	require.Equal(t, 9007199254740992.0, gd.Properties["osm_id"].GetNumberValue())
+}
+
+func TestPropertiesGoTypes(t *testing.T) {
+	f := &geojson.Feature{Properties: map[string]interface{}{
+		"int":    42,
+		"int64":  int64(1) << 62,
+		"int64b": int64(1)<<62 + 1,
+		"uint8":  uint8(7),
+		"float":  float32(0.5),
+		"large":  1e17,
+		"list":   []interface{}{int64(3), "a"},
+	}}
+	gd := &GeoData{}
+	require.NoError(t, PropertiesToGeoData(f, gd))
+	require.Equal(t, 42.0, gd.Properties["int"].GetNumberValue())
+	require.Equal(t, float64(int64(1)<<62), gd.Properties["int64"].GetNumberValue())
+	require.Equal(t, float64(int64(1)<<62), gd.Properties["int64b"].GetNumberValue())
+	require.Equal(t, map[string]string{"/int64b": "4611686018427387905"}, gd.ExactNumbers)
+	require.Equal(t, 7.0, gd.Properties["uint8"].GetNumberValue())
+	require.Equal(t, 0.5, gd.Properties["float"].GetNumberValue())
+	require.Equal(t, 3.0, gd.Properties["list"].GetListValue().GetValues()[0].GetNumberValue())
+
+	m := gd.PropertiesJSONMap()
+	require.Equal(t, []interface{}{3.0, "a"}, m["list"])
+	require.Equal(t, json.Number("4611686018427387905"), m["int64b"])
+	// a float without fraction above 2^53 stays a float64
+	require.Equal(t, 1e17, m["large"])
+	require.Equal(t, float64(int64(1)<<62), m["int64"])
+
+	// the JSON Pointer escaping of the keys
+	f = &geojson.Feature{Properties: map[string]interface{}{
+		"a/b": map[string]interface{}{"c~d": []interface{}{uint64(1)<<63 + 1}},
+	}}
+	gd = &GeoData{}
+	require.NoError(t, PropertiesToGeoData(f, gd))
+	require.Equal(t, map[string]string{"/a~1b/c~0d/0": "9223372036854775809"}, gd.ExactNumbers)
+	require.Equal(t, json.Number("9223372036854775809"), gd.PropertiesJSONMap()["a/b"].(map[string]interface{})["c~d"].([]interface{})[0])
+
+	f.Properties["bad"] = []interface{}{struct{}{}}
+	require.Error(t, PropertiesToGeoData(f, &GeoData{}))
+}
+
+func TestUnmarshalGeoJSONFeatureID(t *testing.T) {
+	tests := []struct {
+		id       string
+		expected string
+	}{
+		{`"way/4242"`, "way/4242"},
+		{`42`, "42"},
+		{`9007199254740993`, "9007199254740993"},
+		{`null`, ""},
+	}
+	for _, test := range tests {
+		f := &geojson.Feature{}
+		data := `{"type":"Feature","id":` + test.id + `,"geometry":{"type":"Point","coordinates":[-71.2275,46.7984]},"properties":{"name":"stop"}}`
+		require.NoError(t, UnmarshalGeoJSONFeature([]byte(data), f), test.id)
+		require.Equal(t, test.expected, f.ID)
+		require.Equal(t, "stop", f.Properties["name"])
+		require.NotNil(t, f.Geometry)
+	}
+
+	f := &geojson.Feature{}
+	require.Error(t, UnmarshalGeoJSONFeature([]byte(`{"type":"Feature","id":true,"geometry":null,"properties":{}}`), f))
+}
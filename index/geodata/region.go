@@ -0,0 +1,61 @@
+package geodata
+
+import "github.com/golang/geo/s2"
+
+// regionUnion is the union of the regions of a multi geometry or a geometry collection
+type regionUnion []s2.Region
+
+// CapBound returns a bounding cap of all the regions
+func (ru regionUnion) CapBound() s2.Cap {
+	return ru.RectBound().CapBound()
+}
+
+// RectBound returns a bounding rect of all the regions
+func (ru regionUnion) RectBound() s2.Rect {
+	rect := s2.EmptyRect()
+	for _, r := range ru {
+		rect = rect.Union(r.RectBound())
+	}
+	return rect
+}
+
+// ContainsCell reports whether one of the regions contains c
+// a cell only contained by several regions together is not reported
+func (ru regionUnion) ContainsCell(c s2.Cell) bool {
+	for _, r := range ru {
+		if r.ContainsCell(c) {
+			return true
+		}
+	}
+	return false
+}
+
+// IntersectsCell reports whether one of the regions intersects c
+func (ru regionUnion) IntersectsCell(c s2.Cell) bool {
+	for _, r := range ru {
+		if r.IntersectsCell(c) {
+			return true
+		}
+	}
+	return false
+}
+
+// ContainsPoint reports whether one of the regions contains p
+func (ru regionUnion) ContainsPoint(p s2.Point) bool {
+	for _, r := range ru {
+		if r.ContainsPoint(p) {
+			return true
+		}
+	}
+	return false
+}
+
+// CellUnionBound returns the cells covering all the regions
+func (ru regionUnion) CellUnionBound() []s2.CellID {
+	var cu s2.CellUnion
+	for _, r := range ru {
+		cu = append(cu, r.CellUnionBound()...)
+	}
+	cu.Normalize()
+	return cu
+}
@@ -1,7 +1,7 @@
 package geodata
 
 import (
-	"fmt"
+	"strings"
 
 	"github.com/golang/geo/s2"
 	spb "github.com/golang/protobuf/ptypes/struct"
@@ -12,41 +12,151 @@ import (
 
 // GeomToGeoData update gd with geo data gathered from g
 func GeomToGeoData(g geom.T, gd *GeoData) error {
-	geo := &Geometry{}
+	geo, err := geomToGeometry(g)
+	if err != nil {
+		return err
+	}
+
+	gd.Geometry = geo
+	return nil
+}
+
+// geomToGeometry converts g to a Geometry, the members of multi geometries and collections are stored in Geometries
+func geomToGeometry(g geom.T) (*Geometry, error) {
+	layout, err := layoutFromGeom(g.Layout())
+	if err != nil {
+		return nil, err
+	}
+	geo := &Geometry{Layout: layout}
 
 	switch g := g.(type) {
 	case *geom.Point:
 		geo.Coordinates = g.Coords()
 		geo.Type = Geometry_POINT
-		//case *geom.MultiPolygon:
-		//	geo.Type = geodata.Geometry_MULTIPOLYGON
+
+	case *geom.MultiPoint:
+		geo.Type = Geometry_MULTIPOINT
+		geo.Geometries = make([]*Geometry, g.NumPoints())
+		for i := range geo.Geometries {
+			geo.Geometries[i] = &Geometry{
+				Type:        Geometry_POINT,
+				Coordinates: g.Point(i).Coords(),
+				Layout:      layout,
+			}
+		}
+
+	case *geom.MultiPolygon:
+		geo.Type = Geometry_MULTIPOLYGON
+		geo.Geometries = make([]*Geometry, g.NumPolygons())
+		for i := range geo.Geometries {
+			p := g.Polygon(i)
+			geo.Geometries[i] = &Geometry{
+				Type:        Geometry_POLYGON,
+				Coordinates: p.FlatCoords(),
+				Ends:        ringsEnds(p.Ends()),
+				Layout:      layout,
+			}
+		}
 
 	case *geom.Polygon:
-		// only supports outer ring
 		geo.Type = Geometry_POLYGON
 		geo.Coordinates = g.FlatCoords()
+		geo.Ends = ringsEnds(g.Ends())
 
 	case *geom.LineString:
 		geo.Type = Geometry_LINESTRING
 		geo.Coordinates = g.FlatCoords()
 
+	case *geom.MultiLineString:
+		geo.Type = Geometry_MULTILINESTRING
+		geo.Geometries = make([]*Geometry, g.NumLineStrings())
+		for i := range geo.Geometries {
+			geo.Geometries[i] = &Geometry{
+				Type:        Geometry_LINESTRING,
+				Coordinates: g.LineString(i).FlatCoords(),
+				Layout:      layout,
+			}
+		}
+
+	case *geom.GeometryCollection:
+		geo.Type = Geometry_GEOMETRYCOLLECTION
+		geo.Geometries = make([]*Geometry, g.NumGeoms())
+		for i, m := range g.Geoms() {
+			mg, err := geomToGeometry(m)
+			if err != nil {
+				return nil, errors.Wrap(err, "invalid geometry collection")
+			}
+			geo.Geometries[i] = mg
+		}
+
 	default:
-		return errors.Errorf("unsupported geo type %T", g)
+		return nil, errors.Errorf("unsupported geo type %T", g)
 	}
 
-	gd.Geometry = geo
-	return nil
+	return geo, nil
 }
 
 // GeoDataToGeom converts GeoData to a geom.T representation
 func GeoDataToGeom(gd *GeoData) (geom.T, error) {
-	switch gd.Geometry.Type {
+	if gd.Geometry == nil {
+		return nil, errors.New("invalid geometry")
+	}
+	return geometryToGeom(gd.Geometry)
+}
+
+// geometryToGeom converts g to a geom.T representation
+func geometryToGeom(g *Geometry) (geom.T, error) {
+	layout := g.geomLayout()
+	switch g.Type {
 	case Geometry_POINT:
-		return geom.NewPointFlat(geom.XY, gd.Geometry.Coordinates), nil
+		return geom.NewPointFlat(layout, g.Coordinates), nil
+
+	case Geometry_MULTIPOINT:
+		mp := geom.NewMultiPoint(layout)
+		for _, p := range g.Geometries {
+			if err := mp.Push(geom.NewPointFlat(layout, p.Coordinates)); err != nil {
+				return nil, errors.Wrap(err, "invalid multipoint")
+			}
+		}
+		return mp, nil
+
 	case Geometry_POLYGON:
-		return geom.NewPolygonFlat(geom.XY, gd.Geometry.Coordinates, []int{len(gd.Geometry.Coordinates)}), nil
+		return geom.NewPolygonFlat(layout, g.Coordinates, g.RingEnds()), nil
+
+	case Geometry_MULTIPOLYGON:
+		mp := geom.NewMultiPolygon(layout)
+		for _, poly := range g.Geometries {
+			if err := mp.Push(geom.NewPolygonFlat(layout, poly.Coordinates, poly.RingEnds())); err != nil {
+				return nil, errors.Wrap(err, "invalid multipolygon")
+			}
+		}
+		return mp, nil
+
 	case Geometry_LINESTRING:
-		return geom.NewLineStringFlat(geom.XY, gd.Geometry.Coordinates), nil
+		return geom.NewLineStringFlat(layout, g.Coordinates), nil
+
+	case Geometry_MULTILINESTRING:
+		ml := geom.NewMultiLineString(layout)
+		for _, l := range g.Geometries {
+			if err := ml.Push(geom.NewLineStringFlat(layout, l.Coordinates)); err != nil {
+				return nil, errors.Wrap(err, "invalid multilinestring")
+			}
+		}
+		return ml, nil
+
+	case Geometry_GEOMETRYCOLLECTION:
+		gc := geom.NewGeometryCollection()
+		for _, m := range g.Geometries {
+			mg, err := geometryToGeom(m)
+			if err != nil {
+				return nil, errors.Wrap(err, "invalid geometry collection")
+			}
+			if err := gc.Push(mg); err != nil {
+				return nil, errors.Wrap(err, "invalid geometry collection")
+			}
+		}
+		return gc, nil
+
 	default:
 		return nil, errors.Errorf("unsupported geodata type")
 	}
@@ -68,123 +178,259 @@ func GeoJSONFeatureToGeoData(f *geojson.Feature, gd *GeoData) error {
 }
 
 // PropertiesToGeoData update gd.Properties with the properties found in f
+// lists and objects are stored as ListValue and StructValue, null properties are skipped
+// the integers a float64 can't hold exactly are stored as their nearest float64,
+// their decimal text is kept in gd.ExactNumbers, see GeoData.PropertiesJSONMap
 func PropertiesToGeoData(f *geojson.Feature, gd *GeoData) error {
 	m := make(map[string]*spb.Value)
+	exact := make(map[string]string)
 	for k, vi := range f.Properties {
-		switch tv := vi.(type) {
-		case bool:
-			m[k] = &spb.Value{Kind: &spb.Value_BoolValue{BoolValue: tv}}
-		case int:
-			m[k] = &spb.Value{Kind: &spb.Value_NumberValue{NumberValue: float64(tv)}}
-		case string:
-			m[k] = &spb.Value{Kind: &spb.Value_StringValue{StringValue: tv}}
-		case float64:
-			m[k] = &spb.Value{Kind: &spb.Value_NumberValue{NumberValue: tv}}
-		case nil:
-			// pass
-		default:
-			return fmt.Errorf("GeoJSON property %s unsupported type %T", k, tv)
+		if vi == nil {
+			continue
 		}
+		v, err := jsonToValue(vi, pointer("", k), exact)
+		if err != nil {
+			return errors.Wrapf(err, "GeoJSON property %s", k)
+		}
+		m[k] = v
 	}
 	if gd.Properties == nil && len(m) > 0 {
 		gd.Properties = make(map[string]*spb.Value)
 	}
 	for k, v := range m {
 		gd.Properties[k] = v
+
+		// the exact numbers of the replaced property
+		p := pointer("", k)
+		for ep := range gd.ExactNumbers {
+			if ep == p || strings.HasPrefix(ep, p+"/") {
+				delete(gd.ExactNumbers, ep)
+			}
+		}
+	}
+	if gd.ExactNumbers == nil && len(exact) > 0 {
+		gd.ExactNumbers = make(map[string]string)
+	}
+	for p, s := range exact {
+		gd.ExactNumbers[p] = s
 	}
 	return nil
 }
 
 // GeoDataToRect generate a RectBound for GeoData gd
-// only works with Polygons & LineString
+// works with all the geometries but a single point
 func GeoDataToRect(gd *GeoData) (s2.Rect, error) {
 	if gd.Geometry == nil {
 		return s2.Rect{}, errors.New("invalid geometry")
 	}
-	switch gd.Geometry.Type {
-	case Geometry_POINT:
+	if gd.Geometry.Type == Geometry_POINT {
 		return s2.Rect{}, errors.New("point can't be rect bounded")
+	}
+	return geometryRect(gd.Geometry)
+}
+
+// geometryRect returns the RectBound of g, a point is bounded by a degenerated rect
+func geometryRect(g *Geometry) (s2.Rect, error) {
+	switch g.Type {
+	case Geometry_POINT:
+		if len(g.Coordinates) < 2 {
+			return s2.Rect{}, errors.New("invalid coordinates count for point")
+		}
+		return s2.RectFromLatLng(s2.LatLngFromDegrees(g.Coordinates[1], g.Coordinates[0])), nil
 
 	case Geometry_POLYGON:
-		l := LoopFromCoordinates(gd.Geometry.Coordinates)
-		if l.IsEmpty() || l.IsFull() || l.ContainsOrigin() {
-			return s2.Rect{}, errors.New("invalid polygon")
+		// the holes are inside the outer ring
+		rings, err := g.rings()
+		if err != nil {
+			return s2.Rect{}, errors.Wrap(err, "invalid polygon")
+		}
+		// the ring orientation does not matter
+		l, err := normalizedLoop(rings[0])
+		if err != nil {
+			return s2.Rect{}, err
 		}
 		return l.RectBound(), nil
 
-	case Geometry_MULTIPOLYGON:
-		return s2.Rect{}, errors.New("multipolygon not supported")
-
 	case Geometry_LINESTRING:
-		if len(gd.Geometry.Coordinates)%2 != 0 {
-			return s2.Rect{}, errors.New("invalid coordinates count for line")
+		pl, err := g.polyline()
+		if err != nil {
+			return s2.Rect{}, err
 		}
+		return pl.RectBound(), nil
 
-		pl := make(s2.Polyline, len(gd.Geometry.Coordinates)/2)
-		for i := 0; i < len(gd.Geometry.Coordinates); i += 2 {
-			ll := s2.LatLngFromDegrees(gd.Geometry.Coordinates[i+1], gd.Geometry.Coordinates[i])
-			pl[i/2] = s2.PointFromLatLng(ll)
+	case Geometry_MULTIPOINT, Geometry_MULTIPOLYGON, Geometry_MULTILINESTRING, Geometry_GEOMETRYCOLLECTION:
+		rect := s2.EmptyRect()
+		for _, m := range g.Geometries {
+			r, err := geometryRect(m)
+			if err != nil {
+				return s2.Rect{}, errors.Wrapf(err, "invalid %s", strings.ToLower(g.Type.String()))
+			}
+			rect = rect.Union(r)
 		}
-
-		return pl.RectBound(), nil
+		if rect.IsEmpty() {
+			return s2.Rect{}, errors.Errorf("empty %s", strings.ToLower(g.Type.String()))
+		}
+		return rect, nil
 
 	default:
 		return s2.Rect{}, errors.New("unsupported data type")
 	}
 }
 
-// geoDataToCoverCellUnion generate an s2 cover normalized for GeoData gd
-func geoDataCoverCellUnion(gd *GeoData, coverer *s2.RegionCoverer, interior bool) (s2.CellUnion, error) {
+// GeoDataToRegion returns an s2.Region representing GeoData gd
+func GeoDataToRegion(gd *GeoData) (s2.Region, error) {
 	if gd.Geometry == nil {
 		return nil, errors.New("invalid geometry")
 	}
-	var cu s2.CellUnion
-	switch gd.Geometry.Type {
+	return geometryRegion(gd.Geometry)
+}
+
+// geometryRegion returns an s2.Region representing g
+func geometryRegion(g *Geometry) (s2.Region, error) {
+	switch g.Type {
 	case Geometry_POINT:
-		c := s2.CellIDFromLatLng(s2.LatLngFromDegrees(gd.Geometry.Coordinates[1], gd.Geometry.Coordinates[0]))
-		cu = append(cu, c.Parent(coverer.MinLevel))
+		if len(g.Coordinates) < 2 {
+			return nil, errors.New("invalid coordinates count for point")
+		}
+		return s2.PointFromLatLng(s2.LatLngFromDegrees(g.Coordinates[1], g.Coordinates[0])), nil
 
 	case Geometry_POLYGON:
-		cup, err := coverPolygon(gd.Geometry.Coordinates, coverer, interior)
+		rings, err := g.rings()
 		if err != nil {
-			return nil, errors.Wrap(err, "can't cover polygon")
+			return nil, errors.Wrap(err, "invalid polygon")
+		}
+		if len(rings) == 1 {
+			return normalizedLoop(rings[0])
 		}
-		cu = append(cu, cup...)
+		return polygonFromRings(rings)
 
 	case Geometry_MULTIPOLYGON:
-		for _, g := range gd.Geometry.Geometries {
-			cup, err := coverPolygon(g.Coordinates, coverer, interior)
+		var rings [][]float64
+		for _, m := range g.Geometries {
+			r, err := m.rings()
 			if err != nil {
-				return nil, errors.Wrap(err, "can't cover multipolygon")
+				return nil, errors.Wrap(err, "invalid multipolygon")
 			}
-
-			cu = append(cu, cup...)
+			rings = append(rings, r...)
+		}
+		p, err := polygonFromRings(rings)
+		if err != nil {
+			return nil, errors.Wrap(err, "invalid multipolygon")
 		}
+		return p, nil
 
 	case Geometry_LINESTRING:
-		if len(gd.Geometry.Coordinates)%2 != 0 {
-			return nil, errors.New("invalid coordinates count for line")
+		return g.polyline()
+
+	case Geometry_MULTIPOINT, Geometry_MULTILINESTRING, Geometry_GEOMETRYCOLLECTION:
+		ru := make(regionUnion, len(g.Geometries))
+		for i, m := range g.Geometries {
+			r, err := geometryRegion(m)
+			if err != nil {
+				return nil, errors.Wrapf(err, "invalid %s", strings.ToLower(g.Type.String()))
+			}
+			ru[i] = r
+		}
+		return ru, nil
+
+	default:
+		return nil, errors.New("unsupported data type")
+	}
+}
+
+// polyline returns the polyline of a linestring geometry
+func (g *Geometry) polyline() (*s2.Polyline, error) {
+	c, err := g.XYCoordinates()
+	if err != nil {
+		return nil, errors.Wrap(err, "invalid line")
+	}
+	return polylineFromCoordinates(c)
+}
+
+// polylineFromCoordinates returns a polyline from a list of lng, lat
+func polylineFromCoordinates(c []float64) (*s2.Polyline, error) {
+	if len(c)%2 != 0 {
+		return nil, errors.New("invalid coordinates count for line")
+	}
+
+	pl := make(s2.Polyline, len(c)/2)
+	for i := 0; i < len(c); i += 2 {
+		pl[i/2] = s2.PointFromLatLng(s2.LatLngFromDegrees(c[i+1], c[i]))
+	}
+	return &pl, nil
+}
+
+// normalizedLoop returns a loop from a list of lng, lat enclosing at most half the sphere
+func normalizedLoop(c []float64) (*s2.Loop, error) {
+	l := LoopFromCoordinates(c)
+	if l == nil || l.IsEmpty() || l.IsFull() {
+		return nil, errors.New("invalid polygon")
+	}
+	l.Normalize()
+	return l, nil
+}
+
+// geoDataToCoverCellUnion generate an s2 cover normalized for GeoData gd
+func geoDataCoverCellUnion(gd *GeoData, coverer *s2.RegionCoverer, interior bool) (s2.CellUnion, error) {
+	if gd.Geometry == nil {
+		return nil, errors.New("invalid geometry")
+	}
+	return geometryCover(gd.Geometry, coverer, interior)
+}
+
+// geometryCover generates an s2 cover for g, the cover of multi geometries and collections
+// is the union of their members covers without duplicated cells
+func geometryCover(g *Geometry, coverer *s2.RegionCoverer, interior bool) (s2.CellUnion, error) {
+	switch g.Type {
+	case Geometry_POINT:
+		if len(g.Coordinates) < 2 {
+			return nil, errors.New("invalid coordinates count for point")
 		}
+		// a point has no interior
+		if interior {
+			return nil, nil
+		}
+		c := s2.CellIDFromLatLng(s2.LatLngFromDegrees(g.Coordinates[1], g.Coordinates[0]))
+		return s2.CellUnion{c.Parent(coverer.MinLevel)}, nil
 
-		pl := make(s2.Polyline, len(gd.Geometry.Coordinates)/2)
-		for i := 0; i < len(gd.Geometry.Coordinates); i += 2 {
-			ll := s2.LatLngFromDegrees(gd.Geometry.Coordinates[i+1], gd.Geometry.Coordinates[i])
-			pl[i/2] = s2.PointFromLatLng(ll)
+	case Geometry_POLYGON:
+		cu, err := coverPolygon(g, coverer, interior)
+		if err != nil {
+			return nil, errors.Wrap(err, "can't cover polygon")
 		}
+		return cu, nil
 
-		var cupl s2.CellUnion
+	case Geometry_LINESTRING:
+		pl, err := g.polyline()
+		if err != nil {
+			return nil, err
+		}
 		if interior {
-			cupl = coverer.InteriorCellUnion(&pl)
-		} else {
-			cupl = coverer.CellUnion(&pl)
+			return coverer.InteriorCellUnion(pl), nil
+		}
+		return coverer.CellUnion(pl), nil
+
+	case Geometry_MULTIPOINT, Geometry_MULTIPOLYGON, Geometry_MULTILINESTRING, Geometry_GEOMETRYCOLLECTION:
+		var cu s2.CellUnion
+		seen := make(map[s2.CellID]struct{})
+		for _, m := range g.Geometries {
+			mcu, err := geometryCover(m, coverer, interior)
+			if err != nil {
+				return nil, errors.Wrapf(err, "can't cover %s", strings.ToLower(g.Type.String()))
+			}
+			for _, c := range mcu {
+				if _, ok := seen[c]; ok {
+					continue
+				}
+				seen[c] = struct{}{}
+				cu = append(cu, c)
+			}
 		}
-		cu = append(cu, cupl...)
+		return cu, nil
 
 	default:
 		return nil, errors.New("unsupported data type")
 	}
-
-	return cu, nil
 }
 
 // Deprecated: use  Cover()
@@ -198,64 +444,39 @@ func (gd *GeoData) Cover(coverer *s2.RegionCoverer) (s2.CellUnion, error) {
 	return geoDataCoverCellUnion(gd, coverer, false)
 }
 
-// InteriorCover generates an s2 interior cover for GeoData gd
+// InteriorCover generates an s2 interior cover for GeoData gd, points have no interior
 func (gd *GeoData) InteriorCover(coverer *s2.RegionCoverer) (s2.CellUnion, error) {
 	return geoDataCoverCellUnion(gd, coverer, true)
 }
 
-// returns an s2 cover from a list of lng, lat forming a closed polygon
-func coverPolygon(c []float64, coverer *s2.RegionCoverer, interior bool) (s2.CellUnion, error) {
-	if len(c) < 6 {
-		return nil, errors.New("invalid polygons not enough coordinates for a closed polygon")
-	}
-	if len(c)%2 != 0 {
-		return nil, errors.New("invalid polygons odd coordinates number")
-	}
-
-	l := LoopFromCoordinatesAndCCW(c, true)
-	if l.IsEmpty() || l.IsFull() {
-		return nil, errors.New("invalid polygons")
+// returns an s2 cover of a polygon geometry, the cells only inside its holes are excluded
+func coverPolygon(g *Geometry, coverer *s2.RegionCoverer, interior bool) (s2.CellUnion, error) {
+	rings, err := g.rings()
+	if err != nil {
+		return nil, err
 	}
 
-	// super hacky try reverse if ContainsOrigin
-	if l.ContainsOrigin() {
-		// reversing the slice
-		for i := len(c)/2 - 1; i >= 0; i-- {
-			opp := len(c) - 1 - i
-			c[i], c[opp] = c[opp], c[i]
-		}
+	p, err := polygonFromRings(rings)
+	if err != nil {
+		return nil, err
 	}
 
 	if interior {
-		return coverer.InteriorCovering(l), nil
+		return coverer.InteriorCovering(p), nil
 	}
-	return coverer.Covering(l), nil
+	return coverer.Covering(p), nil
 }
 
 // ToGeoJSONFeatureCollection converts a list of GeoData to a GeoJSON Feature Collection
 func ToGeoJSONFeatureCollection(geos []*GeoData) ([]byte, error) {
 	fc := geojson.FeatureCollection{}
 	for _, g := range geos {
-		f := &geojson.Feature{}
-		switch g.Geometry.Type {
-		case Geometry_POINT:
-			ng := geom.NewPointFlat(geom.XY, g.Geometry.Coordinates)
-			f.Geometry = ng
-		case Geometry_POLYGON:
-			ng := geom.NewPolygonFlat(geom.XY, g.Geometry.Coordinates, []int{len(g.Geometry.Coordinates)})
-			f.Geometry = ng
-		case Geometry_MULTIPOLYGON:
-			mp := geom.NewMultiPolygon(geom.XY)
-			for _, poly := range g.Geometry.Geometries {
-				ng := geom.NewPolygonFlat(geom.XY, poly.Coordinates, []int{len(poly.Coordinates)})
-				mp.Push(ng)
-			}
-			f.Geometry = mp
-		case Geometry_LINESTRING:
-			ls := geom.NewLineStringFlat(geom.XY, g.Geometry.Coordinates)
-			f.Geometry = ls
+		ng, err := GeoDataToGeom(g)
+		if err != nil {
+			return nil, err
 		}
-		f.Properties = PropertiesToJSONMap(g.Properties)
+		f := &geojson.Feature{Geometry: ng}
+		f.Properties = g.PropertiesJSONMap()
 		fc.Features = append(fc.Features, f)
 	}
 
@@ -263,6 +484,7 @@ func ToGeoJSONFeatureCollection(geos []*GeoData) ([]byte, error) {
 }
 
 // PointsToGeoJSONPolyLines converts a list of GeoData containing points to a polylines GeoJSON
+// the points must share the same layout, which is kept in the polyline
 func PointsToGeoJSONPolyLines(geos []*GeoData) ([]byte, error) {
 	f := geojson.Feature{}
 	var flatCoords []float64
@@ -271,35 +493,51 @@ func PointsToGeoJSONPolyLines(geos []*GeoData) ([]byte, error) {
 		return f.MarshalJSON()
 	}
 
+	layout := geos[0].Geometry.Layout
 	for _, g := range geos {
 		switch g.Geometry.Type {
 		case Geometry_POINT:
+			if g.Geometry.Layout != layout {
+				return nil, errors.New("points with different layouts")
+			}
 			flatCoords = append(flatCoords, g.Geometry.Coordinates...)
 		default:
 			return nil, errors.Errorf("unsupported geometry")
 		}
 
 	}
-	f.Properties = PropertiesToJSONMap(geos[0].Properties)
-	g := geom.NewLineStringFlat(geom.XY, flatCoords)
+	f.Properties = geos[0].PropertiesJSONMap()
+	g := geom.NewLineStringFlat(geos[0].Geometry.geomLayout(), flatCoords)
 	f.Geometry = g
 
 	return f.MarshalJSON()
 }
 
 // PropertiesToJSONMap converts a protobuf map to it's JSON serializable map equivalent
+// the integers a float64 can't hold exactly are their nearest float64, use GeoData.PropertiesJSONMap to keep their digits
 func PropertiesToJSONMap(src map[string]*spb.Value) map[string]interface{} {
+	return propertiesToJSONMap(src, nil)
+}
+
+// PropertiesJSONMap converts gd.Properties to it's JSON serializable map equivalent,
+// the numbers found in gd.ExactNumbers are json.Number of their decimal text
+func (gd *GeoData) PropertiesJSONMap() map[string]interface{} {
+	return propertiesToJSONMap(gd.Properties, gd.ExactNumbers)
+}
+
+// propertiesToJSONMap converts src to it's JSON serializable map equivalent, see valueToJSON
+func propertiesToJSONMap(src map[string]*spb.Value, exact map[string]string) map[string]interface{} {
 	res := make(map[string]interface{})
 
 	for k, v := range src {
-		switch x := v.Kind.(type) {
-		case *spb.Value_NumberValue:
-			res[k] = x.NumberValue
-		case *spb.Value_StringValue:
-			res[k] = x.StringValue
-		case *spb.Value_BoolValue:
-			res[k] = x.BoolValue
+		if v.GetKind() == nil {
+			continue
+		}
+		var p string
+		if len(exact) > 0 {
+			p = pointer("", k)
 		}
+		res[k] = valueToJSON(v, p, exact)
 	}
 	return res
 }
@@ -2,9 +2,12 @@ package geodata
 
 import (
 	"encoding/json"
+	"io/ioutil"
+	"os"
 	"testing"
 
 	"github.com/golang/geo/s2"
+	"github.com/golang/protobuf/proto"
 	"github.com/stretchr/testify/require"
 	"github.com/twpayne/go-geom"
 	"github.com/twpayne/go-geom/encoding/geojson"
@@ -15,8 +18,13 @@ var (
 )
 
 const (
-	pointGeoJSON      = `{"type":"FeatureCollection","features":[{"type":"Feature","properties":{},"geometry":{"type":"Point","coordinates":[-71.22759461402893, 46.79841427927054]}}]}`
-	polygonGeoJSON    = `{"type":"FeatureCollection","features":[{"type":"Feature","properties":{},"geometry":{"type":"Polygon","coordinates":[[[-71.2324869632721,46.79705550924151],[-71.23148918151855,46.79630633487581],[-71.22928977012634,46.795850949282105],[-71.22731566429138,46.79614474688046],[-71.22568488121033,46.79727585265817],[-71.22525572776794,46.79828207612585],[-71.22547030448912,46.79936907011552],[-71.22538447380066,46.799706915125526],[-71.22511625289917,46.79987583683501],[-71.22511625289917,46.80001538045589],[-71.22598528862,46.800786536044875],[-71.2324869632721,46.79705550924151]]]}}]}`
+	pointGeoJSON   = `{"type":"FeatureCollection","features":[{"type":"Feature","properties":{},"geometry":{"type":"Point","coordinates":[-71.22759461402893, 46.79841427927054]}}]}`
+	polygonGeoJSON = `{"type":"FeatureCollection","features":[{"type":"Feature","properties":{},"geometry":{"type":"Polygon","coordinates":[[[-71.2324869632721,46.79705550924151],[-71.23148918151855,46.79630633487581],[-71.22928977012634,46.795850949282105],[-71.22731566429138,46.79614474688046],[-71.22568488121033,46.79727585265817],[-71.22525572776794,46.79828207612585],[-71.22547030448912,46.79936907011552],[-71.22538447380066,46.799706915125526],[-71.22511625289917,46.79987583683501],[-71.22511625289917,46.80001538045589],[-71.22598528862,46.800786536044875],[-71.2324869632721,46.79705550924151]]]}}]}`
+	holeGeoJSON    = `{"type":"FeatureCollection","features":[{"type":"Feature","properties":{},"geometry":{"type":"Polygon","coordinates":[[[-71.24,46.79],[-71.22,46.79],[-71.22,46.81],[-71.24,46.81],[-71.24,46.79]],[[-71.235,46.795],[-71.235,46.805],[-71.225,46.805],[-71.225,46.795],[-71.235,46.795]]]}}]}`
+	multiGeoJSON   = `{"type":"FeatureCollection","features":[
+{"type":"Feature","properties":{"name":"stops"},"geometry":{"type":"MultiPoint","coordinates":[[-71.2275,46.7984],[-71.2301,46.8012],[-71.2199,46.8105]]}},
+{"type":"Feature","properties":{"name":"road"},"geometry":{"type":"MultiLineString","coordinates":[[[-71.2641,46.8373],[-71.2504,46.8432]],[[-71.2368,46.8491],[-71.2268,46.8535]]]}},
+{"type":"Feature","properties":{"name":"mixed"},"geometry":{"type":"GeometryCollection","geometries":[{"type":"Point","coordinates":[-71.2275,46.7984]},{"type":"LineString","coordinates":[[-71.2641,46.8373],[-71.2504,46.8432]]},{"type":"Polygon","coordinates":[[[-71.24,46.79],[-71.22,46.79],[-71.22,46.81],[-71.24,46.81],[-71.24,46.79]]]}]}}]}`
 	lineStringGeoJSON = `{"type":"FeatureCollection","features":[{"type":"Feature","properties":{},"geometry":{"type":"LineString","coordinates":[[-71.26419067382812,46.83735599002144],[-71.25045776367188,46.84328581149685],[-71.23689651489258,46.849156277107134],[-71.22685432434082,46.8535587053004]]}}]}`
 )
 
@@ -80,6 +88,294 @@ func TestGeoJSONFeatureToGeoData(t *testing.T) {
 	require.EqualValues(t, geoline.FlatCoords(), gd.Geometry.Coordinates)
 }
 
+func TestPolygonHoles(t *testing.T) {
+	var fc geojson.FeatureCollection
+	err := json.Unmarshal([]byte(holeGeoJSON), &fc)
+	require.NoError(t, err)
+
+	gd := &GeoData{}
+	err = GeoJSONFeatureToGeoData(fc.Features[0], gd)
+	require.NoError(t, err)
+	require.Equal(t, []int32{10, 20}, gd.Geometry.Ends)
+
+	// round trip
+	g, err := GeoDataToGeom(gd)
+	require.NoError(t, err)
+	poly, ok := g.(*geom.Polygon)
+	require.True(t, ok)
+	require.Equal(t, 2, poly.NumLinearRings())
+
+	b, err := ToGeoJSONFeatureCollection([]*GeoData{gd})
+	require.NoError(t, err)
+	var fc2 geojson.FeatureCollection
+	require.NoError(t, json.Unmarshal(b, &fc2))
+	require.Equal(t, []int{10, 20}, fc2.Features[0].Geometry.(*geom.Polygon).Ends())
+
+	// the hole cells are excluded from the cover
+	inHole := s2.CellIDFromLatLng(s2.LatLngFromDegrees(46.8, -71.23)).Parent(16)
+	inRing := s2.CellIDFromLatLng(s2.LatLngFromDegrees(46.8, -71.2375)).Parent(16)
+	coverer := &s2.RegionCoverer{MinLevel: 16, MaxLevel: 16}
+	cu, err := gd.Cover(coverer)
+	require.NoError(t, err)
+	require.False(t, cu.ContainsCellID(inHole))
+	require.True(t, cu.ContainsCellID(inRing))
+
+	icu, err := gd.InteriorCover(&s2.RegionCoverer{MinLevel: 16, MaxLevel: 16, MaxCells: len(cu)})
+	require.NoError(t, err)
+	require.False(t, icu.ContainsCellID(inHole))
+	require.True(t, icu.ContainsCellID(inRing))
+
+	region, err := GeoDataToRegion(gd)
+	require.NoError(t, err)
+	require.False(t, region.ContainsPoint(s2.PointFromLatLng(s2.LatLngFromDegrees(46.8, -71.23))))
+	require.True(t, region.ContainsPoint(s2.PointFromLatLng(s2.LatLngFromDegrees(46.8, -71.2375))))
+
+	rect, err := GeoDataToRect(gd)
+	require.NoError(t, err)
+	require.InDelta(t, 46.81, rect.Hi().Lat.Degrees(), 1e-5)
+
+	// the same polygon without hole
+	filled := &GeoData{Geometry: &Geometry{Type: Geometry_POLYGON, Coordinates: gd.Geometry.Coordinates[:10]}}
+	fcu, err := filled.Cover(coverer)
+	require.NoError(t, err)
+	require.True(t, fcu.ContainsCellID(inHole))
+
+	// invalid ends
+	gd.Geometry.Ends = []int32{10, 30}
+	_, err = gd.Cover(coverer)
+	require.Error(t, err)
+}
+
+func TestMultiPolygons(t *testing.T) {
+	// synthetic shapes, not real boundaries: a polygon with a hole and islands split at the antimeridian
+	b, err := ioutil.ReadFile("testdata/multipolygons.geojson")
+	require.NoError(t, err)
+	var fc geojson.FeatureCollection
+	require.NoError(t, json.Unmarshal(b, &fc))
+
+	var geos []*GeoData
+	for _, f := range fc.Features {
+		gd := &GeoData{}
+		require.NoError(t, GeoJSONFeatureToGeoData(f, gd))
+		require.Equal(t, Geometry_MULTIPOLYGON, gd.Geometry.Type)
+		require.Len(t, gd.Geometry.Geometries, 3)
+		geos = append(geos, gd)
+
+		// geom round trip
+		g, err := GeoDataToGeom(gd)
+		require.NoError(t, err)
+		mp, ok := g.(*geom.MultiPolygon)
+		require.True(t, ok)
+		src := f.Geometry.(*geom.MultiPolygon)
+		require.Equal(t, src.FlatCoords(), mp.FlatCoords())
+		require.Equal(t, src.Endss(), mp.Endss())
+
+		// protobuf round trip
+		pb, err := proto.Marshal(gd)
+		require.NoError(t, err)
+		gd2 := &GeoData{}
+		require.NoError(t, proto.Unmarshal(pb, gd2))
+		require.True(t, proto.Equal(gd, gd2))
+	}
+
+	// the lagoon hole of the first polygon
+	require.Equal(t, []int32{18, 28}, geos[0].Geometry.Geometries[0].Ends)
+	require.Nil(t, geos[0].Geometry.Geometries[1].Ends)
+
+	// GeoJSON round trip
+	out, err := ToGeoJSONFeatureCollection(geos)
+	require.NoError(t, err)
+	var fc2 geojson.FeatureCollection
+	require.NoError(t, json.Unmarshal(out, &fc2))
+	require.Len(t, fc2.Features, 2)
+	for i, f := range fc2.Features {
+		require.Equal(t, fc.Features[i].Geometry.FlatCoords(), f.Geometry.FlatCoords())
+		require.Equal(t, fc.Features[i].Geometry.(*geom.MultiPolygon).Endss(), f.Geometry.(*geom.MultiPolygon).Endss())
+		require.Equal(t, fc.Features[i].Properties["name"], f.Properties["name"])
+	}
+
+	// rect bounds
+	rect, err := GeoDataToRect(geos[0])
+	require.NoError(t, err)
+	require.InDelta(t, 20.58, rect.Lo().Lat.Degrees(), 1e-3)
+	require.InDelta(t, 21.71, rect.Hi().Lat.Degrees(), 1e-3)
+	require.InDelta(t, -158.28, rect.Lo().Lng.Degrees(), 1e-3)
+	require.InDelta(t, -155.99, rect.Hi().Lng.Degrees(), 1e-3)
+
+	// the second feature crosses the antimeridian
+	rect, err = GeoDataToRect(geos[1])
+	require.NoError(t, err)
+	require.True(t, rect.Lng.IsInverted())
+	require.True(t, rect.Lng.Length() < 0.1)
+
+	// covers exclude the hole
+	coverer := &s2.RegionCoverer{MinLevel: 15, MaxLevel: 15}
+	cu, err := geos[0].Cover(coverer)
+	require.NoError(t, err)
+	require.False(t, cu.ContainsCellID(s2.CellIDFromLatLng(s2.LatLngFromDegrees(21.475, -158.0)).Parent(15)))
+	require.True(t, cu.ContainsCellID(s2.CellIDFromLatLng(s2.LatLngFromDegrees(20.8, -156.3)).Parent(15)))
+
+	region, err := GeoDataToRegion(geos[0])
+	require.NoError(t, err)
+	require.False(t, region.ContainsPoint(s2.PointFromLatLng(s2.LatLngFromDegrees(21.475, -158.0))))
+	require.True(t, region.ContainsPoint(s2.PointFromLatLng(s2.LatLngFromDegrees(21.6, -158.0))))
+	require.True(t, region.ContainsPoint(s2.PointFromLatLng(s2.LatLngFromDegrees(21.15, -157.0))))
+}
+
+func TestNaturalEarthAdmin0(t *testing.T) {
+	// Natural Earth excerpt, see testdata/README.md
+	b, err := ioutil.ReadFile("testdata/ne_admin0_excerpt.geojson")
+	if os.IsNotExist(err) {
+		t.Skip("testdata/ne_admin0_excerpt.geojson is missing, see testdata/README.md")
+	}
+	require.NoError(t, err)
+	var fc geojson.FeatureCollection
+	require.NoError(t, json.Unmarshal(b, &fc))
+
+	var holes, antimeridian bool
+	coverer := &s2.RegionCoverer{MinLevel: 8, MaxLevel: 8}
+	for _, f := range fc.Features {
+		gd := &GeoData{}
+		require.NoError(t, GeoJSONFeatureToGeoData(f, gd))
+
+		// geom round trip
+		g, err := GeoDataToGeom(gd)
+		require.NoError(t, err)
+		require.Equal(t, f.Geometry.FlatCoords(), g.FlatCoords())
+		require.Equal(t, f.Geometry.Layout(), g.Layout())
+
+		// protobuf round trip
+		pb, err := proto.Marshal(gd)
+		require.NoError(t, err)
+		gd2 := &GeoData{}
+		require.NoError(t, proto.Unmarshal(pb, gd2))
+		require.True(t, proto.Equal(gd, gd2))
+
+		// GeoJSON round trip
+		out, err := ToGeoJSONFeatureCollection([]*GeoData{gd})
+		require.NoError(t, err)
+		var fc2 geojson.FeatureCollection
+		require.NoError(t, json.Unmarshal(out, &fc2))
+		require.Len(t, fc2.Features, 1)
+		require.Equal(t, f.Geometry.FlatCoords(), fc2.Features[0].Geometry.FlatCoords())
+		require.Equal(t, f.Properties["NAME"], fc2.Features[0].Properties["NAME"])
+
+		cu, err := gd.Cover(coverer)
+		require.NoError(t, err)
+		require.NotEmpty(t, cu)
+
+		switch g := g.(type) {
+		case *geom.Polygon:
+			holes = holes || g.NumLinearRings() > 1
+		case *geom.MultiPolygon:
+			for i := 0; i < g.NumPolygons(); i++ {
+				holes = holes || g.Polygon(i).NumLinearRings() > 1
+			}
+			rect, err := GeoDataToRect(gd)
+			require.NoError(t, err)
+			antimeridian = antimeridian || rect.Lng.IsInverted()
+		}
+	}
+	require.True(t, holes, "no polygon with a hole in the excerpt")
+	require.True(t, antimeridian, "no country crossing the antimeridian in the excerpt")
+}
+
+func TestMultiGeometries(t *testing.T) {
+	var fc geojson.FeatureCollection
+	require.NoError(t, json.Unmarshal([]byte(multiGeoJSON), &fc))
+
+	types := []Geometry_Type{Geometry_MULTIPOINT, Geometry_MULTILINESTRING, Geometry_GEOMETRYCOLLECTION}
+	var geos []*GeoData
+	for i, f := range fc.Features {
+		gd := &GeoData{}
+		require.NoError(t, GeoJSONFeatureToGeoData(f, gd))
+		require.Equal(t, types[i], gd.Geometry.Type)
+		geos = append(geos, gd)
+
+		g, err := GeoDataToGeom(gd)
+		require.NoError(t, err)
+		require.Equal(t, membersCoords(f.Geometry), membersCoords(g))
+
+		// the cover is the union of the members covers
+		coverer := &s2.RegionCoverer{MinLevel: 14, MaxLevel: 14}
+		cu, err := gd.Cover(coverer)
+		require.NoError(t, err)
+		seen := make(map[s2.CellID]bool)
+		for _, c := range cu {
+			require.False(t, seen[c])
+			seen[c] = true
+		}
+		for _, m := range gd.Geometry.Geometries {
+			mcu, err := (&GeoData{Geometry: m}).Cover(coverer)
+			require.NoError(t, err)
+			for _, c := range mcu {
+				require.True(t, seen[c])
+			}
+		}
+
+		rect, err := GeoDataToRect(gd)
+		require.NoError(t, err)
+		require.False(t, rect.IsEmpty())
+
+		region, err := GeoDataToRegion(gd)
+		require.NoError(t, err)
+		require.True(t, region.RectBound().ApproxEqual(rect))
+	}
+
+	require.Len(t, geos[0].Geometry.Geometries, 3)
+	require.Equal(t, Geometry_POINT, geos[0].Geometry.Geometries[0].Type)
+	icu, err := geos[0].InteriorCover(&s2.RegionCoverer{MinLevel: 14, MaxLevel: 14, MaxCells: 8})
+	require.NoError(t, err)
+	require.Empty(t, icu)
+	require.Len(t, geos[1].Geometry.Geometries, 2)
+	require.Equal(t, Geometry_LINESTRING, geos[1].Geometry.Geometries[1].Type)
+	require.Equal(t, Geometry_POLYGON, geos[2].Geometry.Geometries[2].Type)
+
+	rect, err := GeoDataToRect(geos[0])
+	require.NoError(t, err)
+	require.InDelta(t, 46.7984, rect.Lo().Lat.Degrees(), 1e-9)
+	require.InDelta(t, 46.8105, rect.Hi().Lat.Degrees(), 1e-9)
+
+	region, err := GeoDataToRegion(geos[2])
+	require.NoError(t, err)
+	require.True(t, region.ContainsPoint(s2.PointFromLatLng(s2.LatLngFromDegrees(46.8, -71.23))))
+	require.False(t, region.ContainsPoint(s2.PointFromLatLng(s2.LatLngFromDegrees(46.9, -71.23))))
+
+	// GeoJSON round trip
+	out, err := ToGeoJSONFeatureCollection(geos)
+	require.NoError(t, err)
+	var fc2 geojson.FeatureCollection
+	require.NoError(t, json.Unmarshal(out, &fc2))
+	require.Len(t, fc2.Features, 3)
+	for i, f := range fc2.Features {
+		require.IsType(t, fc.Features[i].Geometry, f.Geometry)
+		require.Equal(t, membersCoords(fc.Features[i].Geometry), membersCoords(f.Geometry))
+	}
+	gc := fc2.Features[2].Geometry.(*geom.GeometryCollection)
+	require.Equal(t, 3, gc.NumGeoms())
+	require.IsType(t, &geom.Polygon{}, gc.Geom(2))
+
+	// protobuf round trip
+	pb, err := proto.Marshal(geos[2])
+	require.NoError(t, err)
+	gd := &GeoData{}
+	require.NoError(t, proto.Unmarshal(pb, gd))
+	require.True(t, proto.Equal(geos[2], gd))
+}
+
+// membersCoords returns the flat coordinates of g or of its members for a collection
+func membersCoords(g geom.T) [][]float64 {
+	gc, ok := g.(*geom.GeometryCollection)
+	if !ok {
+		return [][]float64{g.FlatCoords()}
+	}
+	var res [][]float64
+	for _, m := range gc.Geoms() {
+		res = append(res, membersCoords(m)...)
+	}
+	return res
+}
+
 func TestLineCover(t *testing.T) {
 	gd := &GeoData{}
 	var fc geojson.FeatureCollection
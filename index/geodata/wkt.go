@@ -0,0 +1,126 @@
+package geodata
+
+import (
+	"encoding/binary"
+
+	"github.com/pkg/errors"
+	"github.com/twpayne/go-geom"
+	"github.com/twpayne/go-geom/encoding/ewkb"
+	"github.com/twpayne/go-geom/encoding/wkb"
+	"github.com/twpayne/go-geom/encoding/wkt"
+)
+
+// WGS84SRID is the only spatial reference accepted for EWKB, coordinates are lng lat degrees
+const WGS84SRID = 4326
+
+// ewkbFlags are the EWKB bits set in the geometry type for Z, M and SRID
+const ewkbFlags = 0x80000000 | 0x40000000 | 0x20000000
+
+// GeoDataFromWKT returns a GeoData from its WKT representation
+func GeoDataFromWKT(s string) (*GeoData, error) {
+	g, err := wkt.Unmarshal(s)
+	if err != nil {
+		return nil, errors.Wrap(err, "invalid WKT")
+	}
+	return geomToGeoData(g)
+}
+
+// GeoDataFromWKB returns a GeoData from its WKB or EWKB representation,
+// an EWKB SRID must be WGS84SRID
+func GeoDataFromWKB(b []byte) (*GeoData, error) {
+	if len(b) < 5 {
+		return nil, errors.New("invalid WKB too short")
+	}
+
+	var bo binary.ByteOrder = binary.LittleEndian
+	if b[0] == 0 {
+		bo = binary.BigEndian
+	}
+
+	var g geom.T
+	var err error
+	if bo.Uint32(b[1:5])&ewkbFlags != 0 {
+		g, err = ewkb.Unmarshal(b)
+		if err != nil {
+			return nil, errors.Wrap(err, "invalid EWKB")
+		}
+		if srid := g.SRID(); srid != 0 && srid != WGS84SRID {
+			return nil, errors.Errorf("unsupported SRID %d", srid)
+		}
+	} else {
+		g, err = wkb.Unmarshal(b)
+		if err != nil {
+			return nil, errors.Wrap(err, "invalid WKB")
+		}
+	}
+	return geomToGeoData(g)
+}
+
+// geomToGeoData returns a GeoData for a decoded g
+func geomToGeoData(g geom.T) (*GeoData, error) {
+	gd := &GeoData{}
+	if err := GeomToGeoData(g, gd); err != nil {
+		return nil, err
+	}
+	return gd, nil
+}
+
+// WKT returns the WKT representation of gd geometry
+func (gd *GeoData) WKT() (string, error) {
+	g, err := GeoDataToGeom(gd)
+	if err != nil {
+		return "", err
+	}
+	s, err := wkt.Marshal(g)
+	if err != nil {
+		return "", errors.Wrap(err, "can't encode WKT")
+	}
+	return s, nil
+}
+
+// WKB returns the little endian WKB representation of gd geometry
+func (gd *GeoData) WKB() ([]byte, error) {
+	g, err := GeoDataToGeom(gd)
+	if err != nil {
+		return nil, err
+	}
+	b, err := wkb.Marshal(g, wkb.NDR)
+	if err != nil {
+		return nil, errors.Wrap(err, "can't encode WKB")
+	}
+	return b, nil
+}
+
+// EWKB returns the little endian EWKB representation of gd geometry with the WGS84SRID
+func (gd *GeoData) EWKB() ([]byte, error) {
+	g, err := GeoDataToGeom(gd)
+	if err != nil {
+		return nil, err
+	}
+	b, err := ewkb.Marshal(withSRID(g, WGS84SRID), ewkb.NDR)
+	if err != nil {
+		return nil, errors.Wrap(err, "can't encode EWKB")
+	}
+	return b, nil
+}
+
+// withSRID sets the srid of g
+func withSRID(g geom.T, srid int) geom.T {
+	switch g := g.(type) {
+	case *geom.Point:
+		return g.SetSRID(srid)
+	case *geom.MultiPoint:
+		return g.SetSRID(srid)
+	case *geom.LineString:
+		return g.SetSRID(srid)
+	case *geom.MultiLineString:
+		return g.SetSRID(srid)
+	case *geom.Polygon:
+		return g.SetSRID(srid)
+	case *geom.MultiPolygon:
+		return g.SetSRID(srid)
+	case *geom.GeometryCollection:
+		return g.SetSRID(srid)
+	}
+	return g
+}
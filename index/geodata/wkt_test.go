@@ -0,0 +1,87 @@
+package geodata
+
+import (
+	"testing"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/stretchr/testify/require"
+	"github.com/twpayne/go-geom"
+	"github.com/twpayne/go-geom/encoding/ewkb"
+)
+
+func TestWKT(t *testing.T) {
+	tests := []struct {
+		wkt string
+		typ Geometry_Type
+	}{
+		{"POINT (-71.2275 46.7984)", Geometry_POINT},
+		{"LINESTRING (-71.2641 46.8373, -71.2504 46.8432)", Geometry_LINESTRING},
+		{"POLYGON ((-71.24 46.79, -71.22 46.79, -71.22 46.81, -71.24 46.81, -71.24 46.79), (-71.235 46.795, -71.235 46.805, -71.225 46.805, -71.225 46.795, -71.235 46.795))", Geometry_POLYGON},
+		{"MULTIPOINT (-71.2275 46.7984, -71.2301 46.8012)", Geometry_MULTIPOINT},
+		{"MULTILINESTRING ((-71.2641 46.8373, -71.2504 46.8432), (-71.2368 46.8491, -71.2268 46.8535))", Geometry_MULTILINESTRING},
+		{"MULTIPOLYGON (((-71.24 46.79, -71.22 46.79, -71.22 46.81, -71.24 46.81, -71.24 46.79)), ((-71.2 46.79, -71.19 46.79, -71.19 46.8, -71.2 46.79)))", Geometry_MULTIPOLYGON},
+		{"GEOMETRYCOLLECTION (POINT (-71.2275 46.7984), LINESTRING (-71.2641 46.8373, -71.2504 46.8432))", Geometry_GEOMETRYCOLLECTION},
+	}
+
+	for _, test := range tests {
+		gd, err := GeoDataFromWKT(test.wkt)
+		require.NoError(t, err, test.wkt)
+		require.Equal(t, test.typ, gd.Geometry.Type)
+
+		s, err := gd.WKT()
+		require.NoError(t, err)
+		require.Equal(t, test.wkt, s)
+
+		// WKB round trip
+		b, err := gd.WKB()
+		require.NoError(t, err)
+		gdb, err := GeoDataFromWKB(b)
+		require.NoError(t, err)
+		require.True(t, proto.Equal(gd, gdb), test.wkt)
+
+		// EWKB round trip with SRID
+		b, err = gd.EWKB()
+		require.NoError(t, err)
+		g, err := ewkb.Unmarshal(b)
+		require.NoError(t, err)
+		require.Equal(t, WGS84SRID, g.SRID())
+		gdb, err = GeoDataFromWKB(b)
+		require.NoError(t, err)
+		require.True(t, proto.Equal(gd, gdb), test.wkt)
+	}
+
+	gd, err := GeoDataFromWKT(tests[2].wkt)
+	require.NoError(t, err)
+	require.Equal(t, []int32{10, 20}, gd.Geometry.Ends)
+
+	_, err = GeoDataFromWKT("POINT (-71.2275")
+	require.Error(t, err)
+
+	// altitudes are kept
+	gd, err = GeoDataFromWKT("POINT Z (-71.2275 46.7984 10)")
+	require.NoError(t, err)
+	require.Equal(t, Geometry_XYZ, gd.Geometry.Layout)
+	s, err := gd.WKT()
+	require.NoError(t, err)
+	require.Equal(t, "POINT Z (-71.2275 46.7984 10)", s)
+	b, err := gd.EWKB()
+	require.NoError(t, err)
+	gdb, err := GeoDataFromWKB(b)
+	require.NoError(t, err)
+	require.True(t, proto.Equal(gd, gdb))
+	_, err = GeoDataFromWKB([]byte{1, 2})
+	require.Error(t, err)
+
+	// only WGS84 is accepted
+	b, err = ewkb.Marshal(geom.NewPointFlat(geom.XY, []float64{500000, 4649776}).SetSRID(32633), ewkb.NDR)
+	require.NoError(t, err)
+	_, err = GeoDataFromWKB(b)
+	require.Error(t, err)
+
+	// EWKB without SRID
+	b, err = ewkb.Marshal(geom.NewPointFlat(geom.XY, quebec), ewkb.XDR)
+	require.NoError(t, err)
+	gd, err = GeoDataFromWKB(b)
+	require.NoError(t, err)
+	require.Equal(t, quebec, gd.Geometry.Coordinates)
+}
@@ -0,0 +1,304 @@
+package index
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/binary"
+	"sort"
+	"sync"
+
+	"github.com/akhenakh/oureadb/store"
+	"github.com/golang/geo/s2"
+	"github.com/pkg/errors"
+)
+
+// GeoIDFunc is called for every GeoID streamed by a query
+// returning false stops the scan after id
+type GeoIDFunc func(id GeoID) bool
+
+// Cursor is an opaque token returned by a streamed query stopped before its end,
+// passed back in QueryOptions it resumes the scan right after the last streamed id
+// an empty Cursor means the scan went to its end
+type Cursor string
+
+// QueryOptions are the options of a streamed query
+type QueryOptions struct {
+	// Limit is the maximum number of ids to stream, 0 means no limit
+	Limit int
+
+	// Cursor resumes a previous scan
+	Cursor Cursor
+}
+
+// keyRange is a range of keys >= start and < end
+type keyRange struct {
+	start, end []byte
+}
+
+// cellKeyRange returns the range of keys prefix+c+*
+func cellKeyRange(prefix []byte, c s2.CellID) keyRange {
+	start := make([]byte, len(prefix), len(prefix)+8)
+	copy(start, prefix)
+	start = append(start, itob(uint64(c))...)
+	end := make([]byte, len(prefix), len(prefix)+8)
+	copy(end, prefix)
+	end = append(end, itob(uint64(c)+1)...)
+	return keyRange{start: start, end: end}
+}
+
+// cellDescendantsKeyRange returns the range of keys prefix+d+* for d any descendant of c, c included
+func cellDescendantsKeyRange(prefix []byte, c s2.CellID) keyRange {
+	start := make([]byte, len(prefix), len(prefix)+8)
+	copy(start, prefix)
+	start = append(start, itob(uint64(c.RangeMin()))...)
+	end := make([]byte, len(prefix), len(prefix)+8)
+	copy(end, prefix)
+	end = append(end, itob(uint64(c.RangeMax())+1)...)
+	return keyRange{start: start, end: end}
+}
+
+// levelKeyRange returns the range of keys prefix+l+* for l any descendant of c at level, c level being lower or equal
+// only valid for indexes storing a single level, adjacent cells ranges are then touching
+// and merged by normalizeRanges into one scan
+func levelKeyRange(prefix []byte, c s2.CellID, level int) keyRange {
+	start := make([]byte, len(prefix), len(prefix)+8)
+	copy(start, prefix)
+	start = append(start, itob(uint64(c.ChildBeginAtLevel(level)))...)
+	end := make([]byte, len(prefix), len(prefix)+8)
+	copy(end, prefix)
+	end = append(end, itob(uint64(c.ChildEndAtLevel(level)))...)
+	return keyRange{start: start, end: end}
+}
+
+// leafKeyRange returns the range of keys prefix+l+* for l any leaf cell of c
+// only valid for indexes storing leaf cells, ranges of adjacent cells are touching
+func leafKeyRange(prefix []byte, c s2.CellID) keyRange {
+	start := make([]byte, len(prefix), len(prefix)+8)
+	copy(start, prefix)
+	start = append(start, itob(uint64(c.RangeMin()))...)
+	end := make([]byte, len(prefix), len(prefix)+8)
+	copy(end, prefix)
+	end = append(end, itob(uint64(c.RangeMax().Next()))...)
+	return keyRange{start: start, end: end}
+}
+
+// keyDecoder returns the GeoID for a key/value found during a scan
+// ok is false if the entry should be skipped
+type keyDecoder func(k, v []byte) (id GeoID, ok bool, err error)
+
+// normalizeRanges sorts ranges and merges the overlapping ones
+func normalizeRanges(ranges []keyRange) []keyRange {
+	if len(ranges) == 0 {
+		return ranges
+	}
+	sort.Slice(ranges, func(i, j int) bool { return bytes.Compare(ranges[i].start, ranges[j].start) < 0 })
+
+	res := []keyRange{ranges[0]}
+	for _, r := range ranges[1:] {
+		last := &res[len(res)-1]
+		if bytes.Compare(r.start, last.end) <= 0 {
+			if bytes.Compare(r.end, last.end) > 0 {
+				last.end = r.end
+			}
+			continue
+		}
+		res = append(res, r)
+	}
+	return res
+}
+
+// scanRanges streams the ids found in ranges in key order
+// the cursor keys are stored without the index prefix
+func scanRanges(ctx context.Context, kv store.KVReader, prefix []byte, ranges []keyRange, opts *QueryOptions, decode keyDecoder, fn GeoIDFunc) (Cursor, error) {
+	if opts == nil {
+		opts = &QueryOptions{}
+	}
+
+	var after []byte
+	if opts.Cursor != "" {
+		ck, err := base64.RawURLEncoding.DecodeString(string(opts.Cursor))
+		if err != nil {
+			return "", errors.Wrap(err, "invalid cursor")
+		}
+		after = make([]byte, len(prefix), len(prefix)+len(ck)+1)
+		copy(after, prefix)
+		after = append(after, ck...)
+		// the smallest key greater than the cursor
+		after = append(after, 0)
+	}
+
+	var count int
+	for _, r := range normalizeRanges(ranges) {
+		if err := ctx.Err(); err != nil {
+			return "", err
+		}
+
+		start := r.start
+		if after != nil {
+			if bytes.Compare(r.end, after) <= 0 {
+				continue
+			}
+			if bytes.Compare(start, after) < 0 {
+				start = after
+			}
+		}
+
+		stop, err := func() (bool, error) {
+			iter := kv.RangeIterator(start, r.end)
+			defer iter.Close()
+			for {
+				if err := ctx.Err(); err != nil {
+					return false, err
+				}
+
+				kid, v, ok := iter.Current()
+				if !ok {
+					return false, nil
+				}
+				kid = append([]byte(nil), kid...)
+
+				id, ok, err := decode(kid, v)
+				if err != nil {
+					return false, errors.Wrap(err, "read back failed key from db")
+				}
+
+				if ok {
+					count++
+					if !fn(id) || (opts.Limit > 0 && count >= opts.Limit) {
+						after = kid
+						return true, nil
+					}
+				}
+				iter.Next()
+			}
+		}()
+		if err != nil {
+			return "", err
+		}
+		if stop {
+			return Cursor(base64.RawURLEncoding.EncodeToString(after[len(prefix):])), nil
+		}
+	}
+
+	return "", nil
+}
+
+// scanCells calls fn with the cell, the key and the value of every entry in ranges
+// k and v are only valid during the call, an error returned by fn stops the scan
+func scanCells(ctx context.Context, kvs store.KVStore, prefix []byte, ranges []keyRange, fn func(c s2.CellID, k, v []byte) error) error {
+	kv, err := kvs.Reader()
+	if err != nil {
+		return err
+	}
+	defer kv.Close()
+
+	for _, r := range normalizeRanges(ranges) {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		err := func() error {
+			iter := kv.RangeIterator(r.start, r.end)
+			defer iter.Close()
+			for {
+				if err := ctx.Err(); err != nil {
+					return err
+				}
+
+				k, v, ok := iter.Current()
+				if !ok {
+					return nil
+				}
+				if len(k) < len(prefix)+8 {
+					return errors.New("invalid key")
+				}
+
+				err := fn(s2.CellID(binary.BigEndian.Uint64(k[len(prefix):])), k, v)
+				if err != nil {
+					return err
+				}
+				iter.Next()
+			}
+		}()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// collectRanges returns the ids found in ranges without duplicates
+// with workers <= 1 all the ranges are scanned using one reader so results come from a single snapshot,
+// otherwise the ranges are split between at most workers goroutines each using its own reader
+func collectRanges(ctx context.Context, kvs store.KVStore, prefix []byte, ranges []keyRange, workers int, decode keyDecoder) ([]GeoID, error) {
+	ranges = normalizeRanges(ranges)
+	if workers > len(ranges) {
+		workers = len(ranges)
+	}
+
+	m := make(map[string]struct{})
+	var mu sync.Mutex
+
+	scan := func(ctx context.Context, ranges []keyRange) error {
+		kv, err := kvs.Reader()
+		if err != nil {
+			return err
+		}
+		defer kv.Close()
+
+		_, err = scanRanges(ctx, kv, prefix, ranges, nil, decode, func(id GeoID) bool {
+			mu.Lock()
+			m[string(id)] = struct{}{}
+			mu.Unlock()
+			return true
+		})
+		return err
+	}
+
+	if workers <= 1 {
+		if err := scan(ctx, ranges); err != nil {
+			return nil, errors.Wrap(err, "fetching geo ids from cells failed")
+		}
+	} else {
+		ctx, cancel := context.WithCancel(ctx)
+		defer cancel()
+
+		var wg sync.WaitGroup
+		var once sync.Once
+		var scanErr error
+
+		// contiguous chunks of ranges per worker
+		size := (len(ranges) + workers - 1) / workers
+		for i := 0; i < len(ranges); i += size {
+			end := i + size
+			if end > len(ranges) {
+				end = len(ranges)
+			}
+			wg.Add(1)
+			go func(ranges []keyRange) {
+				defer wg.Done()
+				if err := scan(ctx, ranges); err != nil {
+					once.Do(func() {
+						scanErr = err
+						cancel()
+					})
+				}
+			}(ranges[i:end])
+		}
+		wg.Wait()
+
+		if scanErr != nil {
+			return nil, errors.Wrap(scanErr, "fetching geo ids from cells failed")
+		}
+	}
+
+	res := make([]GeoID, len(m))
+	var i int
+	for k := range m {
+		res[i] = []byte(k)
+		i++
+	}
+
+	return res, nil
+}
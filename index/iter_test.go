@@ -0,0 +1,219 @@
+package index
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/akhenakh/oureadb/index/geodata"
+	"github.com/golang/geo/s2"
+	"github.com/stretchr/testify/require"
+)
+
+func TestStreamPagination(t *testing.T) {
+	s := openStore(t)
+	defer cleanup(t, s)
+
+	idx := NewS2PointIdx(s, []byte("STREAM"))
+
+	for i := 0; i < 10; i++ {
+		_, err := idx.PointIndex(quebec[1]+float64(i)*0.001, quebec[0], []byte{byte('a' + i)})
+		require.NoError(t, err)
+	}
+
+	center := s2.PointFromLatLng(s2.LatLngFromDegrees(quebec[1], quebec[0]))
+	cap := s2.CapFromCenterArea(center, s2RadialAreaMeters(5000))
+
+	var res []GeoID
+	var pages int
+	opts := &QueryOptions{Limit: 3}
+	for {
+		cursor, err := idx.StreamGeoIdsRegionQuery(cap, opts, func(id GeoID) bool {
+			res = append(res, id)
+			return true
+		})
+		require.NoError(t, err)
+		pages++
+		if cursor == "" {
+			break
+		}
+		opts.Cursor = cursor
+	}
+	require.Equal(t, 4, pages)
+	require.Len(t, res, 10)
+
+	m := make(map[string]struct{})
+	for _, id := range res {
+		m[string(id)] = struct{}{}
+	}
+	require.Len(t, m, 10)
+
+	// early termination
+	var count int
+	cursor, err := idx.StreamGeoIdsRegionQuery(cap, nil, func(id GeoID) bool {
+		count++
+		return count < 2
+	})
+	require.NoError(t, err)
+	require.Equal(t, 2, count)
+	require.NotEmpty(t, cursor)
+
+	// invalid cursor
+	_, err = idx.StreamGeoIdsRegionQuery(cap, &QueryOptions{Cursor: "!!"}, func(id GeoID) bool { return true })
+	require.Error(t, err)
+}
+
+func TestStreamTime(t *testing.T) {
+	s := openStore(t)
+	defer cleanup(t, s)
+
+	idx := NewS2FlatTimeIdx(s, []byte("STREAMTIME"), s2Level)
+
+	geo := &geodata.GeoData{
+		Geometry: &geodata.Geometry{
+			Coordinates: paris,
+			Type:        geodata.Geometry_POINT,
+		},
+	}
+
+	now := time.Now()
+	for i := 0; i < 5; i++ {
+		err := idx.GeoTimeIndex(geo, now.Add(-time.Duration(i)*time.Minute), []byte{byte('a' + i)})
+		require.NoError(t, err)
+	}
+
+	cu, err := idx.Covering(geo)
+	require.NoError(t, err)
+
+	var res []GeoID
+	cursor, err := idx.StreamGeoTimeIdsAtCells(cu, MaxGeoTime, MinGeoTime, &QueryOptions{Limit: 2}, func(id GeoID) bool {
+		res = append(res, id)
+		return true
+	})
+	require.NoError(t, err)
+	require.Equal(t, []GeoID{GeoID("a"), GeoID("b")}, res)
+
+	cursor, err = idx.StreamGeoTimeIdsAtCells(cu, MaxGeoTime, MinGeoTime, &QueryOptions{Cursor: cursor}, func(id GeoID) bool {
+		res = append(res, id)
+		return true
+	})
+	require.NoError(t, err)
+	require.Empty(t, cursor)
+	require.Len(t, res, 5)
+	require.Equal(t, GeoID("e"), res[4])
+}
+
+func TestCoalescedRanges(t *testing.T) {
+	c := s2.CellIDFromLatLng(s2.LatLngFromDegrees(quebec[1], quebec[0])).Parent(s2Level)
+	cells := []s2.CellID{c.Next().Next(), c, c.Next(), c.Next().Next().Next().Next()}
+
+	ranges := make([]keyRange, len(cells))
+	for i, c := range cells {
+		ranges[i] = levelKeyRange([]byte("P"), c, s2Level)
+	}
+	require.Len(t, normalizeRanges(ranges), 2)
+
+	for i, c := range cells {
+		ranges[i] = leafKeyRange([]byte("P"), c)
+	}
+	require.Len(t, normalizeRanges(ranges), 2)
+}
+
+func TestGeoIdsAtCellsWorkers(t *testing.T) {
+	s := openStore(t)
+	defer cleanup(t, s)
+
+	idx := NewS2FlatIdx(s, []byte("WORKERS"), s2Level)
+	cells := indexGrid(t, idx, 20)
+
+	var expected []GeoID
+	for _, c := range cells {
+		ids, err := idx.GeoIdsAtCell(c)
+		require.NoError(t, err)
+		expected = append(expected, ids...)
+	}
+
+	res, err := idx.GeoIdsAtCells(cells)
+	require.NoError(t, err)
+	require.ElementsMatch(t, expected, res)
+
+	idx.SetScanWorkers(4)
+	res, err = idx.GeoIdsAtCells(cells)
+	require.NoError(t, err)
+	require.ElementsMatch(t, expected, res)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, err = idx.GeoIdsAtCellsContext(ctx, cells)
+	require.Error(t, err)
+}
+
+// indexGrid indexes one point per cell on a n*n grid of adjacent cells around quebec
+// and returns the cells
+func indexGrid(t testing.TB, idx *S2FlatIdx, n int) []s2.CellID {
+	center := s2.CellIDFromLatLng(s2.LatLngFromDegrees(quebec[1], quebec[0])).Parent(s2Level)
+	size := s2.CellFromCellID(center).RectBound().Size()
+
+	var cells []s2.CellID
+	for i := 0; i < n; i++ {
+		for j := 0; j < n; j++ {
+			ll := s2.LatLngFromDegrees(
+				quebec[1]+float64(i)*size.Lat.Degrees(),
+				quebec[0]+float64(j)*size.Lng.Degrees(),
+			)
+			gd := &geodata.GeoData{Geometry: &geodata.Geometry{
+				Type:        geodata.Geometry_POINT,
+				Coordinates: []float64{ll.Lng.Degrees(), ll.Lat.Degrees()},
+			}}
+			err := idx.GeoIndex(gd, []byte(fmt.Sprintf("%d-%d", i, j)))
+			require.NoError(t, err)
+			cells = append(cells, s2.CellIDFromLatLng(ll).Parent(s2Level))
+		}
+	}
+	return cells
+}
+
+func benchmarkGeoIdsAtCells(b *testing.B, workers int) {
+	s := openStore(b)
+	defer cleanup(b, s)
+
+	idx := NewS2FlatIdx(s, []byte("BENCH"), s2Level)
+	idx.SetScanWorkers(workers)
+	cells := indexGrid(b, idx, 25)
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		_, err := idx.GeoIdsAtCells(cells)
+		if err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkGeoIdsAtCells(b *testing.B) { benchmarkGeoIdsAtCells(b, 0) }
+
+func BenchmarkGeoIdsAtCellsWorkers(b *testing.B) { benchmarkGeoIdsAtCells(b, 4) }
+
+// BenchmarkGeoIdsAtCellsPerCell is the previous behaviour, one reader and one scan per cell
+func BenchmarkGeoIdsAtCellsPerCell(b *testing.B) {
+	s := openStore(b)
+	defer cleanup(b, s)
+
+	idx := NewS2FlatIdx(s, []byte("BENCH"), s2Level)
+	cells := indexGrid(b, idx, 25)
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		m := make(map[string]struct{})
+		for _, c := range cells {
+			ids, err := idx.GeoIdsAtCell(c)
+			if err != nil {
+				b.Fatal(err)
+			}
+			for _, id := range ids {
+				m[string(id)] = struct{}{}
+			}
+		}
+	}
+}
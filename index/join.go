@@ -0,0 +1,150 @@
+package index
+
+import (
+	"context"
+
+	"github.com/akhenakh/oureadb/store"
+	"github.com/pkg/errors"
+)
+
+// JoinPair is a candidate pair of a spatial join, a point of the left index in a cell of the right one
+// Interior is true if the point is in an interior cell of the right geometry so the match is certain
+type JoinPair struct {
+	Left, Right GeoID
+	Interior    bool
+}
+
+// JoinFunc is called for every pair emitted by a spatial join, returning false stops the join
+type JoinFunc func(p JoinPair) bool
+
+// JoinRefineFunc is called for the non interior candidate pairs of a spatial join,
+// returning false drops the pair, for example after checking the point is really inside the polygon
+type JoinRefineFunc func(left, right GeoID) (bool, error)
+
+// SpatialJoin emits the pairs of points of left falling in the cells of the geometries indexed in right
+// both key spaces are walked once in cell order, seeking over the cells present in only one of them,
+// every pair is emitted once, refine is optional and only called for the non interior pairs
+func SpatialJoin(left *S2PointIdx, right *S2FlatIdx, refine JoinRefineFunc, fn JoinFunc) error {
+	return SpatialJoinContext(context.Background(), left, right, refine, fn)
+}
+
+// SpatialJoinContext is SpatialJoin with a context
+func SpatialJoinContext(ctx context.Context, left *S2PointIdx, right *S2FlatIdx, refine JoinRefineFunc, fn JoinFunc) error {
+	lkv, err := left.Reader()
+	if err != nil {
+		return err
+	}
+	defer lkv.Close()
+
+	rkv, err := right.Reader()
+	if err != nil {
+		return err
+	}
+	defer rkv.Close()
+
+	liter := cellsIterator(lkv, left.prefix)
+	defer liter.Close()
+	riter := cellsIterator(rkv, right.prefix)
+	defer riter.Close()
+
+	type match struct {
+		id       GeoID
+		interior bool
+	}
+	var group []match
+
+	for {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		lk, _, ok := liter.Current()
+		if !ok {
+			return nil
+		}
+		lc, lid, err := left.keyToValues(lk)
+		if err != nil {
+			return errors.Wrap(err, "read back failed key from db")
+		}
+
+		rk, _, ok := riter.Current()
+		if !ok {
+			return nil
+		}
+		rc, _, err := right.keyToValues(rk)
+		if err != nil {
+			return errors.Wrap(err, "read back failed key from db")
+		}
+
+		switch {
+		case lc < rc.RangeMin():
+			liter.Seek(leafKeyRange(left.prefix, rc).start)
+			continue
+		case lc > rc.RangeMax():
+			riter.Seek(levelKeyRange(right.prefix, lc.Parent(right.level), right.level).start)
+			continue
+		}
+
+		// all the geometries indexed in rc
+		group = group[:0]
+		for {
+			rk, rv, ok := riter.Current()
+			if !ok {
+				break
+			}
+			c, rid, err := right.keyToValues(rk)
+			if err != nil {
+				return errors.Wrap(err, "read back failed key from db")
+			}
+			if c != rc {
+				break
+			}
+			group = append(group, match{
+				id:       append(GeoID(nil), rid...),
+				interior: len(rv) > 0 && rv[0] == interiorFlag,
+			})
+			riter.Next()
+		}
+
+		// all the points in rc
+		for lc <= rc.RangeMax() {
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+
+			lid = append(GeoID(nil), lid...)
+			for _, m := range group {
+				if !m.interior && refine != nil {
+					ok, err := refine(lid, m.id)
+					if err != nil {
+						return errors.Wrap(err, "refining join pair failed")
+					}
+					if !ok {
+						continue
+					}
+				}
+				if !fn(JoinPair{Left: lid, Right: m.id, Interior: m.interior}) {
+					return nil
+				}
+			}
+
+			liter.Next()
+			lk, _, ok := liter.Current()
+			if !ok {
+				return nil
+			}
+			lc, lid, err = left.keyToValues(lk)
+			if err != nil {
+				return errors.Wrap(err, "read back failed key from db")
+			}
+		}
+	}
+}
+
+// cellsIterator returns an iterator over the cell keys under prefix, the meta namespace excluded
+func cellsIterator(kv store.KVReader, prefix []byte) store.KVIterator {
+	end := make([]byte, len(prefix), len(prefix)+1)
+	copy(end, prefix)
+	end = append(end, metaNamespace)
+	return kv.RangeIterator(prefix, end)
+}
@@ -0,0 +1,114 @@
+package index
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"testing"
+
+	"github.com/akhenakh/oureadb/index/geodata"
+	"github.com/golang/geo/s2"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSpatialJoin(t *testing.T) {
+	s := openStore(t)
+	defer cleanup(t, s)
+
+	flat := NewS2FlatIdx(s, []byte("JOINF"), 16)
+	points := NewS2PointIdx(s, []byte("JOINP"))
+
+	gd := &geodata.GeoData{
+		Geometry: &geodata.Geometry{
+			Coordinates: ring,
+			Type:        geodata.Geometry_POLYGON,
+		},
+	}
+	require.NoError(t, flat.GeoIndex(gd, []byte("ring")))
+	gd2 := &geodata.GeoData{
+		Geometry: &geodata.Geometry{
+			Coordinates: road,
+			Type:        geodata.Geometry_LINESTRING,
+		},
+	}
+	require.NoError(t, flat.GeoIndex(gd2, []byte("road")))
+
+	// a grid of points over the ring and the road
+	var n int
+	for lat := 46.794; lat < 46.855; lat += 0.0005 {
+		for lng := -71.265; lng < -71.224; lng += 0.0005 {
+			_, err := points.PointIndex(lat, lng, []byte(fmt.Sprintf("p%d", n)))
+			require.NoError(t, err)
+			n++
+		}
+	}
+
+	// expected pairs using a lookup per point
+	var expected []string
+	var pointsIn int
+	interior := make(map[string]bool)
+	err := scanCells(context.Background(), s, points.prefix, []keyRange{{start: points.prefix, end: append([]byte("JOINP"), metaNamespace)}},
+		func(c s2.CellID, k, _ []byte) error {
+			_, id, err := points.keyToValues(k)
+			if err != nil {
+				return err
+			}
+			matches, err := flat.GeoMatchesAtCells([]s2.CellID{c.Parent(16)})
+			if err != nil {
+				return err
+			}
+			for _, m := range matches {
+				p := string(id) + "/" + string(m.ID)
+				expected = append(expected, p)
+				interior[p] = m.Interior
+			}
+			if len(matches) > 0 {
+				pointsIn++
+			}
+			return nil
+		})
+	require.NoError(t, err)
+	require.NotZero(t, pointsIn)
+	sort.Strings(expected)
+
+	var got []string
+	var gotInterior int
+	err = SpatialJoin(points, flat, nil, func(p JoinPair) bool {
+		k := string(p.Left) + "/" + string(p.Right)
+		got = append(got, k)
+		require.Equal(t, interior[k], p.Interior)
+		if p.Interior {
+			gotInterior++
+		}
+		return true
+	})
+	require.NoError(t, err)
+	sort.Strings(got)
+	require.Equal(t, expected, got)
+	require.NotZero(t, gotInterior)
+
+	// refine is only called for the non interior pairs
+	var refined int
+	var kept int
+	err = SpatialJoin(points, flat, func(left, right GeoID) (bool, error) {
+		require.False(t, interior[string(left)+"/"+string(right)])
+		refined++
+		return false, nil
+	}, func(p JoinPair) bool {
+		require.True(t, p.Interior)
+		kept++
+		return true
+	})
+	require.NoError(t, err)
+	require.Equal(t, gotInterior, kept)
+	require.Equal(t, len(expected)-gotInterior, refined)
+
+	// stops early
+	var count int
+	err = SpatialJoin(points, flat, nil, func(p JoinPair) bool {
+		count++
+		return count < 3
+	})
+	require.NoError(t, err)
+	require.Equal(t, 3, count)
+}
@@ -0,0 +1,253 @@
+package index
+
+import (
+	"encoding/json"
+	"sync"
+	"time"
+
+	"github.com/akhenakh/oureadb/store"
+	"github.com/pkg/errors"
+)
+
+const (
+	// metadataMetaType marks the index metadata record
+	metadataMetaType = 'm'
+
+	// layoutVersion is the version of the keys layout written by the indexes
+	layoutVersion = 1
+)
+
+// Index types recorded in the metadata
+const (
+	S2FlatIdxType       = "s2flat"
+	S2FlatTimeIdxType   = "s2flattime"
+	S2PointIdxType      = "s2point"
+	S2CoverIdxType      = "s2cover"
+	S2AttrIdxType       = "s2attr"
+	S2TrajectoryIdxType = "s2trajectory"
+)
+
+var (
+	// ErrNoMetadata is returned when opening an index without metadata record
+	ErrNoMetadata = errors.New("no index metadata found")
+
+	// ErrMetadataMismatch is returned when opening an index with parameters different from its metadata
+	ErrMetadataMismatch = errors.New("index metadata mismatch")
+)
+
+// IndexMetadata is the record persisted under an index prefix describing how it was built
+type IndexMetadata struct {
+	Type string `json:"type"`
+
+	// s2 level of the flat indexes
+	Level int `json:"level,omitempty"`
+
+	// cover parameters of S2CoverIdx
+	MinLevel int `json:"min_level,omitempty"`
+	MaxLevel int `json:"max_level,omitempty"`
+	MaxCells int `json:"max_cells,omitempty"`
+
+	// indexed property of S2AttrIdx
+	Property string `json:"property,omitempty"`
+
+	LayoutVersion int       `json:"layout_version"`
+	Created       time.Time `json:"created"`
+
+	// Entries is an approximate number of cell keys: the keys written minus the ones deleted through the index,
+	// rewritten in the same batches from the count kept by the opened index,
+	// an overwritten key is counted again and several handles or processes writing the same index,
+	// or a crash between a batch and the count update, leave it stale, see RepairIndexMetadata
+	Entries int64 `json:"entries"`
+}
+
+// ReadIndexMetadata returns the metadata record stored under prefix
+// returns ErrNoMetadata if there is none
+func ReadIndexMetadata(s store.KVStore, prefix []byte) (*IndexMetadata, error) {
+	kv, err := s.Reader()
+	if err != nil {
+		return nil, err
+	}
+	defer kv.Close()
+
+	v, err := kv.Get(metaKey(prefix, metadataMetaType, nil))
+	if err != nil {
+		return nil, errors.Wrap(err, "reading index metadata failed")
+	}
+	if v == nil {
+		return nil, ErrNoMetadata
+	}
+
+	var md IndexMetadata
+	if err := json.Unmarshal(v, &md); err != nil {
+		return nil, errors.Wrap(err, "decoding index metadata failed")
+	}
+	return &md, nil
+}
+
+// RepairIndexMetadata recounts the cell keys under prefix and stores the count as the Entries of its metadata record
+// returns ErrNoMetadata if there is none, the indexes opened before keep their previous count
+func RepairIndexMetadata(s store.KVStore, prefix []byte) (*IndexMetadata, error) {
+	md, err := ReadIndexMetadata(s, prefix)
+	if err != nil {
+		return nil, err
+	}
+
+	n, err := countKeys(s, prefix)
+	if err != nil {
+		return nil, err
+	}
+	md.Entries = n
+
+	m := &metadata{key: metaKey(prefix, metadataMetaType, nil), md: *md}
+	if err := m.write(s); err != nil {
+		return nil, err
+	}
+	return md, nil
+}
+
+// metadata is the metadata of an opened index, kept in sync with the writes
+type metadata struct {
+	key []byte
+
+	// protects md
+	mu sync.Mutex
+	md IndexMetadata
+}
+
+// openMetadata reads the metadata under prefix and validates it against md
+// if create is true and there is no record, md is stored with the number of keys already under prefix
+func openMetadata(s store.KVStore, prefix []byte, md IndexMetadata, create bool) (*metadata, error) {
+	m := &metadata{key: metaKey(prefix, metadataMetaType, nil)}
+
+	stored, err := ReadIndexMetadata(s, prefix)
+	switch {
+	case err == ErrNoMetadata && create:
+		n, err := countKeys(s, prefix)
+		if err != nil {
+			return nil, err
+		}
+		md.LayoutVersion = layoutVersion
+		md.Created = time.Now().UTC()
+		md.Entries = n
+		m.md = md
+		if err := m.write(s); err != nil {
+			return nil, err
+		}
+		return m, nil
+	case err != nil:
+		return nil, err
+	}
+
+	switch {
+	case stored.Type != md.Type:
+		return nil, errors.Wrapf(ErrMetadataMismatch, "index type is %s, opened as %s", stored.Type, md.Type)
+	case stored.LayoutVersion != layoutVersion:
+		return nil, errors.Wrapf(ErrMetadataMismatch, "index layout version is %d, supported %d", stored.LayoutVersion, layoutVersion)
+	case stored.Level != md.Level:
+		return nil, errors.Wrapf(ErrMetadataMismatch, "index level is %d, opened with %d", stored.Level, md.Level)
+	case stored.Property != md.Property:
+		return nil, errors.Wrapf(ErrMetadataMismatch, "index property is %q, opened with %q", stored.Property, md.Property)
+	case stored.MinLevel != md.MinLevel || stored.MaxLevel != md.MaxLevel || stored.MaxCells != md.MaxCells:
+		return nil, errors.Wrapf(ErrMetadataMismatch, "index cover is %d-%d/%d, opened with %d-%d/%d",
+			stored.MinLevel, stored.MaxLevel, stored.MaxCells, md.MinLevel, md.MaxLevel, md.MaxCells)
+	}
+
+	m.md = *stored
+	return m, nil
+}
+
+// get returns a copy of the metadata, nil if m is nil
+func (m *metadata) get() *IndexMetadata {
+	if m == nil {
+		return nil
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	md := m.md
+	return &md
+}
+
+// add sets in batch the record with n entries added, the returned func applies n to m
+// and must only be called once batch is executed, nothing is done if m is nil
+func (m *metadata) add(batch store.KVBatch, n int) func() {
+	if m == nil || n == 0 {
+		return func() {}
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	md := m.md
+	md.Entries += int64(n)
+	v, _ := json.Marshal(md)
+	batch.Set(m.key, v)
+	return func() {
+		m.mu.Lock()
+		defer m.mu.Unlock()
+		m.md.Entries += int64(n)
+	}
+}
+
+// write stores the record
+func (m *metadata) write(s store.KVStore) error {
+	v, err := json.Marshal(m.md)
+	if err != nil {
+		return errors.Wrap(err, "encoding index metadata failed")
+	}
+
+	kv, err := s.Writer()
+	if err != nil {
+		return err
+	}
+	defer kv.Close()
+
+	batch := kv.NewBatch()
+	defer batch.Close()
+	batch.Set(m.key, v)
+
+	return errors.Wrap(kv.ExecuteBatch(batch), "writing index metadata failed")
+}
+
+// addEntries updates in batch the metadata of the entries counted in an index
+// the returned func applies the counts once batch is executed, see metadata.add
+func addEntries(batch store.KVBatch, entries []bulkEntry) func() {
+	counts := make(map[*metadata]int)
+	for _, e := range entries {
+		if e.meta != nil {
+			counts[e.meta]++
+		}
+	}
+	commits := make([]func(), 0, len(counts))
+	for m, n := range counts {
+		commits = append(commits, m.add(batch, n))
+	}
+	return func() {
+		for _, commit := range commits {
+			commit()
+		}
+	}
+}
+
+// countKeys returns the number of cell keys under prefix, the meta namespace excluded
+// it's the authoritative count the Entries of the metadata are created and repaired from
+func countKeys(s store.KVStore, prefix []byte) (int64, error) {
+	kv, err := s.Reader()
+	if err != nil {
+		return 0, err
+	}
+	defer kv.Close()
+
+	end := make([]byte, len(prefix), len(prefix)+1)
+	copy(end, prefix)
+	end = append(end, metaNamespace)
+
+	var n int64
+	iter := kv.RangeIterator(prefix, end)
+	defer iter.Close()
+	for {
+		if _, _, ok := iter.Current(); !ok {
+			break
+		}
+		n++
+		iter.Next()
+	}
+	return n, nil
+}
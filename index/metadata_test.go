@@ -0,0 +1,200 @@
+package index
+
+import (
+	"testing"
+	"time"
+
+	"github.com/akhenakh/oureadb/index/geodata"
+	"github.com/akhenakh/oureadb/store"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/require"
+)
+
+func TestFlatIdxMetadata(t *testing.T) {
+	s := openStore(t)
+	defer cleanup(t, s)
+
+	prefix := []byte("METAFLAT")
+
+	_, err := OpenS2FlatIdx(s, prefix, s2Level)
+	require.Equal(t, ErrNoMetadata, err)
+
+	// an index created before the metadata existed
+	legacy := NewS2FlatIdx(s, prefix, s2Level)
+	require.Nil(t, legacy.Metadata())
+	gd := &geodata.GeoData{
+		Geometry: &geodata.Geometry{
+			Coordinates: quebec,
+			Type:        geodata.Geometry_POINT,
+		},
+	}
+	require.NoError(t, legacy.GeoIndex(gd, []byte("legacy")))
+
+	idx, err := OpenOrCreateS2FlatIdx(s, prefix, s2Level)
+	require.NoError(t, err)
+	md := idx.Metadata()
+	require.Equal(t, S2FlatIdxType, md.Type)
+	require.Equal(t, s2Level, md.Level)
+	require.Equal(t, layoutVersion, md.LayoutVersion)
+	require.WithinDuration(t, time.Now(), md.Created, time.Minute)
+	require.EqualValues(t, 1, md.Entries)
+
+	gd2 := &geodata.GeoData{
+		Geometry: &geodata.Geometry{
+			Coordinates: ring,
+			Type:        geodata.Geometry_POLYGON,
+		},
+	}
+	require.NoError(t, idx.GeoIndex(gd2, []byte("ring")))
+	cu, err := idx.Covering(gd2)
+	require.NoError(t, err)
+	require.EqualValues(t, 1+len(cu), idx.Metadata().Entries)
+
+	require.NoError(t, idx.GeoReindex(gd, []byte("ring")))
+	require.EqualValues(t, 2, idx.Metadata().Entries)
+
+	require.NoError(t, idx.GeoUnindex([]byte("ring")))
+	require.EqualValues(t, 1, idx.Metadata().Entries)
+
+	b := NewBulkIndexer(s, nil)
+	require.NoError(t, idx.GeoIndexBulk(b, gd2, []byte("bulk")))
+	require.NoError(t, b.Close())
+	require.EqualValues(t, 1+len(cu), idx.Metadata().Entries)
+
+	// the count is persisted
+	stored, err := ReadIndexMetadata(s, prefix)
+	require.NoError(t, err)
+	require.Equal(t, idx.Metadata().Entries, stored.Entries)
+
+	reopened, err := OpenS2FlatIdx(s, prefix, s2Level)
+	require.NoError(t, err)
+	require.Equal(t, stored.Entries, reopened.Metadata().Entries)
+
+	// mismatches
+	_, err = OpenS2FlatIdx(s, prefix, s2Level-1)
+	require.Equal(t, ErrMetadataMismatch, errors.Cause(err))
+
+	_, err = OpenOrCreateS2FlatTimeIdx(s, prefix, s2Level)
+	require.Equal(t, ErrMetadataMismatch, errors.Cause(err))
+
+	_, err = OpenOrCreateS2CoverIdx(s, prefix, 1, s2Level, 8)
+	require.Equal(t, ErrMetadataMismatch, errors.Cause(err))
+}
+
+func TestTimeAndPointIdxMetadata(t *testing.T) {
+	s := openStore(t)
+	defer cleanup(t, s)
+
+	tidx, err := OpenOrCreateS2FlatTimeIdx(s, []byte("METATIME"), s2Level)
+	require.NoError(t, err)
+
+	gd := &geodata.GeoData{
+		Geometry: &geodata.Geometry{
+			Coordinates: paris,
+			Type:        geodata.Geometry_POINT,
+		},
+	}
+	now := time.Now()
+	require.NoError(t, tidx.GeoTimeIndex(gd, now.Add(-2*time.Hour), []byte("old")))
+	require.NoError(t, tidx.GeoTimeIndex(gd, now, []byte("new")))
+	require.EqualValues(t, 2, tidx.Metadata().Entries)
+
+	n, err := tidx.PurgeBefore(now.Add(-time.Hour))
+	require.NoError(t, err)
+	require.Equal(t, 1, n)
+	require.EqualValues(t, 1, tidx.Metadata().Entries)
+
+	pidx, err := OpenOrCreateS2PointIdx(s, []byte("METAPOINT"))
+	require.NoError(t, err)
+	_, err = pidx.GeoPointIndex(gd, []byte("p"))
+	require.NoError(t, err)
+	require.EqualValues(t, 1, pidx.Metadata().Entries)
+
+	_, err = OpenS2FlatIdx(s, []byte("METAPOINT"), s2Level)
+	require.Equal(t, ErrMetadataMismatch, errors.Cause(err))
+}
+
+// failingStore is a store whose batches are never executed
+type failingStore struct {
+	store.KVStore
+}
+
+func (s failingStore) Writer() (store.KVWriter, error) {
+	w, err := s.KVStore.Writer()
+	if err != nil {
+		return nil, err
+	}
+	return failingWriter{w}, nil
+}
+
+type failingWriter struct {
+	store.KVWriter
+}
+
+func (w failingWriter) ExecuteBatch(store.KVBatch) error {
+	return errors.New("batch failed")
+}
+
+func TestMetadataFailedBatch(t *testing.T) {
+	s := openStore(t)
+	defer cleanup(t, s)
+
+	idx, err := OpenOrCreateS2FlatIdx(s, []byte("METAFAIL"), s2Level)
+	require.NoError(t, err)
+
+	gd := &geodata.GeoData{
+		Geometry: &geodata.Geometry{
+			Coordinates: ring,
+			Type:        geodata.Geometry_POLYGON,
+		},
+	}
+	require.NoError(t, idx.GeoIndex(gd, []byte("ring")))
+	entries := idx.Metadata().Entries
+
+	idx.KVStore = failingStore{s}
+	require.Error(t, idx.GeoUnindex([]byte("ring")))
+	require.Error(t, idx.GeoIndex(gd, []byte("other")))
+	require.Equal(t, entries, idx.Metadata().Entries)
+
+	b := NewBulkIndexer(idx.KVStore, nil)
+	require.NoError(t, idx.GeoIndexBulk(b, gd, []byte("bulk")))
+	require.Error(t, b.Close())
+	require.Equal(t, entries, idx.Metadata().Entries)
+}
+
+func TestRepairIndexMetadata(t *testing.T) {
+	s := openStore(t)
+	defer cleanup(t, s)
+
+	prefix := []byte("METAREPAIR")
+	_, err := RepairIndexMetadata(s, prefix)
+	require.Equal(t, ErrNoMetadata, err)
+
+	// two handles writing the same index, each rewrites the record from its own count
+	idx1, err := OpenOrCreateS2FlatIdx(s, prefix, s2Level)
+	require.NoError(t, err)
+	idx2, err := OpenS2FlatIdx(s, prefix, s2Level)
+	require.NoError(t, err)
+
+	gd := &geodata.GeoData{
+		Geometry: &geodata.Geometry{
+			Coordinates: quebec,
+			Type:        geodata.Geometry_POINT,
+		},
+	}
+	require.NoError(t, idx1.GeoIndex(gd, []byte("one")))
+	require.NoError(t, idx2.GeoIndex(gd, []byte("two")))
+
+	stored, err := ReadIndexMetadata(s, prefix)
+	require.NoError(t, err)
+	require.EqualValues(t, 1, stored.Entries)
+
+	md, err := RepairIndexMetadata(s, prefix)
+	require.NoError(t, err)
+	require.EqualValues(t, 2, md.Entries)
+	require.Equal(t, S2FlatIdxType, md.Type)
+
+	reopened, err := OpenS2FlatIdx(s, prefix, s2Level)
+	require.NoError(t, err)
+	require.EqualValues(t, 2, reopened.Metadata().Entries)
+}
@@ -0,0 +1,420 @@
+package index
+
+import (
+	"bytes"
+	"context"
+
+	"github.com/akhenakh/oureadb/index/geodata"
+	"github.com/akhenakh/oureadb/store"
+	"github.com/golang/protobuf/proto"
+	"github.com/pkg/errors"
+)
+
+const (
+	// aliasMetaType marks the alias record pointing to the active prefix of an index
+	aliasMetaType = 'a'
+
+	// sourceChunkSize is the number of GeoData read at once by StoreGeoDataSource
+	sourceChunkSize = 1000
+)
+
+// ErrNoAlias is returned when resolving an alias that was never set
+var ErrNoAlias = errors.New("no index alias found")
+
+// GeoDataSource calls fn for every geo data to index, it stops at the first error returned by fn
+type GeoDataSource func(fn func(id GeoID, gd *geodata.GeoData) error) error
+
+// StoreGeoDataSource returns a GeoDataSource reading the GeoData protobufs stored in s under dataPrefix+id
+// the data is read by chunks so no reader is kept open while fn is writing
+func StoreGeoDataSource(s store.KVStore, dataPrefix []byte) GeoDataSource {
+	return func(fn func(id GeoID, gd *geodata.GeoData) error) error {
+		start := dataPrefix
+		for {
+			type item struct {
+				id GeoID
+				gd *geodata.GeoData
+			}
+			var items []item
+			var next []byte
+
+			err := func() error {
+				kv, err := s.Reader()
+				if err != nil {
+					return err
+				}
+				defer kv.Close()
+
+				iter := kv.PrefixIterator(dataPrefix)
+				defer iter.Close()
+				iter.Seek(start)
+				for {
+					k, v, ok := iter.Current()
+					if !ok {
+						return nil
+					}
+					if len(items) == sourceChunkSize {
+						next = append([]byte(nil), k...)
+						return nil
+					}
+
+					gd := &geodata.GeoData{}
+					if err := proto.Unmarshal(v, gd); err != nil {
+						return errors.Wrapf(err, "decoding geo data %x failed", k)
+					}
+					items = append(items, item{id: append(GeoID(nil), k[len(dataPrefix):]...), gd: gd})
+					iter.Next()
+				}
+			}()
+			if err != nil {
+				return err
+			}
+
+			for _, it := range items {
+				if err := fn(it.id, it.gd); err != nil {
+					return err
+				}
+			}
+
+			if next == nil {
+				return nil
+			}
+			start = next
+		}
+	}
+}
+
+// ResolveAlias returns the prefix alias points to
+// returns ErrNoAlias if alias was never set
+func ResolveAlias(s store.KVStore, alias []byte) ([]byte, error) {
+	kv, err := s.Reader()
+	if err != nil {
+		return nil, err
+	}
+	defer kv.Close()
+
+	v, err := kv.Get(metaKey(alias, aliasMetaType, nil))
+	if err != nil {
+		return nil, errors.Wrap(err, "reading alias failed")
+	}
+	if v == nil {
+		return nil, ErrNoAlias
+	}
+	return v, nil
+}
+
+// SetAlias points alias to prefix, use it to adopt an existing index before a first rebuild
+func SetAlias(s store.KVStore, alias, prefix []byte) error {
+	kv, err := s.Writer()
+	if err != nil {
+		return err
+	}
+	defer kv.Close()
+
+	batch := kv.NewBatch()
+	defer batch.Close()
+	batch.Set(metaKey(alias, aliasMetaType, nil), prefix)
+
+	return errors.Wrap(kv.ExecuteBatch(batch), "writing alias failed")
+}
+
+// OpenS2FlatIdxAlias opens the flat index alias points to, its level is read from its metadata
+// an index without metadata, adopted with SetAlias, is opened at the level set by WithLevel
+// and returns ErrNoMetadata without it
+func OpenS2FlatIdxAlias(s store.KVStore, alias []byte, opts ...Option) (*S2FlatIdx, error) {
+	prefix, err := ResolveAlias(s, alias)
+	if err != nil {
+		return nil, err
+	}
+
+	md, err := ReadIndexMetadata(s, prefix)
+	if err == ErrNoMetadata {
+		o := newOptions(CoverParams{}, opts)
+		if o.level <= 0 {
+			return nil, err
+		}
+		return NewS2FlatIdx(s, prefix, o.level, opts...), nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return OpenS2FlatIdx(s, prefix, md.Level, opts...)
+}
+
+// RebuildOptions are the options of an index rebuild
+type RebuildOptions struct {
+	// Bulk are the options of the bulk indexer writing the new index
+	Bulk *BulkOptions
+
+	// OnError if not nil is called for every geo data that can't be indexed,
+	// otherwise the rebuild stops at the first error
+	OnError func(id GeoID, err error)
+
+	// OnSwap if not nil is called right after alias points to the new index,
+	// before the old keys are deleted, to replace the index used by the queries
+	OnSwap func(idx *S2FlatIdx)
+
+	// Options are the options of the new index
+	Options []Option
+}
+
+// RebuildS2FlatIdx builds a flat index at level under newPrefix from src,
+// then points alias to newPrefix in one write and deletes the keys of the previous index
+// queries can use the previous index until the swap, newPrefix must be empty
+// and must not share a prefix with the previous index or the alias
+// only the cell keys listed in the previous index reverse mappings and its meta records are deleted,
+// so other namespaces extending its prefix are kept, unless the previous index was written without
+// reverse mappings or metadata: then all the keys in [prefix, prefix+0xFF) are deleted
+func RebuildS2FlatIdx(ctx context.Context, s store.KVStore, alias, newPrefix []byte, level int, src GeoDataSource, opts *RebuildOptions) (*S2FlatIdx, error) {
+	if opts == nil {
+		opts = &RebuildOptions{}
+	}
+
+	oldPrefix, err := ResolveAlias(s, alias)
+	if err != nil && err != ErrNoAlias {
+		return nil, err
+	}
+
+	if err := checkRebuildPrefixes(s, alias, oldPrefix, newPrefix); err != nil {
+		return nil, err
+	}
+
+	idx, err := OpenOrCreateS2FlatIdx(s, newPrefix, level, opts.Options...)
+	if err != nil {
+		return nil, err
+	}
+
+	b := NewBulkIndexer(s, opts.Bulk)
+	err = src(func(id GeoID, gd *geodata.GeoData) error {
+		err := idx.GeoIndexBulkContext(ctx, b, gd, id)
+		if err != nil && opts.OnError != nil && ctx.Err() == nil {
+			opts.OnError(id, err)
+			return nil
+		}
+		return err
+	})
+	if err != nil {
+		err = errors.Wrap(err, "indexing source failed")
+	} else {
+		err = b.FlushContext(ctx)
+	}
+	if err == nil {
+		err = SetAlias(s, alias, newPrefix)
+	}
+	if err != nil {
+		// best effort removal of the partial index, the previous one is still active
+		_ = deletePrefix(context.Background(), s, newPrefix)
+		return nil, err
+	}
+
+	if opts.OnSwap != nil {
+		opts.OnSwap(idx)
+	}
+
+	if oldPrefix != nil {
+		if err := deleteS2FlatIdx(ctx, s, oldPrefix); err != nil {
+			return idx, errors.Wrap(err, "deleting previous index failed")
+		}
+	}
+
+	return idx, nil
+}
+
+// checkRebuildPrefixes validates newPrefix can be used to rebuild the index at oldPrefix
+func checkRebuildPrefixes(s store.KVStore, alias, oldPrefix, newPrefix []byte) error {
+	if len(newPrefix) == 0 {
+		return errors.New("empty prefix")
+	}
+
+	aliasKey := metaKey(alias, aliasMetaType, nil)
+	if bytes.HasPrefix(aliasKey, newPrefix) || (oldPrefix != nil && bytes.HasPrefix(aliasKey, oldPrefix)) {
+		return errors.New("the alias record can't be under an index prefix")
+	}
+
+	if oldPrefix != nil && (bytes.HasPrefix(oldPrefix, newPrefix) || bytes.HasPrefix(newPrefix, oldPrefix)) {
+		return errors.Errorf("prefix %q overlaps the current index prefix %q", newPrefix, oldPrefix)
+	}
+
+	kv, err := s.Reader()
+	if err != nil {
+		return err
+	}
+	defer kv.Close()
+
+	iter := kv.PrefixIterator(newPrefix)
+	defer iter.Close()
+	if _, _, ok := iter.Current(); ok {
+		return errors.Errorf("prefix %q is not empty", newPrefix)
+	}
+	return nil
+}
+
+// deleteS2FlatIdx deletes the keys of the flat index at prefix, in batches of about purgeBatchSize keys
+// the cell keys are found from the reverse mappings, keys starting with prefix but not owned by the index are kept
+// an index written before the reverse mappings and metadata existed is deleted by range, see isLegacyS2FlatIdx
+func deleteS2FlatIdx(ctx context.Context, s store.KVStore, prefix []byte) error {
+	legacy, err := isLegacyS2FlatIdx(s, prefix)
+	if err != nil {
+		return err
+	}
+	if legacy {
+		// all the cell keyspace then the meta records
+		meta := make([]byte, len(prefix), len(prefix)+1)
+		copy(meta, prefix)
+		meta = append(meta, metaNamespace)
+		if err := deleteRange(ctx, s, prefix, meta); err != nil {
+			return err
+		}
+		return deletePrefix(ctx, s, meta)
+	}
+
+	idx := &S2FlatIdx{KVStore: s, prefix: prefix}
+	reversePrefix := metaKey(prefix, reverseMetaType, nil)
+	for {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		// the reader is closed before deleting
+		keys, err := func() ([][]byte, error) {
+			kv, err := s.Reader()
+			if err != nil {
+				return nil, err
+			}
+			defer kv.Close()
+
+			var keys [][]byte
+			iter := kv.PrefixIterator(reversePrefix)
+			defer iter.Close()
+			for len(keys) < purgeBatchSize {
+				k, v, ok := iter.Current()
+				if !ok {
+					break
+				}
+				cells, err := bytesToCells(v)
+				if err != nil {
+					return nil, errors.Wrapf(err, "decoding reverse mapping %x failed", k)
+				}
+				id := GeoID(k[len(reversePrefix):])
+				for _, c := range cells {
+					keys = append(keys, idx.cellKey(c, id))
+				}
+				keys = append(keys, append([]byte(nil), k...))
+				iter.Next()
+			}
+			return keys, nil
+		}()
+		if err != nil {
+			return err
+		}
+
+		if len(keys) == 0 {
+			break
+		}
+
+		if err := deleteKeys(s, keys); err != nil {
+			return err
+		}
+	}
+
+	return deleteKeys(s, [][]byte{metaKey(prefix, metadataMetaType, nil)})
+}
+
+// isLegacyS2FlatIdx returns true if the flat index at prefix has no metadata,
+// or has entries but no reverse mappings, its cell keys can't be listed from the reverse mappings
+func isLegacyS2FlatIdx(s store.KVStore, prefix []byte) (bool, error) {
+	md, err := ReadIndexMetadata(s, prefix)
+	if err == ErrNoMetadata {
+		return true, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	if md.Entries == 0 {
+		return false, nil
+	}
+
+	kv, err := s.Reader()
+	if err != nil {
+		return false, err
+	}
+	defer kv.Close()
+
+	iter := kv.PrefixIterator(metaKey(prefix, reverseMetaType, nil))
+	defer iter.Close()
+	_, _, ok := iter.Current()
+	return !ok, nil
+}
+
+// deletePrefix deletes all the keys starting with prefix, in batches of purgeBatchSize keys
+func deletePrefix(ctx context.Context, s store.KVStore, prefix []byte) error {
+	return deleteIterated(ctx, s, func(kv store.KVReader) store.KVIterator {
+		return kv.PrefixIterator(prefix)
+	})
+}
+
+// deleteRange deletes all the keys in [start, end), in batches of purgeBatchSize keys
+func deleteRange(ctx context.Context, s store.KVStore, start, end []byte) error {
+	return deleteIterated(ctx, s, func(kv store.KVReader) store.KVIterator {
+		return kv.RangeIterator(start, end)
+	})
+}
+
+// deleteIterated deletes the keys returned by the iterators of newIter until there are none left
+func deleteIterated(ctx context.Context, s store.KVStore, newIter func(kv store.KVReader) store.KVIterator) error {
+	for {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		// the reader is closed before deleting
+		keys, err := func() ([][]byte, error) {
+			kv, err := s.Reader()
+			if err != nil {
+				return nil, err
+			}
+			defer kv.Close()
+
+			var keys [][]byte
+			iter := newIter(kv)
+			defer iter.Close()
+			for len(keys) < purgeBatchSize {
+				k, _, ok := iter.Current()
+				if !ok {
+					break
+				}
+				keys = append(keys, append([]byte(nil), k...))
+				iter.Next()
+			}
+			return keys, nil
+		}()
+		if err != nil {
+			return err
+		}
+
+		if len(keys) == 0 {
+			return nil
+		}
+
+		if err := deleteKeys(s, keys); err != nil {
+			return err
+		}
+	}
+}
+
+// deleteKeys deletes keys in one batch
+func deleteKeys(s store.KVStore, keys [][]byte) error {
+	kv, err := s.Writer()
+	if err != nil {
+		return err
+	}
+	defer kv.Close()
+
+	batch := kv.NewBatch()
+	defer batch.Close()
+	for _, k := range keys {
+		batch.Delete(k)
+	}
+
+	return errors.Wrap(kv.ExecuteBatch(batch), "deleting keys failed")
+}
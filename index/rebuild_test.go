@@ -0,0 +1,213 @@
+package index
+
+import (
+	"context"
+	"fmt"
+	"testing"
+
+	"github.com/akhenakh/oureadb/index/geodata"
+	"github.com/golang/geo/s2"
+	"github.com/golang/protobuf/proto"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRebuildS2FlatIdx(t *testing.T) {
+	s := openStore(t)
+	defer cleanup(t, s)
+
+	dataPrefix := []byte("DATA")
+	alias := []byte("IDX")
+
+	// the geo data stored in protobuf, some of them indexed at level 13
+	old, err := OpenOrCreateS2FlatIdx(s, []byte("IDX13"), 13)
+	require.NoError(t, err)
+	require.NoError(t, SetAlias(s, alias, []byte("IDX13")))
+
+	kv, err := s.Writer()
+	require.NoError(t, err)
+	batch := kv.NewBatch()
+	for i := 0; i < 20; i++ {
+		gd := &geodata.GeoData{
+			Geometry: &geodata.Geometry{
+				Type:        geodata.Geometry_POINT,
+				Coordinates: []float64{quebec[0] + float64(i)*0.001, quebec[1]},
+			},
+		}
+		id := []byte(fmt.Sprintf("%02d", i))
+		require.NoError(t, old.GeoIndex(gd, id))
+		v, err := proto.Marshal(gd)
+		require.NoError(t, err)
+		batch.Set(append(append([]byte(nil), dataPrefix...), id...), v)
+	}
+	// an invalid entry
+	batch.Set([]byte("DATAbroken"), []byte("not a protobuf"))
+	require.NoError(t, kv.ExecuteBatch(batch))
+
+	src := StoreGeoDataSource(s, dataPrefix)
+
+	// invalid protobuf stops the rebuild
+	_, err = RebuildS2FlatIdx(context.Background(), s, alias, []byte("IDX16"), 16, src, nil)
+	require.Error(t, err)
+
+	// the partial rebuild was removed
+	_, err = ReadIndexMetadata(s, []byte("IDX16"))
+	require.Equal(t, ErrNoMetadata, err)
+	prefix, err := ResolveAlias(s, alias)
+	require.NoError(t, err)
+	require.Equal(t, []byte("IDX13"), prefix)
+
+	// OnError only skips the indexing errors, not the source ones
+	var failed []GeoID
+	_, err = RebuildS2FlatIdx(context.Background(), s, alias, []byte("IDX16"), 16, src, &RebuildOptions{
+		OnError: func(id GeoID, err error) {
+			failed = append(failed, id)
+		},
+	})
+	require.Error(t, err)
+	require.Empty(t, failed)
+
+	// overlapping prefixes
+	_, err = RebuildS2FlatIdx(context.Background(), s, alias, []byte("IDX1"), 16, src, nil)
+	require.Error(t, err)
+
+	kv, err = s.Writer()
+	require.NoError(t, err)
+	batch = kv.NewBatch()
+	batch.Delete([]byte("DATAbroken"))
+	require.NoError(t, kv.ExecuteBatch(batch))
+
+	var swapped bool
+	idx, err := RebuildS2FlatIdx(context.Background(), s, alias, []byte("NEW16"), 16, src, &RebuildOptions{
+		Bulk: &BulkOptions{MaxBatchCount: 7},
+		OnSwap: func(idx *S2FlatIdx) {
+			swapped = true
+
+			// the previous index is still there
+			res, err := old.GeoIdsRadiusQuery(quebec[1], quebec[0], 5000)
+			require.NoError(t, err)
+			require.Len(t, res, 20)
+		},
+	})
+	require.NoError(t, err)
+	require.True(t, swapped)
+	require.EqualValues(t, 20, idx.Metadata().Entries)
+
+	res, err := idx.GeoIdsRadiusQuery(quebec[1], quebec[0], 5000)
+	require.NoError(t, err)
+	require.Len(t, res, 20)
+
+	// the previous index was deleted
+	res, err = old.GeoIdsRadiusQuery(quebec[1], quebec[0], 5000)
+	require.NoError(t, err)
+	require.Len(t, res, 0)
+	_, err = ReadIndexMetadata(s, []byte("IDX13"))
+	require.Equal(t, ErrNoMetadata, err)
+
+	prefix, err = ResolveAlias(s, alias)
+	require.NoError(t, err)
+	require.Equal(t, []byte("NEW16"), prefix)
+
+	reopened, err := OpenS2FlatIdxAlias(s, alias)
+	require.NoError(t, err)
+	require.Equal(t, 16, reopened.Metadata().Level)
+
+	_, err = ResolveAlias(s, []byte("UNKNOWN"))
+	require.Equal(t, ErrNoAlias, err)
+}
+
+func TestRebuildKeepsExtendingPrefixes(t *testing.T) {
+	s := openStore(t)
+	defer cleanup(t, s)
+
+	gd := &geodata.GeoData{
+		Geometry: &geodata.Geometry{
+			Type:        geodata.Geometry_POINT,
+			Coordinates: quebec,
+		},
+	}
+
+	// AB extends the prefix of the rebuilt index A
+	a, err := OpenOrCreateS2FlatIdx(s, []byte("A"), s2Level)
+	require.NoError(t, err)
+	require.NoError(t, a.GeoIndex(gd, []byte("a")))
+	require.NoError(t, SetAlias(s, []byte("IDX"), []byte("A")))
+
+	ab, err := OpenOrCreateS2FlatIdx(s, []byte("AB"), s2Level)
+	require.NoError(t, err)
+	require.NoError(t, ab.GeoIndex(gd, []byte("ab")))
+
+	src := func(fn func(id GeoID, gd *geodata.GeoData) error) error {
+		return fn([]byte("new"), gd)
+	}
+	idx, err := RebuildS2FlatIdx(context.Background(), s, []byte("IDX"), []byte("NEW"), s2Level, src, nil)
+	require.NoError(t, err)
+
+	res, err := idx.GeoIdsRadiusQuery(quebec[1], quebec[0], 1000)
+	require.NoError(t, err)
+	require.Equal(t, []GeoID{GeoID("new")}, res)
+
+	res, err = a.GeoIdsRadiusQuery(quebec[1], quebec[0], 1000)
+	require.NoError(t, err)
+	require.Empty(t, res)
+	_, err = ReadIndexMetadata(s, []byte("A"))
+	require.Equal(t, ErrNoMetadata, err)
+
+	// AB is untouched
+	res, err = ab.GeoIdsRadiusQuery(quebec[1], quebec[0], 1000)
+	require.NoError(t, err)
+	require.Equal(t, []GeoID{GeoID("ab")}, res)
+	reopened, err := OpenS2FlatIdx(s, []byte("AB"), s2Level)
+	require.NoError(t, err)
+	require.EqualValues(t, 1, reopened.Metadata().Entries)
+}
+
+func TestRebuildLegacyS2FlatIdx(t *testing.T) {
+	s := openStore(t)
+	defer cleanup(t, s)
+
+	// cell keys written before the reverse mappings and the metadata existed
+	prefix := []byte("LEGACY")
+	kv, err := s.Writer()
+	require.NoError(t, err)
+	batch := kv.NewBatch()
+	for i := 0; i < 10; i++ {
+		c := s2.CellIDFromLatLng(s2.LatLngFromDegrees(quebec[1], quebec[0]+float64(i)*0.001)).Parent(s2Level)
+		k := append(append([]byte(nil), prefix...), itob(uint64(c))...)
+		batch.Set(append(k, fmt.Sprintf("%02d", i)...), nil)
+	}
+	require.NoError(t, kv.ExecuteBatch(batch))
+	require.NoError(t, SetAlias(s, []byte("IDX"), prefix))
+
+	// the level must be given without metadata
+	_, err = OpenS2FlatIdxAlias(s, []byte("IDX"))
+	require.Equal(t, ErrNoMetadata, err)
+	legacy, err := OpenS2FlatIdxAlias(s, []byte("IDX"), WithLevel(s2Level))
+	require.NoError(t, err)
+	res, err := legacy.GeoIdsRadiusQuery(quebec[1], quebec[0], 5000)
+	require.NoError(t, err)
+	require.Len(t, res, 10)
+
+	gd := &geodata.GeoData{
+		Geometry: &geodata.Geometry{
+			Type:        geodata.Geometry_POINT,
+			Coordinates: quebec,
+		},
+	}
+	src := func(fn func(id GeoID, gd *geodata.GeoData) error) error {
+		return fn([]byte("new"), gd)
+	}
+	_, err = RebuildS2FlatIdx(context.Background(), s, []byte("IDX"), []byte("NEW"), s2Level, src, nil)
+	require.NoError(t, err)
+
+	// no key is left under the previous prefix
+	n, err := countKeys(s, prefix)
+	require.NoError(t, err)
+	require.Zero(t, n)
+	r, err := s.Reader()
+	require.NoError(t, err)
+	defer r.Close()
+	iter := r.PrefixIterator(prefix)
+	defer iter.Close()
+	_, _, ok := iter.Current()
+	require.False(t, ok)
+}
@@ -0,0 +1,610 @@
+package index
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"math"
+
+	"github.com/akhenakh/oureadb/index/geodata"
+	"github.com/akhenakh/oureadb/store"
+	"github.com/golang/geo/s2"
+	spb "github.com/golang/protobuf/ptypes/struct"
+	"github.com/pkg/errors"
+)
+
+// encoded attribute value types, the tag is the first byte of the encoded value
+const (
+	attrBool   = 'b'
+	attrNumber = 'n'
+	attrString = 's'
+)
+
+// ErrNoAttribute is returned when indexing a GeoData without the indexed property
+// or with a property value that is not a string, a number or a bool
+var ErrNoAttribute = errors.New("geo data has no indexable attribute")
+
+// S2AttrIdx a flat S2 region cover index partitioned by the value of a property
+// for queries like "restaurants within 2km" where the category is a GeoData property
+type S2AttrIdx struct {
+	// s2 level to index
+	level int
+
+	// prefix for the keys
+	prefix []byte
+
+	// name of the indexed GeoData property
+	property string
+
+	// number of goroutines used by multi cells lookups
+	workers int
+
+	// parameters used to cover the queried regions
+	cover CoverParams
+
+	// persisted metadata, nil if not opened with OpenS2AttrIdx or OpenOrCreateS2AttrIdx
+	meta *metadata
+
+	store.KVStore
+}
+
+// NewS2AttrIdx returns a new indexer of the property values of the geo data
+// keys are prefix+value+cellid+id so every value is a flat index at level
+// string, number and bool values are indexed, numbers are compared as float64
+// the index metadata is not read nor written, see OpenOrCreateS2AttrIdx
+func NewS2AttrIdx(s store.KVStore, prefix []byte, property string, level int, opts ...Option) *S2AttrIdx {
+	o := newOptions(CoverParams{MinLevel: level, MaxLevel: level}, opts)
+	return &S2AttrIdx{
+		KVStore:  s,
+		prefix:   prefix,
+		property: property,
+		level:    level,
+		workers:  o.workers,
+		cover:    o.cover,
+	}
+}
+
+// OpenS2AttrIdx returns an indexer after validating the metadata stored under prefix
+// returns ErrNoMetadata if the index was not created
+// or ErrMetadataMismatch if it was built with another property or level
+func OpenS2AttrIdx(s store.KVStore, prefix []byte, property string, level int, opts ...Option) (*S2AttrIdx, error) {
+	return openS2AttrIdx(s, prefix, property, level, false, opts)
+}
+
+// OpenOrCreateS2AttrIdx is OpenS2AttrIdx creating the metadata if missing
+func OpenOrCreateS2AttrIdx(s store.KVStore, prefix []byte, property string, level int, opts ...Option) (*S2AttrIdx, error) {
+	return openS2AttrIdx(s, prefix, property, level, true, opts)
+}
+
+func openS2AttrIdx(s store.KVStore, prefix []byte, property string, level int, create bool, opts []Option) (*S2AttrIdx, error) {
+	md := IndexMetadata{Type: S2AttrIdxType, Level: level, Property: property}
+	m, err := openMetadata(s, prefix, md, create)
+	if err != nil {
+		return nil, err
+	}
+	idx := NewS2AttrIdx(s, prefix, property, level, opts...)
+	idx.meta = m
+	return idx, nil
+}
+
+// Metadata returns the persisted metadata, nil if the index was not opened with OpenS2AttrIdx or OpenOrCreateS2AttrIdx
+func (idx *S2AttrIdx) Metadata() *IndexMetadata {
+	return idx.meta.get()
+}
+
+// WithCover returns a copy of the index covering the queried regions using p,
+// to override the index cover parameters for some queries
+func (idx *S2AttrIdx) WithCover(p CoverParams) *S2AttrIdx {
+	c := *idx
+	c.cover = p
+	return &c
+}
+
+// SetScanWorkers sets the number of goroutines scanning the cells of the queries
+// see S2FlatIdx.SetScanWorkers
+func (idx *S2AttrIdx) SetScanWorkers(n int) {
+	idx.workers = n
+}
+
+// GeoIndex is geo indexing the geo data under the value of its property
+// returns ErrNoAttribute if the property is missing or can't be indexed
+// an id -> value+cells reverse mapping is also stored, an already indexed id is reindexed, see GeoReindex
+// the writes of an id are serialized within the process, not between processes sharing the store
+func (idx *S2AttrIdx) GeoIndex(gd *geodata.GeoData, id GeoID) error {
+	return idx.GeoIndexContext(context.Background(), gd, id)
+}
+
+// GeoIndexContext is GeoIndex with a context
+func (idx *S2AttrIdx) GeoIndexContext(ctx context.Context, gd *geodata.GeoData, id GeoID) error {
+	defer lockID(idx.prefix, id)()
+
+	av, _, err := idx.indexedCells(id)
+	if err != nil {
+		return err
+	}
+	if av != nil {
+		return idx.geoReindex(ctx, gd, id)
+	}
+
+	entries, err := idx.indexEntries(gd, id)
+	if err != nil {
+		return err
+	}
+
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	kv, err := idx.KVStore.Writer()
+	if err != nil {
+		return err
+	}
+
+	batch := kv.NewBatch()
+	defer batch.Close()
+
+	for _, e := range entries {
+		batch.Set(e.k, e.v)
+	}
+	commit := addEntries(batch, entries)
+
+	if err := kv.ExecuteBatch(batch); err != nil {
+		return err
+	}
+	commit()
+	return nil
+}
+
+// indexEntries returns the keys and values written to index gd
+func (idx *S2AttrIdx) indexEntries(gd *geodata.GeoData, id GeoID) ([]bulkEntry, error) {
+	av, err := idx.attrValue(gd)
+	if err != nil {
+		return nil, err
+	}
+
+	cu, err := idx.Covering(gd)
+	if err != nil {
+		return nil, errors.Wrap(err, "generating cover failed")
+	}
+
+	if len(cu) == 0 {
+		return nil, errors.New("geo object can't be indexed, empty cover")
+	}
+
+	entries := make([]bulkEntry, 0, len(cu)+1)
+
+	// For each cell we store
+	// a key prefix+value+cellid+id
+	for _, c := range cu {
+		entries = append(entries, bulkEntry{k: idx.cellKey(av, c, id), meta: idx.meta})
+	}
+
+	// the reverse mapping prefix+meta+id -> value+cells
+	entries = append(entries, bulkEntry{k: idx.reverseKey(id), v: append(av, cellsToBytes(cu)...)})
+
+	return entries, nil
+}
+
+// GeoUnindex removes all the cells previously indexed for id
+// returns ErrGeoIDNotFound if id is not indexed
+func (idx *S2AttrIdx) GeoUnindex(id GeoID) error {
+	return idx.GeoUnindexContext(context.Background(), id)
+}
+
+// GeoUnindexContext is GeoUnindex with a context
+func (idx *S2AttrIdx) GeoUnindexContext(ctx context.Context, id GeoID) error {
+	defer lockID(idx.prefix, id)()
+
+	av, cells, err := idx.indexedCells(id)
+	if err != nil {
+		return err
+	}
+
+	if av == nil {
+		return ErrGeoIDNotFound
+	}
+
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	kv, err := idx.KVStore.Writer()
+	if err != nil {
+		return err
+	}
+
+	batch := kv.NewBatch()
+	defer batch.Close()
+
+	for _, c := range cells {
+		batch.Delete(idx.cellKey(av, c, id))
+	}
+	batch.Delete(idx.reverseKey(id))
+	commit := idx.meta.add(batch, -len(cells))
+
+	if err := kv.ExecuteBatch(batch); err != nil {
+		return err
+	}
+	commit()
+	return nil
+}
+
+// GeoReindex replaces the value and cells previously indexed for id by the ones of gd
+// old and new keys are written in the same batch
+// if id was not indexed it behaves like GeoIndex
+func (idx *S2AttrIdx) GeoReindex(gd *geodata.GeoData, id GeoID) error {
+	return idx.GeoReindexContext(context.Background(), gd, id)
+}
+
+// GeoReindexContext is GeoReindex with a context
+func (idx *S2AttrIdx) GeoReindexContext(ctx context.Context, gd *geodata.GeoData, id GeoID) error {
+	defer lockID(idx.prefix, id)()
+
+	return idx.geoReindex(ctx, gd, id)
+}
+
+// geoReindex is GeoReindexContext with the id already locked
+func (idx *S2AttrIdx) geoReindex(ctx context.Context, gd *geodata.GeoData, id GeoID) error {
+	entries, err := idx.indexEntries(gd, id)
+	if err != nil {
+		return err
+	}
+
+	oldAv, oldCells, err := idx.indexedCells(id)
+	if err != nil {
+		return err
+	}
+
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	kv, err := idx.KVStore.Writer()
+	if err != nil {
+		return err
+	}
+
+	batch := kv.NewBatch()
+	defer batch.Close()
+
+	m := make(map[string]struct{}, len(entries))
+	for _, e := range entries {
+		m[string(e.k)] = struct{}{}
+	}
+
+	// only remove the keys not present in the new entries
+	for _, c := range oldCells {
+		k := idx.cellKey(oldAv, c, id)
+		if _, ok := m[string(k)]; ok {
+			continue
+		}
+		batch.Delete(k)
+	}
+
+	for _, e := range entries {
+		batch.Set(e.k, e.v)
+	}
+	commit := idx.meta.add(batch, len(entries)-1-len(oldCells))
+
+	if err := kv.ExecuteBatch(batch); err != nil {
+		return err
+	}
+	commit()
+	return nil
+}
+
+// indexedCells returns the encoded value and the cells stored for id in the reverse mapping
+// returns a nil value if id is not indexed
+func (idx *S2AttrIdx) indexedCells(id GeoID) ([]byte, []s2.CellID, error) {
+	kv, err := idx.Reader()
+	if err != nil {
+		return nil, nil, err
+	}
+	defer kv.Close()
+
+	v, err := kv.Get(idx.reverseKey(id))
+	if err != nil {
+		return nil, nil, errors.Wrap(err, "reading reverse mapping failed")
+	}
+	if v == nil {
+		return nil, nil, nil
+	}
+
+	n, err := attrValueLen(v)
+	if err != nil {
+		return nil, nil, errors.Wrap(err, "decoding reverse mapping failed")
+	}
+
+	cells, err := bytesToCells(v[n:])
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return append([]byte(nil), v[:n]...), cells, nil
+}
+
+// AttributeValue returns the property value indexed for id as a string, a float64 or a bool
+// returns ErrGeoIDNotFound if id is not indexed
+func (idx *S2AttrIdx) AttributeValue(id GeoID) (interface{}, error) {
+	av, _, err := idx.indexedCells(id)
+	if err != nil {
+		return nil, err
+	}
+	if av == nil {
+		return nil, ErrGeoIDNotFound
+	}
+	return decodeAttrValue(av)
+}
+
+// GeoIdsAtCells returns the GeoData keys contained in the cells whose property is one of values, without duplicates
+func (idx *S2AttrIdx) GeoIdsAtCells(cells []s2.CellID, values ...interface{}) ([]GeoID, error) {
+	return idx.GeoIdsAtCellsContext(context.Background(), cells, values...)
+}
+
+// GeoIdsAtCellsContext is GeoIdsAtCells with a context
+func (idx *S2AttrIdx) GeoIdsAtCellsContext(ctx context.Context, cells []s2.CellID, values ...interface{}) ([]GeoID, error) {
+	for _, c := range cells {
+		if c.Level() != idx.level {
+			return nil, errors.New("requested a cellID with a different level than the index")
+		}
+	}
+
+	ranges, err := idx.cellsRanges(cells, values)
+	if err != nil {
+		return nil, err
+	}
+
+	return idx.collectRanges(ctx, ranges)
+}
+
+// GeoIdsRadiusQuery returns the GeoID found in the index inside radius whose property is one of values
+// note you should check the returned GeoData is really inside/intersects the cap
+func (idx *S2AttrIdx) GeoIdsRadiusQuery(lat, lng, radius float64, values ...interface{}) ([]GeoID, error) {
+	return idx.GeoIdsRadiusQueryContext(context.Background(), lat, lng, radius, values...)
+}
+
+// GeoIdsRadiusQueryContext is GeoIdsRadiusQuery with a context
+func (idx *S2AttrIdx) GeoIdsRadiusQueryContext(ctx context.Context, lat, lng, radius float64, values ...interface{}) ([]GeoID, error) {
+	center := s2.PointFromLatLng(s2.LatLngFromDegrees(lat, lng))
+	cap := s2.CapFromCenterArea(center, s2RadialAreaMeters(radius))
+	return idx.GeoIdsRegionQueryContext(ctx, cap, values...)
+}
+
+// GeoIdsRegionQuery returns the GeoID found in the index intersecting the cover of region
+// whose property is one of values
+// note you should check the returned GeoData is really inside/intersects the region
+func (idx *S2AttrIdx) GeoIdsRegionQuery(region s2.Region, values ...interface{}) ([]GeoID, error) {
+	return idx.GeoIdsRegionQueryContext(context.Background(), region, values...)
+}
+
+// GeoIdsRegionQueryContext is GeoIdsRegionQuery with a context
+func (idx *S2AttrIdx) GeoIdsRegionQueryContext(ctx context.Context, region s2.Region, values ...interface{}) ([]GeoID, error) {
+	cu := idx.cover.atMostLevel(idx.level).covering(region)
+	ranges, err := idx.cellsRanges(cu, values)
+	if err != nil {
+		return nil, err
+	}
+
+	return idx.collectRanges(ctx, ranges)
+}
+
+// Covering is generating the cover of a GeoData
+func (idx *S2AttrIdx) Covering(gd *geodata.GeoData) (s2.CellUnion, error) {
+	coverer := &s2.RegionCoverer{MinLevel: idx.level, MaxLevel: idx.level}
+	return gd.Cover(coverer)
+}
+
+// attrValue returns the encoded value of the indexed property of gd
+func (idx *S2AttrIdx) attrValue(gd *geodata.GeoData) ([]byte, error) {
+	v, ok := gd.Properties[idx.property]
+	if !ok {
+		return nil, errors.Wrapf(ErrNoAttribute, "missing property %s", idx.property)
+	}
+
+	av, err := encodeAttrValue(v)
+	if err != nil {
+		return nil, errors.Wrapf(ErrNoAttribute, "property %s: %v", idx.property, err)
+	}
+	return av, nil
+}
+
+// cellsRanges returns the key ranges of the cells for every value, cells level being lower or equal to the index level
+func (idx *S2AttrIdx) cellsRanges(cells []s2.CellID, values []interface{}) ([]keyRange, error) {
+	if len(values) == 0 {
+		return nil, errors.New("no attribute value queried")
+	}
+
+	ranges := make([]keyRange, 0, len(cells)*len(values))
+	for _, v := range values {
+		av, err := encodeAttrValue(v)
+		if err != nil {
+			return nil, err
+		}
+
+		vp := make([]byte, len(idx.prefix), len(idx.prefix)+len(av))
+		copy(vp, idx.prefix)
+		vp = append(vp, av...)
+
+		for _, c := range cells {
+			ranges = append(ranges, levelKeyRange(vp, c, idx.level))
+		}
+	}
+	return ranges, nil
+}
+
+// collectRanges returns the ids found in ranges, without duplicates
+func (idx *S2AttrIdx) collectRanges(ctx context.Context, ranges []keyRange) ([]GeoID, error) {
+	return collectRanges(ctx, idx.KVStore, idx.prefix, ranges, idx.workers, idx.decodeID)
+}
+
+// decodeID is the keyDecoder of the index keys
+func (idx *S2AttrIdx) decodeID(k, _ []byte) (GeoID, bool, error) {
+	_, _, id, err := idx.keyToValues(k)
+	return id, err == nil, err
+}
+
+func (idx *S2AttrIdx) keyToValues(k []byte) (av []byte, c s2.CellID, id GeoID, err error) {
+	// prefix+value+cellid+id
+	if len(k) <= len(idx.prefix) {
+		return av, c, id, errors.New("invalid key")
+	}
+	n, err := attrValueLen(k[len(idx.prefix):])
+	if err != nil {
+		return av, c, id, err
+	}
+
+	pos := len(idx.prefix) + n
+	if len(k) <= pos+8 {
+		return av, c, id, errors.New("invalid key")
+	}
+	av = k[len(idx.prefix):pos]
+	c = s2.CellID(binary.BigEndian.Uint64(k[pos:]))
+	id = k[pos+8:]
+	return
+}
+
+// cellKey returns the key prefix+value+cellid+id
+func (idx *S2AttrIdx) cellKey(av []byte, c s2.CellID, id GeoID) []byte {
+	k := make([]byte, len(idx.prefix), len(idx.prefix)+len(av)+8+len(id))
+	copy(k, idx.prefix)
+	k = append(k, av...)
+	k = append(k, itob(uint64(c))...)
+	k = append(k, []byte(id)...)
+	return k
+}
+
+// reverseKey returns the key of the id -> value+cells reverse mapping
+func (idx *S2AttrIdx) reverseKey(id GeoID) []byte {
+	return metaKey(idx.prefix, reverseMetaType, id)
+}
+
+// encodeAttrValue encodes v as a tag followed by an order preserving encoding of the value
+// v can be a string, a bool, a Go number or a protobuf string, number or bool Value
+// strings have their 0x00 bytes escaped as 0x00 0xFF and are terminated by 0x00 0x01
+// numbers are encoded as sortable big endian float64
+func encodeAttrValue(v interface{}) ([]byte, error) {
+	switch v := v.(type) {
+	case *spb.Value:
+		switch k := v.GetKind().(type) {
+		case *spb.Value_StringValue:
+			return encodeAttrValue(k.StringValue)
+		case *spb.Value_NumberValue:
+			return encodeAttrValue(k.NumberValue)
+		case *spb.Value_BoolValue:
+			return encodeAttrValue(k.BoolValue)
+		default:
+			return nil, errors.Errorf("unsupported attribute value kind %T", k)
+		}
+	case string:
+		b := make([]byte, 0, len(v)+3)
+		b = append(b, attrString)
+		for i := 0; i < len(v); i++ {
+			b = append(b, v[i])
+			if v[i] == 0x00 {
+				b = append(b, 0xFF)
+			}
+		}
+		return append(b, 0x00, 0x01), nil
+	case bool:
+		if v {
+			return []byte{attrBool, 1}, nil
+		}
+		return []byte{attrBool, 0}, nil
+	case float64:
+		if math.IsNaN(v) {
+			return nil, errors.New("NaN attribute value")
+		}
+		// -0 and 0 are the same value
+		if v == 0 {
+			v = 0
+		}
+		bits := math.Float64bits(v)
+		if v >= 0 {
+			bits ^= 1 << 63
+		} else {
+			bits = ^bits
+		}
+		return append([]byte{attrNumber}, itob(bits)...), nil
+	case float32:
+		return encodeAttrValue(float64(v))
+	case int:
+		return encodeAttrValue(float64(v))
+	case int8:
+		return encodeAttrValue(float64(v))
+	case int16:
+		return encodeAttrValue(float64(v))
+	case int32:
+		return encodeAttrValue(float64(v))
+	case int64:
+		return encodeAttrValue(float64(v))
+	case uint:
+		return encodeAttrValue(float64(v))
+	case uint8:
+		return encodeAttrValue(float64(v))
+	case uint16:
+		return encodeAttrValue(float64(v))
+	case uint32:
+		return encodeAttrValue(float64(v))
+	case uint64:
+		return encodeAttrValue(float64(v))
+	default:
+		return nil, errors.Errorf("unsupported attribute value type %T", v)
+	}
+}
+
+// attrValueLen returns the length of the encoded value at the start of b
+func attrValueLen(b []byte) (int, error) {
+	if len(b) == 0 {
+		return 0, errors.New("empty attribute value")
+	}
+
+	switch b[0] {
+	case attrBool:
+		if len(b) < 2 {
+			return 0, errors.New("truncated bool attribute value")
+		}
+		return 2, nil
+	case attrNumber:
+		if len(b) < 9 {
+			return 0, errors.New("truncated number attribute value")
+		}
+		return 9, nil
+	case attrString:
+		for i := 1; i < len(b)-1; i++ {
+			if b[i] != 0x00 {
+				continue
+			}
+			if b[i+1] == 0x01 {
+				return i + 2, nil
+			}
+			// escaped 0x00
+			i++
+		}
+		return 0, errors.New("unterminated string attribute value")
+	default:
+		return 0, errors.Errorf("invalid attribute value tag %x", b[0])
+	}
+}
+
+// decodeAttrValue returns the value encoded by encodeAttrValue as a string, a float64 or a bool
+func decodeAttrValue(b []byte) (interface{}, error) {
+	n, err := attrValueLen(b)
+	if err != nil {
+		return nil, err
+	}
+
+	switch b[0] {
+	case attrBool:
+		return b[1] == 1, nil
+	case attrNumber:
+		bits := binary.BigEndian.Uint64(b[1:9])
+		if bits&(1<<63) != 0 {
+			bits ^= 1 << 63
+		} else {
+			bits = ^bits
+		}
+		return math.Float64frombits(bits), nil
+	default:
+		return string(bytes.Replace(b[1:n-2], []byte{0x00, 0xFF}, []byte{0x00}, -1)), nil
+	}
+}
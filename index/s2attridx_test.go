@@ -0,0 +1,165 @@
+package index
+
+import (
+	"bytes"
+	"math"
+	"sort"
+	"testing"
+
+	"github.com/akhenakh/oureadb/index/geodata"
+	spb "github.com/golang/protobuf/ptypes/struct"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/require"
+)
+
+func attrPoint(lng, lat float64, props map[string]*spb.Value) *geodata.GeoData {
+	return &geodata.GeoData{
+		Geometry: &geodata.Geometry{
+			Type:        geodata.Geometry_POINT,
+			Coordinates: []float64{lng, lat},
+		},
+		Properties: props,
+	}
+}
+
+func stringValue(s string) *spb.Value {
+	return &spb.Value{Kind: &spb.Value_StringValue{StringValue: s}}
+}
+
+func TestS2AttrIdx(t *testing.T) {
+	s := openStore(t)
+	defer cleanup(t, s)
+
+	idx, err := OpenOrCreateS2AttrIdx(s, []byte("ATTR"), "category", s2Level)
+	require.NoError(t, err)
+
+	category := func(c string) map[string]*spb.Value {
+		return map[string]*spb.Value{"category": stringValue(c)}
+	}
+
+	require.NoError(t, idx.GeoIndex(attrPoint(quebec[0], quebec[1], category("restaurant")), []byte("resto")))
+	require.NoError(t, idx.GeoIndex(attrPoint(quebec[0]+0.001, quebec[1], category("bar")), []byte("bar")))
+	require.NoError(t, idx.GeoIndex(attrPoint(quebec[0]+0.002, quebec[1], category("restaurants")), []byte("restos")))
+	// far away
+	require.NoError(t, idx.GeoIndex(attrPoint(paris[0], paris[1], category("restaurant")), []byte("paris")))
+
+	err = idx.GeoIndex(attrPoint(quebec[0], quebec[1], nil), []byte("none"))
+	require.Equal(t, ErrNoAttribute, errors.Cause(err))
+
+	res, err := idx.GeoIdsRadiusQuery(quebec[1], quebec[0], 2000, "restaurant")
+	require.NoError(t, err)
+	require.Equal(t, []GeoID{GeoID("resto")}, res)
+
+	res, err = idx.GeoIdsRadiusQuery(quebec[1], quebec[0], 2000, "restaurant", "bar")
+	require.NoError(t, err)
+	sort.Slice(res, func(i, j int) bool { return bytes.Compare(res[i], res[j]) < 0 })
+	require.Equal(t, []GeoID{GeoID("bar"), GeoID("resto")}, res)
+
+	res, err = idx.GeoIdsRadiusQuery(quebec[1], quebec[0], 2000, "cafe")
+	require.NoError(t, err)
+	require.Empty(t, res)
+
+	_, err = idx.GeoIdsRadiusQuery(quebec[1], quebec[0], 2000)
+	require.Error(t, err)
+
+	// the value changes
+	require.NoError(t, idx.GeoReindex(attrPoint(quebec[0], quebec[1], category("cafe")), []byte("resto")))
+	res, err = idx.GeoIdsRadiusQuery(quebec[1], quebec[0], 2000, "restaurant")
+	require.NoError(t, err)
+	require.Empty(t, res)
+	res, err = idx.GeoIdsRadiusQuery(quebec[1], quebec[0], 2000, "cafe")
+	require.NoError(t, err)
+	require.Equal(t, []GeoID{GeoID("resto")}, res)
+
+	v, err := idx.AttributeValue([]byte("resto"))
+	require.NoError(t, err)
+	require.Equal(t, "cafe", v)
+
+	require.NoError(t, idx.GeoUnindex([]byte("resto")))
+	res, err = idx.GeoIdsRadiusQuery(quebec[1], quebec[0], 2000, "cafe")
+	require.NoError(t, err)
+	require.Empty(t, res)
+	require.Equal(t, ErrGeoIDNotFound, idx.GeoUnindex([]byte("resto")))
+
+	// indexing twice replaces the previous value
+	require.NoError(t, idx.GeoIndex(attrPoint(quebec[0], quebec[1], category("cafe")), []byte("twice")))
+	require.NoError(t, idx.GeoIndex(attrPoint(quebec[0], quebec[1], category("pub")), []byte("twice")))
+	require.NoError(t, idx.GeoUnindex([]byte("twice")))
+	res, err = idx.GeoIdsRadiusQuery(quebec[1], quebec[0], 2000, "cafe", "pub")
+	require.NoError(t, err)
+	require.Empty(t, res)
+
+	require.EqualValues(t, 3, idx.Metadata().Entries)
+
+	_, err = OpenS2AttrIdx(s, []byte("ATTR"), "kind", s2Level)
+	require.Equal(t, ErrMetadataMismatch, errors.Cause(err))
+}
+
+func TestS2AttrIdxNumberBool(t *testing.T) {
+	s := openStore(t)
+	defer cleanup(t, s)
+
+	idx := NewS2AttrIdx(s, []byte("ATTRN"), "v", s2Level)
+
+	values := []*spb.Value{
+		{Kind: &spb.Value_NumberValue{NumberValue: 3}},
+		{Kind: &spb.Value_NumberValue{NumberValue: -2.5}},
+		{Kind: &spb.Value_BoolValue{BoolValue: true}},
+	}
+	for i, v := range values {
+		gd := attrPoint(quebec[0], quebec[1], map[string]*spb.Value{"v": v})
+		require.NoError(t, idx.GeoIndex(gd, []byte{byte('a' + i)}))
+	}
+
+	// Go numbers match the float64 stored
+	res, err := idx.GeoIdsRadiusQuery(quebec[1], quebec[0], 1000, 3)
+	require.NoError(t, err)
+	require.Equal(t, []GeoID{GeoID("a")}, res)
+
+	res, err = idx.GeoIdsRadiusQuery(quebec[1], quebec[0], 1000, float32(-2.5), true)
+	require.NoError(t, err)
+	require.Len(t, res, 2)
+
+	res, err = idx.GeoIdsRadiusQuery(quebec[1], quebec[0], 1000, false)
+	require.NoError(t, err)
+	require.Empty(t, res)
+
+	_, err = idx.GeoIdsRadiusQuery(quebec[1], quebec[0], 1000, []string{"a"})
+	require.Error(t, err)
+}
+
+func TestAttrValueEncoding(t *testing.T) {
+	values := []interface{}{
+		false, true,
+		math.Inf(-1), -1e10, -2.5, 0.0, 1e-10, 3.0, math.Inf(1),
+		"", "a", "a\x00", "a\x00b", "ab", "b",
+	}
+
+	var prev []byte
+	for _, v := range values {
+		b, err := encodeAttrValue(v)
+		require.NoError(t, err)
+
+		// order is preserved
+		require.True(t, bytes.Compare(prev, b) < 0, "%v", v)
+		prev = b
+
+		// self delimited
+		n, err := attrValueLen(append(b, 0x00, 0x01, 0x02))
+		require.NoError(t, err)
+		require.Equal(t, len(b), n)
+
+		d, err := decodeAttrValue(b)
+		require.NoError(t, err)
+		require.Equal(t, v, d)
+	}
+
+	z, err := encodeAttrValue(math.Copysign(0, -1))
+	require.NoError(t, err)
+	pz, err := encodeAttrValue(0)
+	require.NoError(t, err)
+	require.Equal(t, pz, z)
+
+	_, err = encodeAttrValue(math.NaN())
+	require.Error(t, err)
+}
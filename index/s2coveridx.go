@@ -0,0 +1,437 @@
+package index
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+
+	"github.com/akhenakh/oureadb/index/geodata"
+	"github.com/akhenakh/oureadb/store"
+	"github.com/golang/geo/s2"
+	"github.com/pkg/errors"
+)
+
+// S2CoverIdx a multi level S2 region cover index
+// unlike S2FlatIdx the stored cover is normalized and made of cells between minLevel and maxLevel,
+// large polygons are using fewer keys and small ones get a tighter cover
+type S2CoverIdx struct {
+	// s2 levels range to index
+	minLevel, maxLevel int
+
+	// maximum number of cells for a cover
+	maxCells int
+
+	// prefix for the keys
+	prefix []byte
+
+	// number of goroutines used by multi cells lookups
+	workers int
+
+	// persisted metadata, nil if not opened with OpenS2CoverIdx or OpenOrCreateS2CoverIdx
+	meta *metadata
+
+	store.KVStore
+}
+
+// NewS2CoverIdx returns a new indexer
+// the index metadata is not read nor written, see OpenOrCreateS2CoverIdx
+func NewS2CoverIdx(s store.KVStore, prefix []byte, minLevel, maxLevel, maxCells int) *S2CoverIdx {
+	return &S2CoverIdx{
+		KVStore:  s,
+		prefix:   prefix,
+		minLevel: minLevel,
+		maxLevel: maxLevel,
+		maxCells: maxCells,
+	}
+}
+
+// OpenS2CoverIdx returns an indexer after validating the metadata stored under prefix
+// returns ErrNoMetadata if the index was not created or ErrMetadataMismatch if it was built with other cover parameters
+func OpenS2CoverIdx(s store.KVStore, prefix []byte, minLevel, maxLevel, maxCells int) (*S2CoverIdx, error) {
+	return openS2CoverIdx(s, prefix, minLevel, maxLevel, maxCells, false)
+}
+
+// OpenOrCreateS2CoverIdx is OpenS2CoverIdx creating the metadata if missing
+func OpenOrCreateS2CoverIdx(s store.KVStore, prefix []byte, minLevel, maxLevel, maxCells int) (*S2CoverIdx, error) {
+	return openS2CoverIdx(s, prefix, minLevel, maxLevel, maxCells, true)
+}
+
+func openS2CoverIdx(s store.KVStore, prefix []byte, minLevel, maxLevel, maxCells int, create bool) (*S2CoverIdx, error) {
+	m, err := openMetadata(s, prefix, IndexMetadata{Type: S2CoverIdxType, MinLevel: minLevel, MaxLevel: maxLevel, MaxCells: maxCells}, create)
+	if err != nil {
+		return nil, err
+	}
+	idx := NewS2CoverIdx(s, prefix, minLevel, maxLevel, maxCells)
+	idx.meta = m
+	return idx, nil
+}
+
+// Metadata returns the persisted metadata, nil if the index was not opened with OpenS2CoverIdx or OpenOrCreateS2CoverIdx
+func (idx *S2CoverIdx) Metadata() *IndexMetadata {
+	return idx.meta.get()
+}
+
+// SetScanWorkers sets the number of goroutines scanning the cells in GeoIdsAtCells and the queries using it
+// 0 or 1, the default, scans all the cells from a single snapshot,
+// more workers trade that consistency for throughput as each one opens its own reader
+func (idx *S2CoverIdx) SetScanWorkers(n int) {
+	idx.workers = n
+}
+
+// GeoIndex is geo indexing the geo data
+// it's not storing GeoData itself but only the geo index of the cover
+// id is the key referring to the GeoData stored somewhere else
+// an id -> cells reverse mapping is also stored, an already indexed id is reindexed, see GeoReindex
+// the writes of an id are serialized within the process, not between processes sharing the store
+func (idx *S2CoverIdx) GeoIndex(gd *geodata.GeoData, id GeoID) error {
+	return idx.GeoIndexContext(context.Background(), gd, id)
+}
+
+// GeoIndexContext is GeoIndex with a context
+func (idx *S2CoverIdx) GeoIndexContext(ctx context.Context, gd *geodata.GeoData, id GeoID) error {
+	defer lockID(idx.prefix, id)()
+
+	// the cells of a previous cover would be left behind by the new reverse mapping
+	cells, err := idx.indexedCells(id)
+	if err != nil {
+		return err
+	}
+	if cells != nil {
+		return idx.geoReindex(ctx, gd, id)
+	}
+
+	cu, err := idx.Covering(gd)
+	if err != nil {
+		return errors.Wrap(err, "generating cover failed")
+	}
+
+	// no cover for this geo object this is probably an error
+	if len(cu) == 0 {
+		return errors.New("geo object can't be indexed, empty cover")
+	}
+
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	kv, err := idx.KVStore.Writer()
+	if err != nil {
+		return err
+	}
+
+	batch := kv.NewBatch()
+	defer batch.Close()
+
+	// For each cell we store
+	// a key prefix+cellid+id -> no values
+	for _, c := range cu {
+		batch.Set(idx.cellKey(c, id), nil)
+	}
+
+	// the reverse mapping prefix+meta+id -> cells
+	batch.Set(idx.reverseKey(id), cellsToBytes(cu))
+	commit := idx.meta.add(batch, len(cu))
+
+	if err := kv.ExecuteBatch(batch); err != nil {
+		return err
+	}
+	commit()
+	return nil
+}
+
+// GeoUnindex removes all the cells previously indexed for id
+// returns ErrGeoIDNotFound if id is not indexed
+func (idx *S2CoverIdx) GeoUnindex(id GeoID) error {
+	return idx.GeoUnindexContext(context.Background(), id)
+}
+
+// GeoUnindexContext is GeoUnindex with a context
+func (idx *S2CoverIdx) GeoUnindexContext(ctx context.Context, id GeoID) error {
+	defer lockID(idx.prefix, id)()
+
+	cells, err := idx.indexedCells(id)
+	if err != nil {
+		return err
+	}
+
+	if cells == nil {
+		return ErrGeoIDNotFound
+	}
+
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	kv, err := idx.KVStore.Writer()
+	if err != nil {
+		return err
+	}
+
+	batch := kv.NewBatch()
+	defer batch.Close()
+
+	for _, c := range cells {
+		batch.Delete(idx.cellKey(c, id))
+	}
+	batch.Delete(idx.reverseKey(id))
+	commit := idx.meta.add(batch, -len(cells))
+
+	if err := kv.ExecuteBatch(batch); err != nil {
+		return err
+	}
+	commit()
+	return nil
+}
+
+// GeoReindex replaces the cells previously indexed for id by the cover of gd
+// old and new cells are written in the same batch
+// if id was not indexed it behaves like GeoIndex
+func (idx *S2CoverIdx) GeoReindex(gd *geodata.GeoData, id GeoID) error {
+	return idx.GeoReindexContext(context.Background(), gd, id)
+}
+
+// GeoReindexContext is GeoReindex with a context
+func (idx *S2CoverIdx) GeoReindexContext(ctx context.Context, gd *geodata.GeoData, id GeoID) error {
+	defer lockID(idx.prefix, id)()
+
+	return idx.geoReindex(ctx, gd, id)
+}
+
+// geoReindex is GeoReindexContext with the id already locked
+func (idx *S2CoverIdx) geoReindex(ctx context.Context, gd *geodata.GeoData, id GeoID) error {
+	cu, err := idx.Covering(gd)
+	if err != nil {
+		return errors.Wrap(err, "generating cover failed")
+	}
+
+	if len(cu) == 0 {
+		return errors.New("geo object can't be indexed, empty cover")
+	}
+
+	oldCells, err := idx.indexedCells(id)
+	if err != nil {
+		return err
+	}
+
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	kv, err := idx.KVStore.Writer()
+	if err != nil {
+		return err
+	}
+
+	batch := kv.NewBatch()
+	defer batch.Close()
+
+	m := make(map[s2.CellID]struct{}, len(cu))
+	for _, c := range cu {
+		m[c] = struct{}{}
+	}
+
+	// only remove the cells not present in the new cover
+	for _, c := range oldCells {
+		if _, ok := m[c]; ok {
+			continue
+		}
+		batch.Delete(idx.cellKey(c, id))
+	}
+
+	for _, c := range cu {
+		batch.Set(idx.cellKey(c, id), nil)
+	}
+
+	batch.Set(idx.reverseKey(id), cellsToBytes(cu))
+	commit := idx.meta.add(batch, len(cu)-len(oldCells))
+
+	if err := kv.ExecuteBatch(batch); err != nil {
+		return err
+	}
+	commit()
+	return nil
+}
+
+// indexedCells returns the cells stored for id in the reverse mapping
+// returns nil if id is not indexed
+func (idx *S2CoverIdx) indexedCells(id GeoID) ([]s2.CellID, error) {
+	kv, err := idx.Reader()
+	if err != nil {
+		return nil, err
+	}
+	defer kv.Close()
+
+	v, err := kv.Get(idx.reverseKey(id))
+	if err != nil {
+		return nil, errors.Wrap(err, "reading reverse mapping failed")
+	}
+	if v == nil {
+		return nil, nil
+	}
+
+	return bytesToCells(v)
+}
+
+// Covering is generating the normalized cover of a GeoData
+func (idx *S2CoverIdx) Covering(gd *geodata.GeoData) (s2.CellUnion, error) {
+	if gd.Geometry != nil && gd.Geometry.Type == geodata.Geometry_POINT {
+		// a point is covered by one cell at the finest level
+		coverer := &s2.RegionCoverer{MinLevel: idx.maxLevel, MaxLevel: idx.maxLevel}
+		return gd.Cover(coverer)
+	}
+
+	cu, err := gd.Cover(idx.coverer())
+	if err != nil {
+		return nil, err
+	}
+	cu.Normalize()
+	return cu, nil
+}
+
+// GeoIdsAtCells returns all GeoData keys intersecting the cells, without duplicates
+// cells can be of any level, indexed descendants are range scanned and
+// indexed ancestors down to minLevel are looked up
+func (idx *S2CoverIdx) GeoIdsAtCells(cells []s2.CellID) ([]GeoID, error) {
+	return idx.GeoIdsAtCellsContext(context.Background(), cells)
+}
+
+// GeoIdsAtCellsContext is GeoIdsAtCells with a context
+func (idx *S2CoverIdx) GeoIdsAtCellsContext(ctx context.Context, cells []s2.CellID) ([]GeoID, error) {
+	return collectRanges(ctx, idx.KVStore, idx.prefix, idx.cellsRanges(cells), idx.workers, func(k, _ []byte) (GeoID, bool, error) {
+		_, id, err := idx.keyToValues(k)
+		return id, err == nil, err
+	})
+}
+
+// StreamGeoIdsAtCells streams the GeoData keys intersecting the cells in key order
+// an id indexed in several of the scanned cells is streamed once per cell
+func (idx *S2CoverIdx) StreamGeoIdsAtCells(cells []s2.CellID, opts *QueryOptions, fn GeoIDFunc) (Cursor, error) {
+	return idx.StreamGeoIdsAtCellsContext(context.Background(), cells, opts, fn)
+}
+
+// StreamGeoIdsAtCellsContext is StreamGeoIdsAtCells with a context
+func (idx *S2CoverIdx) StreamGeoIdsAtCellsContext(ctx context.Context, cells []s2.CellID, opts *QueryOptions, fn GeoIDFunc) (Cursor, error) {
+	ranges := idx.cellsRanges(cells)
+
+	kv, err := idx.Reader()
+	if err != nil {
+		return "", err
+	}
+	defer kv.Close()
+
+	return scanRanges(ctx, kv, idx.prefix, ranges, opts, func(k, _ []byte) (GeoID, bool, error) {
+		_, id, err := idx.keyToValues(k)
+		return id, err == nil, err
+	}, fn)
+}
+
+// StreamGeoIdsRegionQuery streams the GeoID found in the index intersecting the cover of region
+// note you should check the returned GeoData is really inside/intersects the region
+func (idx *S2CoverIdx) StreamGeoIdsRegionQuery(region s2.Region, opts *QueryOptions, fn GeoIDFunc) (Cursor, error) {
+	return idx.StreamGeoIdsRegionQueryContext(context.Background(), region, opts, fn)
+}
+
+// StreamGeoIdsRegionQueryContext is StreamGeoIdsRegionQuery with a context
+func (idx *S2CoverIdx) StreamGeoIdsRegionQueryContext(ctx context.Context, region s2.Region, opts *QueryOptions, fn GeoIDFunc) (Cursor, error) {
+	cu := idx.coverer().Covering(region)
+	return idx.StreamGeoIdsAtCellsContext(ctx, cu, opts, fn)
+}
+
+// GeoIdsRadiusQuery returns the GeoID found in the index inside radius
+// note you should check the returned GeoData is really inside/intersects the cap
+func (idx *S2CoverIdx) GeoIdsRadiusQuery(lat, lng, radius float64) ([]GeoID, error) {
+	return idx.GeoIdsRadiusQueryContext(context.Background(), lat, lng, radius)
+}
+
+// GeoIdsRadiusQueryContext is GeoIdsRadiusQuery with a context
+func (idx *S2CoverIdx) GeoIdsRadiusQueryContext(ctx context.Context, lat, lng, radius float64) ([]GeoID, error) {
+	center := s2.PointFromLatLng(s2.LatLngFromDegrees(lat, lng))
+	cap := s2.CapFromCenterArea(center, s2RadialAreaMeters(radius))
+	return idx.GeoIdsRegionQueryContext(ctx, cap)
+}
+
+// GeoIdsRectQuery query over rect ur upper right bl bottom left
+// note you should check the returned GeoData is really inside/intersects the rect
+func (idx *S2CoverIdx) GeoIdsRectQuery(urlat, urlng, bllat, bllng float64) ([]GeoID, error) {
+	return idx.GeoIdsRectQueryContext(context.Background(), urlat, urlng, bllat, bllng)
+}
+
+// GeoIdsRectQueryContext is GeoIdsRectQuery with a context
+func (idx *S2CoverIdx) GeoIdsRectQueryContext(ctx context.Context, urlat, urlng, bllat, bllng float64) ([]GeoID, error) {
+	rect := s2.RectFromLatLng(s2.LatLngFromDegrees(bllat, bllng))
+	rect = rect.AddPoint(s2.LatLngFromDegrees(urlat, urlng))
+	return idx.GeoIdsRegionQueryContext(ctx, rect)
+}
+
+// GeoIdsRegionQuery returns the GeoID found in the index intersecting the cover of region
+// note you should check the returned GeoData is really inside/intersects the region
+func (idx *S2CoverIdx) GeoIdsRegionQuery(region s2.Region) ([]GeoID, error) {
+	return idx.GeoIdsRegionQueryContext(context.Background(), region)
+}
+
+// GeoIdsRegionQueryContext is GeoIdsRegionQuery with a context
+func (idx *S2CoverIdx) GeoIdsRegionQueryContext(ctx context.Context, region s2.Region) ([]GeoID, error) {
+	cu := idx.coverer().Covering(region)
+	return idx.GeoIdsAtCellsContext(ctx, cu)
+}
+
+// GeoIdsGeoDataQuery returns the GeoID found in the index intersecting the cover of gd
+// note you should check the returned GeoData is really inside/intersects gd
+func (idx *S2CoverIdx) GeoIdsGeoDataQuery(gd *geodata.GeoData) ([]GeoID, error) {
+	return idx.GeoIdsGeoDataQueryContext(context.Background(), gd)
+}
+
+// GeoIdsGeoDataQueryContext is GeoIdsGeoDataQuery with a context
+func (idx *S2CoverIdx) GeoIdsGeoDataQueryContext(ctx context.Context, gd *geodata.GeoData) ([]GeoID, error) {
+	cu, err := idx.Covering(gd)
+	if err != nil {
+		return nil, errors.Wrap(err, "generating cover failed")
+	}
+	return idx.GeoIdsAtCellsContext(ctx, cu)
+}
+
+func (idx *S2CoverIdx) coverer() *s2.RegionCoverer {
+	return &s2.RegionCoverer{MinLevel: idx.minLevel, MaxLevel: idx.maxLevel, MaxCells: idx.maxCells}
+}
+
+// cellsRanges returns the key ranges of the indexed descendants of cells, cells included,
+// and of their indexed ancestors down to minLevel
+func (idx *S2CoverIdx) cellsRanges(cells []s2.CellID) []keyRange {
+	var ranges []keyRange
+	for _, c := range cells {
+		ranges = append(ranges, cellDescendantsKeyRange(idx.prefix, c))
+		for l := c.Level() - 1; l >= idx.minLevel; l-- {
+			ranges = append(ranges, cellKeyRange(idx.prefix, c.Parent(l)))
+		}
+	}
+	return ranges
+}
+
+func (idx *S2CoverIdx) keyToValues(k []byte) (c s2.CellID, id GeoID, err error) {
+	// prefix+cellid+id
+	if len(k) <= len(idx.prefix)+8 {
+		return c, id, errors.New("invalid key")
+	}
+	buf := bytes.NewBuffer(k[len(idx.prefix):])
+	err = binary.Read(buf, binary.BigEndian, &c)
+	if err != nil {
+		return c, id, errors.Wrap(err, "read back cell key failed")
+	}
+
+	id = k[len(idx.prefix)+8:]
+	return
+}
+
+// cellKey returns the key prefix+cellid+id
+func (idx *S2CoverIdx) cellKey(c s2.CellID, id GeoID) []byte {
+	k := make([]byte, len(idx.prefix), len(idx.prefix)+8+len(id))
+	copy(k, idx.prefix)
+	k = append(k, itob(uint64(c))...)
+	k = append(k, []byte(id)...)
+	return k
+}
+
+// reverseKey returns the key of the id -> cells reverse mapping
+func (idx *S2CoverIdx) reverseKey(id GeoID) []byte {
+	return metaKey(idx.prefix, reverseMetaType, id)
+}
@@ -0,0 +1,129 @@
+package index
+
+import (
+	"testing"
+
+	"github.com/akhenakh/oureadb/index/geodata"
+	"github.com/golang/geo/s2"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCoverPolygonGeoStorage(t *testing.T) {
+	s := openStore(t)
+	defer cleanup(t, s)
+
+	id := []byte("MYPOLY")
+
+	idx := NewS2CoverIdx(s, []byte("TESTCOVER"), 8, 20, 8)
+	require.NotNil(t, idx)
+
+	geo := &geodata.GeoData{
+		Geometry: &geodata.Geometry{
+			Coordinates: ring,
+			Type:        geodata.Geometry_POLYGON,
+		},
+	}
+
+	cu, err := idx.Covering(geo)
+	require.NoError(t, err)
+	require.True(t, len(cu) <= 8)
+
+	err = idx.GeoIndex(geo, id)
+	require.NoError(t, err)
+
+	// querying a fine cell inside the polygon, found via its indexed ancestors
+	c := s2.CellIDFromLatLng(s2.LatLngFromDegrees(46.798, -71.228)).Parent(24)
+	res, err := idx.GeoIdsAtCells([]s2.CellID{c})
+	require.NoError(t, err)
+	require.Len(t, res, 1)
+
+	// querying a coarse cell, found via its indexed descendants
+	res, err = idx.GeoIdsAtCells([]s2.CellID{c.Parent(6)})
+	require.NoError(t, err)
+	require.Len(t, res, 1)
+
+	// far away
+	res, err = idx.GeoIdsRadiusQuery(48.850, 2.348, 2000)
+	require.NoError(t, err)
+	require.Len(t, res, 0)
+
+	res, err = idx.GeoIdsRadiusQuery(46.798, -71.228, 200)
+	require.NoError(t, err)
+	require.Len(t, res, 1)
+
+	res, err = idx.GeoIdsRectQuery(47.042521787558435, -71.03279113769531, 46.6451938027548, -71.47705078125)
+	require.NoError(t, err)
+	require.Len(t, res, 1)
+}
+
+func TestCoverPointGeoCovering(t *testing.T) {
+	s := openStore(t)
+	defer cleanup(t, s)
+
+	idx := NewS2CoverIdx(s, []byte("TESTCOVER"), 8, 20, 8)
+
+	geo := &geodata.GeoData{
+		Geometry: &geodata.Geometry{
+			Coordinates: quebec,
+			Type:        geodata.Geometry_POINT,
+		},
+	}
+
+	cu, err := idx.Covering(geo)
+	require.NoError(t, err)
+	require.Len(t, cu, 1)
+	require.Equal(t, 20, cu[0].Level())
+}
+
+func TestCoverGeoIndexTwice(t *testing.T) {
+	s := openStore(t)
+	defer cleanup(t, s)
+
+	id := []byte("MYPOLY")
+	prefix := []byte("TESTCOVER")
+
+	idx, err := OpenOrCreateS2CoverIdx(s, prefix, 8, 20, 8)
+	require.NoError(t, err)
+
+	poly := &geodata.GeoData{
+		Geometry: &geodata.Geometry{
+			Coordinates: ring,
+			Type:        geodata.Geometry_POLYGON,
+		},
+	}
+	point := &geodata.GeoData{
+		Geometry: &geodata.Geometry{
+			Coordinates: paris,
+			Type:        geodata.Geometry_POINT,
+		},
+	}
+
+	require.NoError(t, idx.GeoIndex(poly, id))
+	// indexing again replaces the previous cover
+	require.NoError(t, idx.GeoIndex(point, id))
+
+	res, err := idx.GeoIdsRadiusQuery(46.798, -71.228, 200)
+	require.NoError(t, err)
+	require.Len(t, res, 0)
+
+	res, err = idx.GeoIdsRadiusQuery(paris[1], paris[0], 200)
+	require.NoError(t, err)
+	require.Len(t, res, 1)
+
+	n, err := countKeys(s, prefix)
+	require.NoError(t, err)
+	require.EqualValues(t, 1, n)
+	require.EqualValues(t, 1, idx.Metadata().Entries)
+
+	require.NoError(t, idx.GeoUnindex(id))
+	require.Equal(t, ErrGeoIDNotFound, idx.GeoUnindex(id))
+
+	res, err = idx.GeoIdsRadiusQuery(paris[1], paris[0], 200)
+	require.NoError(t, err)
+	require.Len(t, res, 0)
+
+	n, err = countKeys(s, prefix)
+	require.NoError(t, err)
+	require.Zero(t, n)
+	require.Zero(t, idx.Metadata().Entries)
+}
@@ -2,6 +2,7 @@ package index
 
 import (
 	"bytes"
+	"context"
 	"encoding/binary"
 
 	"github.com/akhenakh/oureadb/index/geodata"
@@ -18,32 +19,234 @@ type S2FlatIdx struct {
 	// prefix for the keys
 	prefix []byte
 
+	// number of goroutines used by multi cells lookups
+	workers int
+
+	// parameters used to cover the queried regions
+	cover CoverParams
+
+	// persisted metadata, nil if not opened with OpenS2FlatIdx or OpenOrCreateS2FlatIdx
+	meta *metadata
+
 	store.KVStore
 }
 
 // NewS2FlatIdx returns a new indexer
-func NewS2FlatIdx(s store.KVStore, prefix []byte, level int) *S2FlatIdx {
+// queried regions are covered with cells at level by default, see the cover options,
+// coarser cells are scanned as the ranges of their children at level
+// the index metadata is not read nor written, see OpenOrCreateS2FlatIdx
+func NewS2FlatIdx(s store.KVStore, prefix []byte, level int, opts ...Option) *S2FlatIdx {
+	o := newOptions(CoverParams{MinLevel: level, MaxLevel: level}, opts)
 	return &S2FlatIdx{
 		KVStore: s,
 		prefix:  prefix,
 		level:   level,
+		workers: o.workers,
+		cover:   o.cover,
+	}
+}
+
+// OpenS2FlatIdx returns an indexer after validating the metadata stored under prefix
+// returns ErrNoMetadata if the index was not created or ErrMetadataMismatch if it was built with another level
+func OpenS2FlatIdx(s store.KVStore, prefix []byte, level int, opts ...Option) (*S2FlatIdx, error) {
+	return openS2FlatIdx(s, prefix, level, false, opts)
+}
+
+// OpenOrCreateS2FlatIdx is OpenS2FlatIdx creating the metadata if missing
+func OpenOrCreateS2FlatIdx(s store.KVStore, prefix []byte, level int, opts ...Option) (*S2FlatIdx, error) {
+	return openS2FlatIdx(s, prefix, level, true, opts)
+}
+
+func openS2FlatIdx(s store.KVStore, prefix []byte, level int, create bool, opts []Option) (*S2FlatIdx, error) {
+	m, err := openMetadata(s, prefix, IndexMetadata{Type: S2FlatIdxType, Level: level}, create)
+	if err != nil {
+		return nil, err
 	}
+	idx := NewS2FlatIdx(s, prefix, level, opts...)
+	idx.meta = m
+	return idx, nil
+}
+
+// Metadata returns the persisted metadata, nil if the index was not opened with OpenS2FlatIdx or OpenOrCreateS2FlatIdx
+func (idx *S2FlatIdx) Metadata() *IndexMetadata {
+	return idx.meta.get()
+}
+
+// WithCover returns a copy of the index covering the queried regions using p,
+// to override the index cover parameters for some queries
+func (idx *S2FlatIdx) WithCover(p CoverParams) *S2FlatIdx {
+	c := *idx
+	c.cover = p
+	return &c
+}
+
+// SetScanWorkers sets the number of goroutines scanning the cells in GeoIdsAtCells and the queries using it
+// 0 or 1, the default, scans all the cells from a single snapshot,
+// more workers trade that consistency for throughput as each one opens its own reader
+func (idx *S2FlatIdx) SetScanWorkers(n int) {
+	idx.workers = n
 }
 
 // GeoIndex is geo indexing the geo data
 // it's not storing GeoData itself but only the geo index of the cover
 // id is the key referring to the GeoData stored somewhere else
+// an id -> cells reverse mapping is also stored, an already indexed id is reindexed, see GeoReindex
+// the writes of an id are serialized within the process, not between processes sharing the store
 func (idx *S2FlatIdx) GeoIndex(gd *geodata.GeoData, id GeoID) error {
+	return idx.GeoIndexContext(context.Background(), gd, id)
+}
+
+// GeoIndexContext is GeoIndex with a context
+func (idx *S2FlatIdx) GeoIndexContext(ctx context.Context, gd *geodata.GeoData, id GeoID) error {
+	// the cells of a previous cover would be left behind by the new reverse mapping
+	defer lockID(idx.prefix, id)()
+
+	cells, err := idx.indexedCells(id)
+	if err != nil {
+		return err
+	}
+	if cells != nil {
+		return idx.geoReindex(ctx, gd, id)
+	}
+
+	entries, err := idx.indexEntries(gd, id)
+	if err != nil {
+		return err
+	}
+
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	kv, err := idx.KVStore.Writer()
+	if err != nil {
+		return err
+	}
+
+	batch := kv.NewBatch()
+	defer batch.Close()
+
+	for _, e := range entries {
+		batch.Set(e.k, e.v)
+	}
+	commit := addEntries(batch, entries)
+
+	if err := kv.ExecuteBatch(batch); err != nil {
+		return err
+	}
+	commit()
+	return nil
+}
+
+// indexEntries returns the keys and values written to index gd
+func (idx *S2FlatIdx) indexEntries(gd *geodata.GeoData, id GeoID) ([]bulkEntry, error) {
 	cu, err := idx.Covering(gd)
 	if err != nil {
-		return errors.Wrap(err, "generating cover failed")
+		return nil, errors.Wrap(err, "generating cover failed")
 	}
 
 	// no cover for this geo object this is probably an error
+	if len(cu) == 0 {
+		return nil, errors.New("geo object can't be indexed, empty cover")
+	}
+
+	interior, err := idx.interiorCells(gd, cu)
+	if err != nil {
+		return nil, errors.Wrap(err, "generating interior cover failed")
+	}
+
+	entries := make([]bulkEntry, 0, len(cu)+1)
+
+	// For each cell we store
+	// a key prefix+cellid+id -> interior flag
+	for _, c := range cu {
+		entries = append(entries, bulkEntry{k: idx.cellKey(c, id), v: interiorValue(interior, c), meta: idx.meta})
+	}
+
+	// the reverse mapping prefix+meta+id -> cells
+	entries = append(entries, bulkEntry{k: idx.reverseKey(id), v: cellsToBytes(cu)})
+
+	return entries, nil
+}
+
+// GeoUnindex removes all the cells previously indexed for id
+// returns ErrGeoIDNotFound if id is not indexed
+func (idx *S2FlatIdx) GeoUnindex(id GeoID) error {
+	return idx.GeoUnindexContext(context.Background(), id)
+}
+
+// GeoUnindexContext is GeoUnindex with a context
+func (idx *S2FlatIdx) GeoUnindexContext(ctx context.Context, id GeoID) error {
+	defer lockID(idx.prefix, id)()
+
+	cells, err := idx.indexedCells(id)
+	if err != nil {
+		return err
+	}
+
+	if cells == nil {
+		return ErrGeoIDNotFound
+	}
+
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	kv, err := idx.KVStore.Writer()
+	if err != nil {
+		return err
+	}
+
+	batch := kv.NewBatch()
+	defer batch.Close()
+
+	for _, c := range cells {
+		batch.Delete(idx.cellKey(c, id))
+	}
+	batch.Delete(idx.reverseKey(id))
+	commit := idx.meta.add(batch, -len(cells))
+
+	if err := kv.ExecuteBatch(batch); err != nil {
+		return err
+	}
+	commit()
+	return nil
+}
+
+// GeoReindex replaces the cells previously indexed for id by the cover of gd
+// old and new cells are written in the same batch
+// if id was not indexed it behaves like GeoIndex
+func (idx *S2FlatIdx) GeoReindex(gd *geodata.GeoData, id GeoID) error {
+	return idx.GeoReindexContext(context.Background(), gd, id)
+}
+
+// GeoReindexContext is GeoReindex with a context
+func (idx *S2FlatIdx) GeoReindexContext(ctx context.Context, gd *geodata.GeoData, id GeoID) error {
+	defer lockID(idx.prefix, id)()
+
+	return idx.geoReindex(ctx, gd, id)
+}
+
+// geoReindex is GeoReindexContext with the id already locked
+func (idx *S2FlatIdx) geoReindex(ctx context.Context, gd *geodata.GeoData, id GeoID) error {
+	cu, err := idx.Covering(gd)
+	if err != nil {
+		return errors.Wrap(err, "generating cover failed")
+	}
+
 	if len(cu) == 0 {
 		return errors.New("geo object can't be indexed, empty cover")
 	}
 
+	oldCells, err := idx.indexedCells(id)
+	if err != nil {
+		return err
+	}
+
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
 	kv, err := idx.KVStore.Writer()
 	if err != nil {
 		return err
@@ -52,25 +255,80 @@ func (idx *S2FlatIdx) GeoIndex(gd *geodata.GeoData, id GeoID) error {
 	batch := kv.NewBatch()
 	defer batch.Close()
 
-	// For each cell we store
-	// a key prefix+cellid+id -> no values
+	m := make(map[s2.CellID]struct{}, len(cu))
 	for _, c := range cu {
-		k := make([]byte, len(idx.prefix))
-		copy(k, idx.prefix)
-		k = append(k, itob(uint64(c))...)
-		k = append(k, []byte(id)...)
-		batch.Set(k, nil)
+		m[c] = struct{}{}
+	}
+
+	// only remove the cells not present in the new cover
+	for _, c := range oldCells {
+		if _, ok := m[c]; ok {
+			continue
+		}
+		batch.Delete(idx.cellKey(c, id))
 	}
 
-	return kv.ExecuteBatch(batch)
+	interior, err := idx.interiorCells(gd, cu)
+	if err != nil {
+		return errors.Wrap(err, "generating interior cover failed")
+	}
+
+	for _, c := range cu {
+		batch.Set(idx.cellKey(c, id), interiorValue(interior, c))
+	}
+
+	batch.Set(idx.reverseKey(id), cellsToBytes(cu))
+	commit := idx.meta.add(batch, len(cu)-len(oldCells))
+
+	if err := kv.ExecuteBatch(batch); err != nil {
+		return err
+	}
+	commit()
+	return nil
+}
+
+// indexedCells returns the cells stored for id in the reverse mapping
+// returns nil if id is not indexed
+func (idx *S2FlatIdx) indexedCells(id GeoID) ([]s2.CellID, error) {
+	kv, err := idx.Reader()
+	if err != nil {
+		return nil, err
+	}
+	defer kv.Close()
+
+	v, err := kv.Get(idx.reverseKey(id))
+	if err != nil {
+		return nil, errors.Wrap(err, "reading reverse mapping failed")
+	}
+	if v == nil {
+		return nil, nil
+	}
+
+	return bytesToCells(v)
 }
 
 // GeoIdsAtCell returns all GeoData keys contained in the cell
 func (idx *S2FlatIdx) GeoIdsAtCell(c s2.CellID) ([]GeoID, error) {
+	return idx.GeoIdsAtCellContext(context.Background(), c)
+}
+
+// GeoIdsAtCellContext is GeoIdsAtCell with a context
+func (idx *S2FlatIdx) GeoIdsAtCellContext(ctx context.Context, c s2.CellID) ([]GeoID, error) {
 	if c.Level() != idx.level {
 		return nil, errors.New("requested a cellID with a different level than the index")
 	}
 
+	kv, err := idx.Reader()
+	if err != nil {
+		return nil, err
+	}
+	defer kv.Close()
+
+	return idx.geoIdsAtCell(ctx, kv, c)
+}
+
+// geoIdsAtCell returns all GeoData keys contained in the cell using reader kv
+func (idx *S2FlatIdx) geoIdsAtCell(ctx context.Context, kv store.KVReader, c s2.CellID) ([]GeoID, error) {
 	// add the prefix to the queried key
 	k := make([]byte, len(idx.prefix))
 	copy(k, idx.prefix)
@@ -78,20 +336,20 @@ func (idx *S2FlatIdx) GeoIdsAtCell(c s2.CellID) ([]GeoID, error) {
 
 	var res []GeoID
 
-	kv, err := idx.Reader()
-	defer kv.Close()
-	if err != nil {
-		return nil, err
-	}
-
 	// iterate entries with cell's prefix
 	iter := kv.PrefixIterator(k)
 	defer iter.Close()
 	for {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+
 		kid, _, ok := iter.Current()
 		if !ok {
 			break
 		}
+		kid = append([]byte(nil), kid...)
+
 		_, id, err := idx.keyToValues(kid)
 		if err != nil {
 			return nil, errors.Wrap(err, "read back failed key from db")
@@ -106,36 +364,155 @@ func (idx *S2FlatIdx) GeoIdsAtCell(c s2.CellID) ([]GeoID, error) {
 
 // GeoIdsAtCells returns all GeoData keys contained in the cells, without duplicates
 func (idx *S2FlatIdx) GeoIdsAtCells(cells []s2.CellID) ([]GeoID, error) {
-	m := make(map[string]struct{})
+	return idx.GeoIdsAtCellsContext(context.Background(), cells)
+}
 
-	for _, c := range cells {
-		ids, err := idx.GeoIdsAtCell(c)
-		if err != nil {
-			return nil, errors.Wrap(err, "fetching geo ids from cells failed")
-		}
-		for _, id := range ids {
-			m[string(id)] = struct{}{}
-		}
+// GeoIdsAtCellsContext is GeoIdsAtCells with a context
+func (idx *S2FlatIdx) GeoIdsAtCellsContext(ctx context.Context, cells []s2.CellID) ([]GeoID, error) {
+	ranges, err := idx.cellsRanges(cells)
+	if err != nil {
+		return nil, err
 	}
 
-	res := make([]GeoID, len(m))
-	var i int
-	for k := range m {
-		res[i] = []byte(k)
-		i++
+	return idx.collectRanges(ctx, ranges)
+}
+
+// StreamGeoIdsAtCells streams the GeoData keys contained in the cells in key order
+// an id indexed in several of the cells is streamed once per cell
+func (idx *S2FlatIdx) StreamGeoIdsAtCells(cells []s2.CellID, opts *QueryOptions, fn GeoIDFunc) (Cursor, error) {
+	return idx.StreamGeoIdsAtCellsContext(context.Background(), cells, opts, fn)
+}
+
+// StreamGeoIdsAtCellsContext is StreamGeoIdsAtCells with a context
+func (idx *S2FlatIdx) StreamGeoIdsAtCellsContext(ctx context.Context, cells []s2.CellID, opts *QueryOptions, fn GeoIDFunc) (Cursor, error) {
+	ranges, err := idx.cellsRanges(cells)
+	if err != nil {
+		return "", err
 	}
 
-	return res, nil
+	return idx.streamRanges(ctx, ranges, opts, fn)
+}
+
+// StreamGeoIdsRegionQuery streams the GeoID found in the index intersecting the cover of region
+// note you should check the returned GeoData is really inside/intersects the region
+func (idx *S2FlatIdx) StreamGeoIdsRegionQuery(region s2.Region, opts *QueryOptions, fn GeoIDFunc) (Cursor, error) {
+	return idx.StreamGeoIdsRegionQueryContext(context.Background(), region, opts, fn)
+}
+
+// StreamGeoIdsRegionQueryContext is StreamGeoIdsRegionQuery with a context
+func (idx *S2FlatIdx) StreamGeoIdsRegionQueryContext(ctx context.Context, region s2.Region, opts *QueryOptions, fn GeoIDFunc) (Cursor, error) {
+	return idx.streamRanges(ctx, idx.regionRanges(region), opts, fn)
 }
 
 // GeoIdsRadiusQuery returns the GeoID found in the index inside radius
 // note you should check the returned GeoData is really inside/intersects the cap
 func (idx *S2FlatIdx) GeoIdsRadiusQuery(lat, lng, radius float64) ([]GeoID, error) {
+	return idx.GeoIdsRadiusQueryContext(context.Background(), lat, lng, radius)
+}
+
+// GeoIdsRadiusQueryContext is GeoIdsRadiusQuery with a context
+func (idx *S2FlatIdx) GeoIdsRadiusQueryContext(ctx context.Context, lat, lng, radius float64) ([]GeoID, error) {
 	center := s2.PointFromLatLng(s2.LatLngFromDegrees(lat, lng))
 	cap := s2.CapFromCenterArea(center, s2RadialAreaMeters(radius))
-	coverer := &s2.RegionCoverer{MinLevel: idx.level, MaxLevel: idx.level}
-	cu := coverer.Covering(cap)
-	return idx.GeoIdsAtCells(cu)
+	return idx.GeoIdsRegionQueryContext(ctx, cap)
+}
+
+// GeoIdsRectQuery query over rect ur upper right bl bottom left
+// note you should check the returned GeoData is really inside/intersects the rect
+func (idx *S2FlatIdx) GeoIdsRectQuery(urlat, urlng, bllat, bllng float64) ([]GeoID, error) {
+	return idx.GeoIdsRectQueryContext(context.Background(), urlat, urlng, bllat, bllng)
+}
+
+// GeoIdsRectQueryContext is GeoIdsRectQuery with a context
+func (idx *S2FlatIdx) GeoIdsRectQueryContext(ctx context.Context, urlat, urlng, bllat, bllng float64) ([]GeoID, error) {
+	rect := s2.RectFromLatLng(s2.LatLngFromDegrees(bllat, bllng))
+	rect = rect.AddPoint(s2.LatLngFromDegrees(urlat, urlng))
+	return idx.GeoIdsRegionQueryContext(ctx, rect)
+}
+
+// GeoIdsRegionQuery returns the GeoID found in the index intersecting the cover of region
+// note you should check the returned GeoData is really inside/intersects the region
+func (idx *S2FlatIdx) GeoIdsRegionQuery(region s2.Region) ([]GeoID, error) {
+	return idx.GeoIdsRegionQueryContext(context.Background(), region)
+}
+
+// GeoIdsRegionQueryContext is GeoIdsRegionQuery with a context
+func (idx *S2FlatIdx) GeoIdsRegionQueryContext(ctx context.Context, region s2.Region) ([]GeoID, error) {
+	return idx.collectRanges(ctx, idx.regionRanges(region))
+}
+
+// GeoIdsGeoDataQuery returns the GeoID found in the index intersecting the cover of gd
+// note you should check the returned GeoData is really inside/intersects gd
+func (idx *S2FlatIdx) GeoIdsGeoDataQuery(gd *geodata.GeoData) ([]GeoID, error) {
+	return idx.GeoIdsGeoDataQueryContext(context.Background(), gd)
+}
+
+// GeoIdsGeoDataQueryContext is GeoIdsGeoDataQuery with a context
+func (idx *S2FlatIdx) GeoIdsGeoDataQueryContext(ctx context.Context, gd *geodata.GeoData) ([]GeoID, error) {
+	cu, err := idx.Covering(gd)
+	if err != nil {
+		return nil, errors.Wrap(err, "generating cover failed")
+	}
+	return idx.GeoIdsAtCellsContext(ctx, cu)
+}
+
+// GeoIDMatch is a GeoID found in a S2FlatIdx
+// Interior is true if the match is certain: a queried cell is fully inside the indexed geometry,
+// otherwise the id is only a candidate and the geometry should be checked
+type GeoIDMatch struct {
+	ID       GeoID
+	Interior bool
+}
+
+// GeoMatchesAtCells returns all GeoData keys contained in the cells with their interior flag, without duplicates
+func (idx *S2FlatIdx) GeoMatchesAtCells(cells []s2.CellID) ([]GeoIDMatch, error) {
+	return idx.GeoMatchesAtCellsContext(context.Background(), cells)
+}
+
+// GeoMatchesAtCellsContext is GeoMatchesAtCells with a context
+func (idx *S2FlatIdx) GeoMatchesAtCellsContext(ctx context.Context, cells []s2.CellID) ([]GeoIDMatch, error) {
+	ranges, err := idx.cellsRanges(cells)
+	if err != nil {
+		return nil, err
+	}
+
+	return idx.geoMatches(ctx, ranges)
+}
+
+// geoMatches returns the ids found in ranges with their interior flag, without duplicates
+func (idx *S2FlatIdx) geoMatches(ctx context.Context, ranges []keyRange) ([]GeoIDMatch, error) {
+	m := make(map[string]bool)
+	err := scanCells(ctx, idx.KVStore, idx.prefix, ranges, func(_ s2.CellID, k, v []byte) error {
+		_, id, err := idx.keyToValues(k)
+		if err != nil {
+			return errors.Wrap(err, "read back failed key from db")
+		}
+		interior := len(v) > 0 && v[0] == interiorFlag
+		m[string(id)] = m[string(id)] || interior
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	res := make([]GeoIDMatch, 0, len(m))
+	for k, interior := range m {
+		res = append(res, GeoIDMatch{ID: []byte(k), Interior: interior})
+	}
+
+	return res, nil
+}
+
+// GeoMatchesRegionQuery returns the GeoID found in the index intersecting the cover of region
+// with their interior flag, only the non interior matches should be checked against the region
+// region is covered at the index level, ignoring the index cover parameters
+func (idx *S2FlatIdx) GeoMatchesRegionQuery(region s2.Region) ([]GeoIDMatch, error) {
+	return idx.GeoMatchesRegionQueryContext(context.Background(), region)
+}
+
+// GeoMatchesRegionQueryContext is GeoMatchesRegionQuery with a context
+func (idx *S2FlatIdx) GeoMatchesRegionQueryContext(ctx context.Context, region s2.Region) ([]GeoIDMatch, error) {
+	return idx.geoMatches(ctx, idx.levelRegionRanges(region))
 }
 
 // Covering is generating the cover of a GeoData
@@ -144,6 +521,92 @@ func (idx *S2FlatIdx) Covering(gd *geodata.GeoData) (s2.CellUnion, error) {
 	return gd.Cover(coverer)
 }
 
+// interiorCells returns the cells of the cover cu fully inside gd
+// only polygons, alone or in a collection, have interior cells
+func (idx *S2FlatIdx) interiorCells(gd *geodata.GeoData, cu s2.CellUnion) (map[s2.CellID]struct{}, error) {
+	m := make(map[s2.CellID]struct{})
+	if gd.Geometry == nil ||
+		(gd.Geometry.Type != geodata.Geometry_POLYGON && gd.Geometry.Type != geodata.Geometry_MULTIPOLYGON &&
+			gd.Geometry.Type != geodata.Geometry_GEOMETRYCOLLECTION) {
+		return m, nil
+	}
+
+	// interior cells are part of the cover, MaxCells can't be 0 for an interior covering
+	coverer := &s2.RegionCoverer{MinLevel: idx.level, MaxLevel: idx.level, MaxCells: len(cu)}
+	icu, err := gd.InteriorCover(coverer)
+	if err != nil {
+		return nil, err
+	}
+	for _, c := range icu {
+		m[c] = struct{}{}
+	}
+	return m, nil
+}
+
+// interiorValue returns the value stored for cell c
+func interiorValue(interior map[s2.CellID]struct{}, c s2.CellID) []byte {
+	if _, ok := interior[c]; ok {
+		return []byte{interiorFlag}
+	}
+	return nil
+}
+
+// cellsRanges returns the key ranges of cells, adjacent cells are coalesced when scanned
+func (idx *S2FlatIdx) cellsRanges(cells []s2.CellID) ([]keyRange, error) {
+	ranges := make([]keyRange, len(cells))
+	for i, c := range cells {
+		if c.Level() != idx.level {
+			return nil, errors.New("requested a cellID with a different level than the index")
+		}
+		ranges[i] = levelKeyRange(idx.prefix, c, idx.level)
+	}
+	return ranges, nil
+}
+
+// regionRanges returns the key ranges of the cover of region
+func (idx *S2FlatIdx) regionRanges(region s2.Region) []keyRange {
+	cu := idx.cover.atMostLevel(idx.level).covering(region)
+	ranges := make([]keyRange, len(cu))
+	for i, c := range cu {
+		ranges[i] = levelKeyRange(idx.prefix, c, idx.level)
+	}
+	return ranges
+}
+
+// levelRegionRanges returns the key ranges of the cover of region at the index level
+// a coarser cell would match the interior cells of its children not touching region
+func (idx *S2FlatIdx) levelRegionRanges(region s2.Region) []keyRange {
+	coverer := &s2.RegionCoverer{MinLevel: idx.level, MaxLevel: idx.level}
+	cu := coverer.Covering(region)
+	ranges := make([]keyRange, len(cu))
+	for i, c := range cu {
+		ranges[i] = levelKeyRange(idx.prefix, c, idx.level)
+	}
+	return ranges
+}
+
+// streamRanges streams the ids found in ranges
+func (idx *S2FlatIdx) streamRanges(ctx context.Context, ranges []keyRange, opts *QueryOptions, fn GeoIDFunc) (Cursor, error) {
+	kv, err := idx.Reader()
+	if err != nil {
+		return "", err
+	}
+	defer kv.Close()
+
+	return scanRanges(ctx, kv, idx.prefix, ranges, opts, idx.decodeID, fn)
+}
+
+// collectRanges returns the ids found in ranges, without duplicates
+func (idx *S2FlatIdx) collectRanges(ctx context.Context, ranges []keyRange) ([]GeoID, error) {
+	return collectRanges(ctx, idx.KVStore, idx.prefix, ranges, idx.workers, idx.decodeID)
+}
+
+// decodeID is the keyDecoder of the index keys
+func (idx *S2FlatIdx) decodeID(k, _ []byte) (GeoID, bool, error) {
+	_, id, err := idx.keyToValues(k)
+	return id, err == nil, err
+}
+
 func (idx *S2FlatIdx) keyToValues(k []byte) (c s2.CellID, id GeoID, err error) {
 	// prefix+cellid+id
 	if len(k) <= len(idx.prefix)+8 {
@@ -158,3 +621,17 @@ func (idx *S2FlatIdx) keyToValues(k []byte) (c s2.CellID, id GeoID, err error) {
 	id = k[len(idx.prefix)+8:]
 	return
 }
+
+// cellKey returns the key prefix+cellid+id
+func (idx *S2FlatIdx) cellKey(c s2.CellID, id GeoID) []byte {
+	k := make([]byte, len(idx.prefix), len(idx.prefix)+8+len(id))
+	copy(k, idx.prefix)
+	k = append(k, itob(uint64(c))...)
+	k = append(k, []byte(id)...)
+	return k
+}
+
+// reverseKey returns the key of the id -> cells reverse mapping
+func (idx *S2FlatIdx) reverseKey(id GeoID) []byte {
+	return metaKey(idx.prefix, reverseMetaType, id)
+}
@@ -1,7 +1,10 @@
 package index
 
 import (
+	"fmt"
+	"sync"
 	"testing"
+	"time"
 
 	"github.com/akhenakh/oureadb/s2tools"
 
@@ -131,6 +134,274 @@ func TestGenericPointGeoStorage(t *testing.T) {
 	require.Len(t, res, 1)
 }
 
+func TestGeoReindexUnindex(t *testing.T) {
+	s := openStore(t)
+	defer cleanup(t, s)
+
+	id := []byte("MYPOLY")
+
+	idx := NewS2FlatIdx(s, []byte("TESTPREFIX"), s2Level)
+
+	poly := &geodata.GeoData{
+		Geometry: &geodata.Geometry{
+			Coordinates: ring,
+			Type:        geodata.Geometry_POLYGON,
+		},
+	}
+	point := &geodata.GeoData{
+		Geometry: &geodata.Geometry{
+			Coordinates: quebec,
+			Type:        geodata.Geometry_POINT,
+		},
+	}
+
+	err := idx.GeoIndex(poly, id)
+	require.NoError(t, err)
+
+	polyCell := s2.CellIDFromLatLng(s2.LatLngFromDegrees(ring[1], ring[0])).Parent(s2Level)
+	pointCell := s2.CellIDFromLatLng(s2.LatLngFromDegrees(quebec[1], quebec[0])).Parent(s2Level)
+
+	// moving the object to the point
+	err = idx.GeoReindex(point, id)
+	require.NoError(t, err)
+
+	res, err := idx.GeoIdsAtCell(polyCell)
+	require.NoError(t, err)
+	require.Len(t, res, 0)
+
+	res, err = idx.GeoIdsAtCell(pointCell)
+	require.NoError(t, err)
+	require.Len(t, res, 1)
+
+	err = idx.GeoUnindex(id)
+	require.NoError(t, err)
+
+	res, err = idx.GeoIdsAtCell(pointCell)
+	require.NoError(t, err)
+	require.Len(t, res, 0)
+
+	err = idx.GeoUnindex(id)
+	require.Equal(t, ErrGeoIDNotFound, err)
+}
+
+func TestGeoIndexTwice(t *testing.T) {
+	s := openStore(t)
+	defer cleanup(t, s)
+
+	id := []byte("MYPOLY")
+
+	idx := NewS2FlatIdx(s, []byte("TESTPREFIX"), s2Level)
+
+	poly := &geodata.GeoData{
+		Geometry: &geodata.Geometry{
+			Coordinates: ring,
+			Type:        geodata.Geometry_POLYGON,
+		},
+	}
+	point := &geodata.GeoData{
+		Geometry: &geodata.Geometry{
+			Coordinates: quebec,
+			Type:        geodata.Geometry_POINT,
+		},
+	}
+
+	err := idx.GeoIndex(poly, id)
+	require.NoError(t, err)
+	err = idx.GeoIndex(point, id)
+	require.NoError(t, err)
+
+	polyCell := s2.CellIDFromLatLng(s2.LatLngFromDegrees(ring[1], ring[0])).Parent(s2Level)
+	pointCell := s2.CellIDFromLatLng(s2.LatLngFromDegrees(quebec[1], quebec[0])).Parent(s2Level)
+
+	res, err := idx.GeoIdsAtCell(polyCell)
+	require.NoError(t, err)
+	require.Len(t, res, 0)
+
+	err = idx.GeoUnindex(id)
+	require.NoError(t, err)
+
+	for _, c := range []s2.CellID{polyCell, pointCell} {
+		res, err = idx.GeoIdsAtCell(c)
+		require.NoError(t, err)
+		require.Len(t, res, 0)
+	}
+}
+
+// slowStore is a store yielding to the other goroutines before every write
+type slowStore struct {
+	store.KVStore
+}
+
+func (s slowStore) Writer() (store.KVWriter, error) {
+	time.Sleep(time.Millisecond)
+	return s.KVStore.Writer()
+}
+
+func TestGeoIndexConcurrent(t *testing.T) {
+	s := openStore(t)
+	defer cleanup(t, s)
+
+	id := []byte("MYPOINT")
+	prefix := []byte("TESTPREFIX")
+
+	// two handles of the same index writing the same id, the writes are delayed to interleave them
+	slow := slowStore{s}
+	handles := []*S2FlatIdx{NewS2FlatIdx(slow, prefix, s2Level), NewS2FlatIdx(slow, prefix, s2Level)}
+
+	var wg sync.WaitGroup
+	errs := make(chan error, 8)
+	for w := 0; w < 8; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			errs <- func() error {
+				for i := 0; i < 20; i++ {
+					gd := &geodata.GeoData{
+						Geometry: &geodata.Geometry{
+							Type:        geodata.Geometry_POINT,
+							Coordinates: []float64{quebec[0] + float64(w)*0.01, quebec[1] + float64(i)*0.01},
+						},
+					}
+					if err := handles[w%2].GeoIndex(gd, id); err != nil {
+						return fmt.Errorf("worker %d: %v", w, err)
+					}
+				}
+				return nil
+			}()
+		}(w)
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		require.NoError(t, err)
+	}
+
+	// the reverse mapping knows the only cell left
+	n, err := countKeys(s, prefix)
+	require.NoError(t, err)
+	require.EqualValues(t, 1, n)
+
+	require.NoError(t, handles[0].GeoUnindex(id))
+	n, err = countKeys(s, prefix)
+	require.NoError(t, err)
+	require.Zero(t, n)
+}
+
+func TestGenericRegionQuery(t *testing.T) {
+	s := openStore(t)
+	defer cleanup(t, s)
+
+	idx := NewS2FlatIdx(s, []byte("TESTPREFIX"), s2Level)
+
+	geo := &geodata.GeoData{
+		Geometry: &geodata.Geometry{
+			Coordinates: quebec,
+			Type:        geodata.Geometry_POINT,
+		},
+	}
+
+	err := idx.GeoIndex(geo, []byte("MYPOINTID"))
+	require.NoError(t, err)
+
+	res, err := idx.GeoIdsRectQuery(46.81, -71.21, 46.80, -71.22)
+	require.NoError(t, err)
+	require.Len(t, res, 1)
+
+	zone := &geodata.GeoData{
+		Geometry: &geodata.Geometry{
+			Coordinates: ring,
+			Type:        geodata.Geometry_POLYGON,
+		},
+	}
+
+	res, err = idx.GeoIdsGeoDataQuery(zone)
+	require.NoError(t, err)
+	require.Len(t, res, 0)
+
+	res, err = idx.GeoIdsGeoDataQuery(geo)
+	require.NoError(t, err)
+	require.Len(t, res, 1)
+}
+
+func TestGeoMatchesInterior(t *testing.T) {
+	s := openStore(t)
+	defer cleanup(t, s)
+
+	idx := NewS2FlatIdx(s, []byte("TESTPREFIX"), s2Level)
+
+	geo := &geodata.GeoData{
+		Geometry: &geodata.Geometry{
+			Coordinates: append([]float64(nil), ring...),
+			Type:        geodata.Geometry_POLYGON,
+		},
+	}
+
+	err := idx.GeoIndex(geo, []byte("MYPOLY"))
+	require.NoError(t, err)
+
+	// the center of the polygon
+	center := s2.CellIDFromLatLng(s2.LatLngFromDegrees(46.798, -71.228)).Parent(s2Level)
+	res, err := idx.GeoMatchesAtCells([]s2.CellID{center})
+	require.NoError(t, err)
+	require.Len(t, res, 1)
+	require.True(t, res[0].Interior)
+
+	// a vertex of the polygon
+	border := s2.CellIDFromLatLng(s2.LatLngFromDegrees(ring[1], ring[0])).Parent(s2Level)
+	res, err = idx.GeoMatchesAtCells([]s2.CellID{border})
+	require.NoError(t, err)
+	require.Len(t, res, 1)
+	require.False(t, res[0].Interior)
+
+	// both, interior wins
+	res, err = idx.GeoMatchesRegionQuery(&s2.CellUnion{center, border})
+	require.NoError(t, err)
+	require.Len(t, res, 1)
+	require.True(t, res[0].Interior)
+}
+
+func TestGeoMatchesCollectionPoint(t *testing.T) {
+	s := openStore(t)
+	defer cleanup(t, s)
+
+	idx := NewS2FlatIdx(s, []byte("TESTPREFIX"), 16)
+
+	gd, err := geodata.GeoDataFromWKT("GEOMETRYCOLLECTION (POINT (-71.2275 46.7984), LINESTRING (-71.2641 46.8373, -71.2504 46.8432))")
+	require.NoError(t, err)
+	require.NoError(t, idx.GeoIndex(gd, []byte("bus")))
+
+	// a point member has no interior
+	c := s2.CellIDFromLatLng(s2.LatLngFromDegrees(46.7984, -71.2275)).Parent(16)
+	res, err := idx.GeoMatchesAtCells([]s2.CellID{c})
+	require.NoError(t, err)
+	require.Equal(t, []GeoIDMatch{{ID: GeoID("bus")}}, res)
+}
+
+func TestGeoMatchesCoarseCover(t *testing.T) {
+	s := openStore(t)
+	defer cleanup(t, s)
+
+	// the queried regions are covered with cells coarser than the index level
+	idx := NewS2FlatIdx(s, []byte("TESTPREFIX"), 14, WithCoverLevels(8, 14), WithCoverMaxCells(4))
+
+	zone, err := geodata.GeoDataFromWKT("POLYGON ((-71.4 46.6, -71.0 46.6, -71.0 47.0, -71.4 47.0, -71.4 46.6))")
+	require.NoError(t, err)
+	require.NoError(t, idx.GeoIndex(zone, []byte("zone")))
+
+	// north of the polygon, not touching it
+	outside := s2.CapFromCenterAngle(s2.PointFromLatLng(s2.LatLngFromDegrees(47.028, -71.2)), metersToAngle(2000))
+	res, err := idx.GeoMatchesRegionQuery(outside)
+	require.NoError(t, err)
+	for _, m := range res {
+		require.False(t, m.Interior)
+	}
+
+	inside := s2.CapFromCenterAngle(s2.PointFromLatLng(s2.LatLngFromDegrees(46.8, -71.2)), metersToAngle(2000))
+	res, err = idx.GeoMatchesRegionQuery(inside)
+	require.NoError(t, err)
+	require.Equal(t, []GeoIDMatch{{ID: GeoID("zone"), Interior: true}}, res)
+}
+
 func TestGenericPointGeoCovering(t *testing.T) {
 	s, _ := null.New(nil, nil)
 	defer s.Close()
@@ -199,7 +470,7 @@ func TestGenericLineStringGeoCovering(t *testing.T) {
 	// 4cb8963,4cb897d,4cb8bd9
 }
 
-func openStore(t *testing.T) store.KVStore {
+func openStore(t testing.TB) store.KVStore {
 	rv, err := gtreap.New(nil, map[string]interface{}{
 		"path": "",
 	})
@@ -209,7 +480,7 @@ func openStore(t *testing.T) store.KVStore {
 	return rv
 }
 
-func cleanup(t *testing.T, s store.KVStore) {
+func cleanup(t testing.TB, s store.KVStore) {
 	err := s.Close()
 	if err != nil {
 		t.Fatal(err)
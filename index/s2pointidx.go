@@ -2,7 +2,10 @@ package index
 
 import (
 	"bytes"
+	"context"
 	"encoding/binary"
+	"math"
+	"sort"
 
 	"github.com/akhenakh/oureadb/index/geodata"
 	"github.com/akhenakh/oureadb/store"
@@ -10,26 +13,93 @@ import (
 	"github.com/pkg/errors"
 )
 
+// nearestStartRadius is the radius in meters of the first ring scanned by GeoIdsNearest
+const nearestStartRadius = 100
+
 // S2PointIdx is an s2 point index
 type S2PointIdx struct {
 	// prefix for the keys
 	prefix []byte
 
+	// number of goroutines used by multi cells lookups
+	workers int
+
+	// parameters used to cover the queried regions
+	cover CoverParams
+
+	// persisted metadata, nil if not opened with OpenS2PointIdx or OpenOrCreateS2PointIdx
+	meta *metadata
+
 	store.KVStore
 }
 
 // NewS2PointIdx returns a new indexer
-func NewS2PointIdx(s store.KVStore, prefix []byte) *S2PointIdx {
+// queried regions are covered with cells up to level 14 and 8 cells by default, see the cover options
+// the index metadata is not read nor written, see OpenOrCreateS2PointIdx
+func NewS2PointIdx(s store.KVStore, prefix []byte, opts ...Option) *S2PointIdx {
+	o := newOptions(CoverParams{MaxLevel: 14, MaxCells: 8}, opts)
 	return &S2PointIdx{
 		KVStore: s,
 		prefix:  prefix,
+		workers: o.workers,
+		cover:   o.cover,
 	}
 }
 
+// OpenS2PointIdx returns an indexer after validating the metadata stored under prefix
+// returns ErrNoMetadata if the index was not created or ErrMetadataMismatch if it was built as another index type
+func OpenS2PointIdx(s store.KVStore, prefix []byte, opts ...Option) (*S2PointIdx, error) {
+	return openS2PointIdx(s, prefix, false, opts)
+}
+
+// OpenOrCreateS2PointIdx is OpenS2PointIdx creating the metadata if missing
+func OpenOrCreateS2PointIdx(s store.KVStore, prefix []byte, opts ...Option) (*S2PointIdx, error) {
+	return openS2PointIdx(s, prefix, true, opts)
+}
+
+func openS2PointIdx(s store.KVStore, prefix []byte, create bool, opts []Option) (*S2PointIdx, error) {
+	m, err := openMetadata(s, prefix, IndexMetadata{Type: S2PointIdxType}, create)
+	if err != nil {
+		return nil, err
+	}
+	idx := NewS2PointIdx(s, prefix, opts...)
+	idx.meta = m
+	return idx, nil
+}
+
+// Metadata returns the persisted metadata, nil if the index was not opened with OpenS2PointIdx or OpenOrCreateS2PointIdx
+func (idx *S2PointIdx) Metadata() *IndexMetadata {
+	return idx.meta.get()
+}
+
+// WithCover returns a copy of the index covering the queried regions using p,
+// to override the index cover parameters for some queries
+func (idx *S2PointIdx) WithCover(p CoverParams) *S2PointIdx {
+	c := *idx
+	c.cover = p
+	return &c
+}
+
+// SetScanWorkers sets the number of goroutines scanning the cells in GeoIdsAtCells
+// 0 or 1, the default, scans all the cells from a single snapshot,
+// more workers trade that consistency for throughput as each one opens its own reader
+func (idx *S2PointIdx) SetScanWorkers(n int) {
+	idx.workers = n
+}
+
 // PointIndex is geo indexing a point
 // it's not storing GeoData itself but only the geo cell l30 of the point
 // id is the key referring to the GeoData stored somewhere else
 func (idx *S2PointIdx) PointIndex(lat, lng float64, id GeoID) ([]byte, error) {
+	return idx.PointIndexContext(context.Background(), lat, lng, id)
+}
+
+// PointIndexContext is PointIndex with a context
+func (idx *S2PointIdx) PointIndexContext(ctx context.Context, lat, lng float64, id GeoID) ([]byte, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
 	kv, err := idx.KVStore.Writer()
 	if err != nil {
 		return nil, err
@@ -40,8 +110,13 @@ func (idx *S2PointIdx) PointIndex(lat, lng float64, id GeoID) ([]byte, error) {
 
 	k := idx.PointKey(lat, lng, id)
 	batch.Set(k, nil)
+	commit := idx.meta.add(batch, 1)
 
-	return k, kv.ExecuteBatch(batch)
+	if err := kv.ExecuteBatch(batch); err != nil {
+		return nil, err
+	}
+	commit()
+	return k, nil
 }
 
 // PointKey is returning the key generated for a position + id
@@ -72,174 +147,258 @@ func (idx *S2PointIdx) GeoPointKey(gd *geodata.GeoData, id GeoID) ([]byte, error
 // it's not storing GeoData itself but only the geo cell l30 of the point
 // id is the key referring to the GeoData stored somewhere else
 func (idx *S2PointIdx) GeoPointIndex(gd *geodata.GeoData, id GeoID) ([]byte, error) {
+	return idx.GeoPointIndexContext(context.Background(), gd, id)
+}
+
+// GeoPointIndexContext is GeoPointIndex with a context
+func (idx *S2PointIdx) GeoPointIndexContext(ctx context.Context, gd *geodata.GeoData, id GeoID) ([]byte, error) {
 	if gd.Geometry.Type != geodata.Geometry_POINT {
 		return nil, errors.New("only points are supported")
 	}
 
-	return idx.PointIndex(gd.Geometry.Coordinates[1], gd.Geometry.Coordinates[0], id)
+	return idx.PointIndexContext(ctx, gd.Geometry.Coordinates[1], gd.Geometry.Coordinates[0], id)
 }
 
 // GeoIdsAtCell returns all GeoData keys contained in the cell
 func (idx *S2PointIdx) GeoIdsAtCell(c s2.CellID) ([]GeoID, error) {
-	// add the prefix to the queried key
-	start := make([]byte, len(idx.prefix))
-	copy(start, idx.prefix)
-	start = append(start, itob(uint64(c.RangeMin()))...)
-	stop := make([]byte, len(idx.prefix))
-	copy(stop, idx.prefix)
-	stop = append(stop, itob(uint64(c.RangeMax()))...)
+	return idx.GeoIdsAtCellContext(context.Background(), c)
+}
 
+// GeoIdsAtCellContext is GeoIdsAtCell with a context
+func (idx *S2PointIdx) GeoIdsAtCellContext(ctx context.Context, c s2.CellID) ([]GeoID, error) {
 	var res []GeoID
-
-	kv, err := idx.Reader()
+	_, err := idx.streamGeoIds(ctx, []s2.CellID{c}, nil, nil, func(id GeoID) bool {
+		res = append(res, id)
+		return true
+	})
 	if err != nil {
 		return nil, err
 	}
+	return res, nil
+}
 
-	// iterate entries with cell's prefix
-	iter := kv.RangeIterator(start, stop)
-	defer iter.Close()
-	for {
-		kid, _, ok := iter.Current()
-		if !ok {
-			break
-		}
-		_, id, err := idx.keyToValues(kid)
-		if err != nil {
-			return nil, errors.Wrap(err, "read back failed key from db")
-		}
+// GeoIdsAtCells returns all GeoData keys contained in the cells, without duplicates
+func (idx *S2PointIdx) GeoIdsAtCells(cells []s2.CellID) ([]GeoID, error) {
+	return idx.GeoIdsAtCellsContext(context.Background(), cells)
+}
 
-		res = append(res, id)
-		iter.Next()
+// GeoIdsAtCellsContext is GeoIdsAtCells with a context
+func (idx *S2PointIdx) GeoIdsAtCellsContext(ctx context.Context, cells []s2.CellID) ([]GeoID, error) {
+	ranges := make([]keyRange, len(cells))
+	for i, c := range cells {
+		ranges[i] = leafKeyRange(idx.prefix, c)
 	}
 
-	return res, nil
+	return collectRanges(ctx, idx.KVStore, idx.prefix, ranges, idx.workers, func(k, _ []byte) (GeoID, bool, error) {
+		_, id, err := idx.keyToValues(k)
+		return id, err == nil, err
+	})
 }
 
-// GeoIdsAtCells returns all GeoData keys contained in the cells, without duplicates
-func (idx *S2PointIdx) GeoIdsAtCells(cells []s2.CellID) ([]GeoID, error) {
-	m := make(map[string]struct{})
+// StreamGeoIdsAtCells streams the GeoData keys contained in the cells in key order
+func (idx *S2PointIdx) StreamGeoIdsAtCells(cells []s2.CellID, opts *QueryOptions, fn GeoIDFunc) (Cursor, error) {
+	return idx.StreamGeoIdsAtCellsContext(context.Background(), cells, opts, fn)
+}
 
-	for _, c := range cells {
-		ids, err := idx.GeoIdsAtCell(c)
-		if err != nil {
-			return nil, errors.Wrap(err, "fetching geo ids from cells failed")
-		}
-		for _, id := range ids {
-			m[string(id)] = struct{}{}
-		}
+// StreamGeoIdsAtCellsContext is StreamGeoIdsAtCells with a context
+func (idx *S2PointIdx) StreamGeoIdsAtCellsContext(ctx context.Context, cells []s2.CellID, opts *QueryOptions, fn GeoIDFunc) (Cursor, error) {
+	return idx.streamGeoIds(ctx, cells, nil, opts, fn)
+}
+
+// StreamGeoIdsRegionQuery streams the GeoID found in the index inside region in key order
+// points are exactly filtered against the region
+func (idx *S2PointIdx) StreamGeoIdsRegionQuery(region s2.Region, opts *QueryOptions, fn GeoIDFunc) (Cursor, error) {
+	return idx.StreamGeoIdsRegionQueryContext(context.Background(), region, opts, fn)
+}
+
+// StreamGeoIdsRegionQueryContext is StreamGeoIdsRegionQuery with a context
+func (idx *S2PointIdx) StreamGeoIdsRegionQueryContext(ctx context.Context, region s2.Region, opts *QueryOptions, fn GeoIDFunc) (Cursor, error) {
+	cu := idx.cover.covering(region)
+	return idx.streamGeoIds(ctx, cu, region, opts, fn)
+}
+
+// streamGeoIds streams the ids found in cells, filtered by region if not nil
+func (idx *S2PointIdx) streamGeoIds(ctx context.Context, cells []s2.CellID, region s2.Region, opts *QueryOptions, fn GeoIDFunc) (Cursor, error) {
+	ranges := make([]keyRange, len(cells))
+	for i, c := range cells {
+		ranges[i] = leafKeyRange(idx.prefix, c)
 	}
 
-	res := make([]GeoID, len(m))
-	var i int
-	for k := range m {
-		res[i] = []byte(k)
-		i++
+	kv, err := idx.Reader()
+	if err != nil {
+		return "", err
 	}
+	defer kv.Close()
 
-	return res, nil
+	return scanRanges(ctx, kv, idx.prefix, ranges, opts, func(k, _ []byte) (GeoID, bool, error) {
+		c, id, err := idx.keyToValues(k)
+		if err != nil {
+			return nil, false, err
+		}
+		if region != nil && !region.ContainsPoint(c.Point()) {
+			return nil, false, nil
+		}
+		return id, true, nil
+	}, fn)
 }
 
 // GeoIdsRadiusQuery returns the GeoID found in the index inside radius
 func (idx *S2PointIdx) GeoIdsRadiusQuery(lat, lng, radius float64) ([]GeoID, error) {
+	return idx.GeoIdsRadiusQueryContext(context.Background(), lat, lng, radius)
+}
+
+// GeoIdsRadiusQueryContext is GeoIdsRadiusQuery with a context
+func (idx *S2PointIdx) GeoIdsRadiusQueryContext(ctx context.Context, lat, lng, radius float64) ([]GeoID, error) {
 	center := s2.PointFromLatLng(s2.LatLngFromDegrees(lat, lng))
 	cap := s2.CapFromCenterArea(center, s2RadialAreaMeters(radius))
-	coverer := &s2.RegionCoverer{MaxLevel: 14, MaxCells: 8}
-	cu := coverer.Covering(cap)
-
-	kv, err := idx.Reader()
-	defer kv.Close()
-	if err != nil {
-		return nil, err
-	}
+	return idx.GeoIdsRegionQueryContext(ctx, cap)
+}
 
-	var res []GeoID
+// GeoIdsRectQuery query over rect ur upper right bl bottom left
+func (idx *S2PointIdx) GeoIdsRectQuery(urlat, urlng, bllat, bllng float64) ([]GeoID, error) {
+	return idx.GeoIdsRectQueryContext(context.Background(), urlat, urlng, bllat, bllng)
+}
 
-	// we range over cover to lookup for points (cell l30) and filter them in place
-	for _, coverCell := range cu {
-		start := make([]byte, len(idx.prefix))
-		copy(start, idx.prefix)
-		start = append(start, itob(uint64(coverCell.RangeMin()))...)
-		stop := make([]byte, len(idx.prefix))
-		copy(stop, idx.prefix)
-		stop = append(stop, itob(uint64(coverCell.RangeMax()))...)
-
-		// iterate entries with cell's prefix
-		iter := kv.RangeIterator(start, stop)
-
-		for {
-			kid, _, ok := iter.Current()
-			if !ok {
-				break
-			}
+// GeoIdsRectQueryContext is GeoIdsRectQuery with a context
+func (idx *S2PointIdx) GeoIdsRectQueryContext(ctx context.Context, urlat, urlng, bllat, bllng float64) ([]GeoID, error) {
+	rect := s2.RectFromLatLng(s2.LatLngFromDegrees(bllat, bllng))
+	rect = rect.AddPoint(s2.LatLngFromDegrees(urlat, urlng))
+	return idx.GeoIdsRegionQueryContext(ctx, rect)
+}
 
-			kid = append([]byte(nil), kid...)
+// GeoIdsGeoDataQuery returns the GeoID found in the index inside the geometry of gd
+func (idx *S2PointIdx) GeoIdsGeoDataQuery(gd *geodata.GeoData) ([]GeoID, error) {
+	return idx.GeoIdsGeoDataQueryContext(context.Background(), gd)
+}
 
-			c, id, err := idx.keyToValues(kid)
-			if err != nil {
-				return nil, errors.Wrap(err, "read back failed key from db")
-			}
+// GeoIdsGeoDataQueryContext is GeoIdsGeoDataQuery with a context
+func (idx *S2PointIdx) GeoIdsGeoDataQueryContext(ctx context.Context, gd *geodata.GeoData) ([]GeoID, error) {
+	region, err := geodata.GeoDataToRegion(gd)
+	if err != nil {
+		return nil, errors.Wrap(err, "can't query with this geodata")
+	}
+	return idx.GeoIdsRegionQueryContext(ctx, region)
+}
 
-			// filter in place
-			if cap.ContainsPoint(c.Point()) {
-				res = append(res, id)
-			}
+// GeoIdsRegionQuery returns the GeoID found in the index inside region
+// points are exactly filtered against the region
+func (idx *S2PointIdx) GeoIdsRegionQuery(region s2.Region) ([]GeoID, error) {
+	return idx.GeoIdsRegionQueryContext(context.Background(), region)
+}
 
-			iter.Next()
-		}
-		iter.Close()
+// GeoIdsRegionQueryContext is GeoIdsRegionQuery with a context
+func (idx *S2PointIdx) GeoIdsRegionQueryContext(ctx context.Context, region s2.Region) ([]GeoID, error) {
+	var res []GeoID
+	_, err := idx.StreamGeoIdsRegionQueryContext(ctx, region, nil, func(id GeoID) bool {
+		res = append(res, id)
+		return true
+	})
+	if err != nil {
+		return nil, err
 	}
 	return res, nil
 }
 
-// GeoIdsRectQuery query over rect ur upper right bl bottom left
-func (idx *S2PointIdx) GeoIdsRectQuery(urlat, urlng, bllat, bllng float64) ([]GeoID, error) {
-	rect := s2.RectFromLatLng(s2.LatLngFromDegrees(bllat, bllng))
-	rect = rect.AddPoint(s2.LatLngFromDegrees(urlat, urlng))
-	coverer := &s2.RegionCoverer{MaxLevel: 14, MaxCells: 8}
-	cu := coverer.Covering(rect)
+// GeoIDDistance is a GeoID with its distance in meters to a queried point
+type GeoIDDistance struct {
+	ID       GeoID
+	Distance float64
+}
 
-	var res []GeoID
+// GeoIdsNearest returns the k nearest GeoID to lat, lng within maxDistance meters,
+// ordered by great-circle distance
+// the search scans growing rings around the point and stops as soon as
+// k results are proven to be the closest
+func (idx *S2PointIdx) GeoIdsNearest(lat, lng float64, k int, maxDistance float64) ([]GeoIDDistance, error) {
+	return idx.GeoIdsNearestContext(context.Background(), lat, lng, k, maxDistance)
+}
+
+// GeoIdsNearestContext is GeoIdsNearest with a context
+func (idx *S2PointIdx) GeoIdsNearestContext(ctx context.Context, lat, lng float64, k int, maxDistance float64) ([]GeoIDDistance, error) {
+	if k <= 0 {
+		return nil, errors.New("invalid k")
+	}
+	if maxDistance <= 0 {
+		return nil, errors.New("invalid max distance")
+	}
+
+	center := s2.PointFromLatLng(s2.LatLngFromDegrees(lat, lng))
 
 	kv, err := idx.Reader()
-	defer kv.Close()
 	if err != nil {
 		return nil, err
 	}
+	defer kv.Close()
 
-	// we range over cover to lookup for points (cell l30) and filter them in place
-	for _, coverCell := range cu {
-		start := make([]byte, len(idx.prefix))
-		copy(start, idx.prefix)
-		start = append(start, itob(uint64(coverCell.RangeMin()))...)
-		stop := make([]byte, len(idx.prefix))
-		copy(stop, idx.prefix)
-		stop = append(stop, itob(uint64(coverCell.RangeMax()))...)
-
-		// iterate entries with cell's prefix
-		iter := kv.RangeIterator(start, stop)
-		for {
-			kid, _, ok := iter.Current()
-			if !ok {
-				break
-			}
-			kid = append([]byte(nil), kid...)
+	var res []GeoIDDistance
+	var scanned s2.CellUnion
 
-			c, id, err := idx.keyToValues(kid)
-			if err != nil {
-				return nil, errors.Wrap(err, "read back failed key from db")
+	radius := math.Min(nearestStartRadius, maxDistance)
+	for {
+		cap := s2.CapFromCenterAngle(center, metersToAngle(radius))
+		cu := idx.cover.covering(cap)
+
+		// only scan the ring not already scanned
+		ring := s2.CellUnionFromDifference(cu, scanned)
+		for _, coverCell := range ring {
+			if err := ctx.Err(); err != nil {
+				return nil, err
 			}
 
-			// filter in place
-			//TODO: find a CointainsPoint interface to factorize code with radius
-			if rect.ContainsPoint(c.Point()) {
-				res = append(res, id)
+			start := make([]byte, len(idx.prefix))
+			copy(start, idx.prefix)
+			start = append(start, itob(uint64(coverCell.RangeMin()))...)
+			stop := make([]byte, len(idx.prefix))
+			copy(stop, idx.prefix)
+			stop = append(stop, itob(uint64(coverCell.RangeMax())+1)...)
+
+			iter := kv.RangeIterator(start, stop)
+			for {
+				if err := ctx.Err(); err != nil {
+					iter.Close()
+					return nil, err
+				}
+
+				kid, _, ok := iter.Current()
+				if !ok {
+					break
+				}
+				kid = append([]byte(nil), kid...)
+
+				c, id, err := idx.keyToValues(kid)
+				if err != nil {
+					iter.Close()
+					return nil, errors.Wrap(err, "read back failed key from db")
+				}
+
+				d := angleToMeters(center.Distance(c.Point()))
+				if d <= maxDistance {
+					res = append(res, GeoIDDistance{ID: id, Distance: d})
+				}
+
+				iter.Next()
 			}
+			iter.Close()
+		}
+		scanned = s2.CellUnionFromUnion(scanned, ring)
 
-			iter.Next()
+		sort.SliceStable(res, func(i, j int) bool { return res[i].Distance < res[j].Distance })
+		if len(res) > k {
+			res = res[:k]
 		}
-		iter.Close()
+
+		// every point within radius has been scanned
+		// so the k found are the closest if the farthest is inside radius
+		if len(res) == k && res[k-1].Distance <= radius {
+			break
+		}
+
+		if radius >= maxDistance {
+			break
+		}
+		radius = math.Min(radius*2, maxDistance)
 	}
+
 	return res, nil
 }
 
@@ -92,3 +92,70 @@ func TestPointGeoCovering(t *testing.T) {
 	t.Log(c.ToToken())
 	require.EqualValues(t, c, quebecCellL30ID)
 }
+
+func TestPointGeoNearest(t *testing.T) {
+	s := openStore(t)
+	defer cleanup(t, s)
+
+	idx := NewS2PointIdx(s, []byte("NEAR"))
+
+	// points going north from quebec every ~111m
+	for i := 0; i < 20; i++ {
+		_, err := idx.PointIndex(quebec[1]+float64(i)*0.001, quebec[0], []byte{byte('a' + i)})
+		require.NoError(t, err)
+	}
+
+	res, err := idx.GeoIdsNearest(quebec[1]+0.0052, quebec[0], 3, 10000)
+	require.NoError(t, err)
+	require.Len(t, res, 3)
+	require.Equal(t, GeoID("f"), res[0].ID)
+	require.Equal(t, GeoID("g"), res[1].ID)
+	require.Equal(t, GeoID("e"), res[2].ID)
+	require.InDelta(t, 22, res[0].Distance, 1)
+	require.True(t, res[0].Distance <= res[1].Distance && res[1].Distance <= res[2].Distance)
+
+	// max distance excludes points
+	res, err = idx.GeoIdsNearest(quebec[1]-0.01, quebec[0], 3, 1200)
+	require.NoError(t, err)
+	require.Len(t, res, 1)
+	require.Equal(t, GeoID("a"), res[0].ID)
+
+	// far away a big radius is needed
+	res, err = idx.GeoIdsNearest(48.850, 2.348, 1, 6000*1000)
+	require.NoError(t, err)
+	require.Len(t, res, 1)
+	require.Equal(t, GeoID("t"), res[0].ID)
+}
+
+func TestPointGeoRegionQuery(t *testing.T) {
+	s := openStore(t)
+	defer cleanup(t, s)
+
+	idx := NewS2PointIdx(s, []byte("REGION"))
+
+	// inside the ring polygon
+	_, err := idx.PointIndex(46.798, -71.228, []byte("inside"))
+	require.NoError(t, err)
+
+	// close but outside
+	_, err = idx.PointIndex(46.7955, -71.2250, []byte("outside"))
+	require.NoError(t, err)
+
+	zone := &geodata.GeoData{
+		Geometry: &geodata.Geometry{
+			Coordinates: ring,
+			Type:        geodata.Geometry_POLYGON,
+		},
+	}
+
+	res, err := idx.GeoIdsGeoDataQuery(zone)
+	require.NoError(t, err)
+	require.Len(t, res, 1)
+	require.Equal(t, GeoID("inside"), res[0])
+
+	region, err := geodata.GeoDataToRegion(zone)
+	require.NoError(t, err)
+	res, err = idx.GeoIdsRegionQuery(region)
+	require.NoError(t, err)
+	require.Len(t, res, 1)
+}
@@ -2,6 +2,7 @@ package index
 
 import (
 	"bytes"
+	"context"
 	"encoding/binary"
 	"math"
 	"time"
@@ -12,6 +13,12 @@ import (
 	"github.com/pkg/errors"
 )
 
+// maxRegionCells is the maximum number of cells at the index level a region is expanded to
+const maxRegionCells = 1 << 16
+
+// ErrRegionTooLarge is returned when a region covers too many cells at the index level
+var ErrRegionTooLarge = errors.New("region covers too many cells at the index level")
+
 // S2FlatTimeIdx a flat S2 region cover time to index points & polygons
 type S2FlatTimeIdx struct {
 	// s2 level to index
@@ -20,18 +27,74 @@ type S2FlatTimeIdx struct {
 	// prefix or bucket for the keys
 	prefix []byte
 
+	// number of goroutines used by multi cells lookups
+	workers int
+
+	// parameters used to cover the queried regions
+	cover CoverParams
+
+	// persisted metadata, nil if not opened with OpenS2FlatTimeIdx or OpenOrCreateS2FlatTimeIdx
+	meta *metadata
+
 	store.KVStore
 }
 
 // NewS2FlatTimeIdx returns a new indexer
-func NewS2FlatTimeIdx(s store.KVStore, prefix []byte, level int) *S2FlatTimeIdx {
+// queried regions are covered with cells at level by default, see the cover options,
+// coarser cells are scanned for all times, or expanded to their children at level for the time ordered results
+// the index metadata is not read nor written, see OpenOrCreateS2FlatTimeIdx
+func NewS2FlatTimeIdx(s store.KVStore, prefix []byte, level int, opts ...Option) *S2FlatTimeIdx {
+	o := newOptions(CoverParams{MinLevel: level, MaxLevel: level}, opts)
 	return &S2FlatTimeIdx{
 		KVStore: s,
 		prefix:  prefix,
 		level:   level,
+		workers: o.workers,
+		cover:   o.cover,
 	}
 }
 
+// OpenS2FlatTimeIdx returns an indexer after validating the metadata stored under prefix
+// returns ErrNoMetadata if the index was not created or ErrMetadataMismatch if it was built with another level
+func OpenS2FlatTimeIdx(s store.KVStore, prefix []byte, level int, opts ...Option) (*S2FlatTimeIdx, error) {
+	return openS2FlatTimeIdx(s, prefix, level, false, opts)
+}
+
+// OpenOrCreateS2FlatTimeIdx is OpenS2FlatTimeIdx creating the metadata if missing
+func OpenOrCreateS2FlatTimeIdx(s store.KVStore, prefix []byte, level int, opts ...Option) (*S2FlatTimeIdx, error) {
+	return openS2FlatTimeIdx(s, prefix, level, true, opts)
+}
+
+func openS2FlatTimeIdx(s store.KVStore, prefix []byte, level int, create bool, opts []Option) (*S2FlatTimeIdx, error) {
+	m, err := openMetadata(s, prefix, IndexMetadata{Type: S2FlatTimeIdxType, Level: level}, create)
+	if err != nil {
+		return nil, err
+	}
+	idx := NewS2FlatTimeIdx(s, prefix, level, opts...)
+	idx.meta = m
+	return idx, nil
+}
+
+// Metadata returns the persisted metadata, nil if the index was not opened with OpenS2FlatTimeIdx or OpenOrCreateS2FlatTimeIdx
+func (idx *S2FlatTimeIdx) Metadata() *IndexMetadata {
+	return idx.meta.get()
+}
+
+// WithCover returns a copy of the index covering the queried regions using p,
+// to override the index cover parameters for some queries
+func (idx *S2FlatTimeIdx) WithCover(p CoverParams) *S2FlatTimeIdx {
+	c := *idx
+	c.cover = p
+	return &c
+}
+
+// SetScanWorkers sets the number of goroutines scanning the cells in GeoTimeIdsAtCells and the queries using it
+// 0 or 1, the default, scans all the cells from a single snapshot,
+// more workers trade that consistency for throughput as each one opens its own reader
+func (idx *S2FlatTimeIdx) SetScanWorkers(n int) {
+	idx.workers = n
+}
+
 // GeoTimeIndex is indexing the data by time and geo position
 // it's not storing GeoData itself but only the geo index of the cover
 // id is the key referring to the GeoData stored somewhere else
@@ -39,11 +102,20 @@ func NewS2FlatTimeIdx(s store.KVStore, prefix []byte, level int) *S2FlatTimeIdx
 // could be a user position or an effect zone
 // t is the time when the event end (can be in the future)
 func (idx *S2FlatTimeIdx) GeoTimeIndex(gd *geodata.GeoData, t time.Time, id GeoID) error {
+	return idx.GeoTimeIndexContext(context.Background(), gd, t, id)
+}
+
+// GeoTimeIndexContext is GeoTimeIndex with a context
+func (idx *S2FlatTimeIdx) GeoTimeIndexContext(ctx context.Context, gd *geodata.GeoData, t time.Time, id GeoID) error {
 	cu, err := idx.Covering(gd)
 	if err != nil {
 		return errors.Wrap(err, "generating cover failed")
 	}
 
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
 	kv, err := idx.KVStore.Writer()
 	if err != nil {
 		return err
@@ -59,8 +131,13 @@ func (idx *S2FlatTimeIdx) GeoTimeIndex(gd *geodata.GeoData, t time.Time, id GeoI
 		//TODO: optional set value is the full s2 cellid in case of a point
 		batch.Set(k, nil)
 	}
+	commit := idx.meta.add(batch, len(cu))
 
-	return kv.ExecuteBatch(batch)
+	if err := kv.ExecuteBatch(batch); err != nil {
+		return err
+	}
+	commit()
+	return nil
 }
 
 // Covering is generating the cover of a GeoData
@@ -72,49 +149,122 @@ func (idx *S2FlatTimeIdx) Covering(gd *geodata.GeoData) (s2.CellUnion, error) {
 // GeoTimeIdsRadiusQuery query over radius in meters within time range
 // scan from future to past
 func (idx *S2FlatTimeIdx) GeoTimeIdsRadiusQuery(from time.Time, to time.Time, lat, lng float64, radius float64) ([]GeoID, error) {
+	return idx.GeoTimeIdsRadiusQueryContext(context.Background(), from, to, lat, lng, radius)
+}
+
+// GeoTimeIdsRadiusQueryContext is GeoTimeIdsRadiusQuery with a context
+func (idx *S2FlatTimeIdx) GeoTimeIdsRadiusQueryContext(ctx context.Context, from time.Time, to time.Time, lat, lng float64, radius float64) ([]GeoID, error) {
 	center := s2.PointFromLatLng(s2.LatLngFromDegrees(lat, lng))
 	cap := s2.CapFromCenterArea(center, s2RadialAreaMeters(radius))
-	coverer := &s2.RegionCoverer{MinLevel: idx.level, MaxLevel: idx.level}
-	cu := coverer.Covering(cap)
-	return idx.GeoTimeIdsAtCells(cu, from, to)
+	return idx.GeoTimeIdsRegionQueryContext(ctx, from, to, cap)
 }
 
 // GeoTimeIdsRectQuery query over rect ur upper right bl bottom left
 // scan from future to past
 func (idx *S2FlatTimeIdx) GeoTimeIdsRectQuery(from time.Time, to time.Time, urlat, urlng, bllat, bllng float64) ([]GeoID, error) {
+	return idx.GeoTimeIdsRectQueryContext(context.Background(), from, to, urlat, urlng, bllat, bllng)
+}
+
+// GeoTimeIdsRectQueryContext is GeoTimeIdsRectQuery with a context
+func (idx *S2FlatTimeIdx) GeoTimeIdsRectQueryContext(ctx context.Context, from time.Time, to time.Time, urlat, urlng, bllat, bllng float64) ([]GeoID, error) {
 	rect := s2.RectFromLatLng(s2.LatLngFromDegrees(bllat, bllng))
 	rect = rect.AddPoint(s2.LatLngFromDegrees(urlat, urlng))
-	coverer := &s2.RegionCoverer{MinLevel: idx.level, MaxLevel: idx.level}
-	cu := coverer.Covering(rect)
-	return idx.GeoTimeIdsAtCells(cu, from, to)
+	return idx.GeoTimeIdsRegionQueryContext(ctx, from, to, rect)
 }
 
-// GeoTimeIdsAtCells returns all GeoData keys contained in the cells within time range, without duplicates
-func (idx *S2FlatTimeIdx) GeoTimeIdsAtCells(cells []s2.CellID, from time.Time, to time.Time) ([]GeoID, error) {
-	m := make(map[string]struct{})
+// GeoTimeIdsRegionQuery query over the cover of region within time range
+// scan from future to past
+func (idx *S2FlatTimeIdx) GeoTimeIdsRegionQuery(from time.Time, to time.Time, region s2.Region) ([]GeoID, error) {
+	return idx.GeoTimeIdsRegionQueryContext(context.Background(), from, to, region)
+}
 
-	for _, c := range cells {
-		ids, err := idx.GeoTimeIdsAtCell(c, from, to)
-		if err != nil {
-			return nil, errors.Wrap(err, "fetching geo ids from cells failed")
-		}
-		for _, id := range ids {
-			m[string(id)] = struct{}{}
-		}
+// GeoTimeIdsRegionQueryContext is GeoTimeIdsRegionQuery with a context
+func (idx *S2FlatTimeIdx) GeoTimeIdsRegionQueryContext(ctx context.Context, from time.Time, to time.Time, region s2.Region) ([]GeoID, error) {
+	return collectRanges(ctx, idx.KVStore, idx.prefix, idx.regionRanges(region), idx.workers, idx.timeDecoder(from, to))
+}
+
+// GeoTimeIdsGeoDataQuery query over the cover of gd within time range
+// scan from future to past
+func (idx *S2FlatTimeIdx) GeoTimeIdsGeoDataQuery(from time.Time, to time.Time, gd *geodata.GeoData) ([]GeoID, error) {
+	return idx.GeoTimeIdsGeoDataQueryContext(context.Background(), from, to, gd)
+}
+
+// GeoTimeIdsGeoDataQueryContext is GeoTimeIdsGeoDataQuery with a context
+func (idx *S2FlatTimeIdx) GeoTimeIdsGeoDataQueryContext(ctx context.Context, from time.Time, to time.Time, gd *geodata.GeoData) ([]GeoID, error) {
+	cu, err := idx.Covering(gd)
+	if err != nil {
+		return nil, errors.Wrap(err, "generating cover failed")
 	}
+	return idx.GeoTimeIdsAtCellsContext(ctx, cu, from, to)
+}
 
-	res := make([]GeoID, len(m))
-	var i int
-	for k := range m {
-		res[i] = []byte(k)
-		i++
+// StreamGeoTimeIdsAtCells streams the GeoData keys contained in the cells within time range
+// in key order, cell by cell from future to past
+// an id indexed in several of the cells is streamed once per cell
+func (idx *S2FlatTimeIdx) StreamGeoTimeIdsAtCells(cells []s2.CellID, from time.Time, to time.Time, opts *QueryOptions, fn GeoIDFunc) (Cursor, error) {
+	return idx.StreamGeoTimeIdsAtCellsContext(context.Background(), cells, from, to, opts, fn)
+}
+
+// StreamGeoTimeIdsAtCellsContext is StreamGeoTimeIdsAtCells with a context
+func (idx *S2FlatTimeIdx) StreamGeoTimeIdsAtCellsContext(ctx context.Context, cells []s2.CellID, from time.Time, to time.Time, opts *QueryOptions, fn GeoIDFunc) (Cursor, error) {
+	ranges, err := idx.cellsRanges(cells, from, to)
+	if err != nil {
+		return "", err
 	}
 
-	return res, nil
+	kv, err := idx.Reader()
+	if err != nil {
+		return "", err
+	}
+	defer kv.Close()
+
+	return scanRanges(ctx, kv, idx.prefix, ranges, opts, func(k, _ []byte) (GeoID, bool, error) {
+		_, _, id, err := idx.keyToValues(k)
+		return id, err == nil, err
+	}, fn)
+}
+
+// StreamGeoTimeIdsRegionQuery streams the GeoID found over the cover of region within time range
+func (idx *S2FlatTimeIdx) StreamGeoTimeIdsRegionQuery(from time.Time, to time.Time, region s2.Region, opts *QueryOptions, fn GeoIDFunc) (Cursor, error) {
+	return idx.StreamGeoTimeIdsRegionQueryContext(context.Background(), from, to, region, opts, fn)
+}
+
+// StreamGeoTimeIdsRegionQueryContext is StreamGeoTimeIdsRegionQuery with a context
+func (idx *S2FlatTimeIdx) StreamGeoTimeIdsRegionQueryContext(ctx context.Context, from time.Time, to time.Time, region s2.Region, opts *QueryOptions, fn GeoIDFunc) (Cursor, error) {
+	kv, err := idx.Reader()
+	if err != nil {
+		return "", err
+	}
+	defer kv.Close()
+
+	return scanRanges(ctx, kv, idx.prefix, idx.regionRanges(region), opts, idx.timeDecoder(from, to), fn)
+}
+
+// GeoTimeIdsAtCells returns all GeoData keys contained in the cells within time range, without duplicates
+func (idx *S2FlatTimeIdx) GeoTimeIdsAtCells(cells []s2.CellID, from time.Time, to time.Time) ([]GeoID, error) {
+	return idx.GeoTimeIdsAtCellsContext(context.Background(), cells, from, to)
+}
+
+// GeoTimeIdsAtCellsContext is GeoTimeIdsAtCells with a context
+func (idx *S2FlatTimeIdx) GeoTimeIdsAtCellsContext(ctx context.Context, cells []s2.CellID, from time.Time, to time.Time) ([]GeoID, error) {
+	ranges, err := idx.cellsRanges(cells, from, to)
+	if err != nil {
+		return nil, err
+	}
+
+	return collectRanges(ctx, idx.KVStore, idx.prefix, ranges, idx.workers, func(k, _ []byte) (GeoID, bool, error) {
+		_, _, id, err := idx.keyToValues(k)
+		return id, err == nil, err
+	})
 }
 
 // GeoTimeIdsAtCell returns all GeoData keys contained in the cell from time from  to time to
 func (idx *S2FlatTimeIdx) GeoTimeIdsAtCell(c s2.CellID, from time.Time, to time.Time) ([]GeoID, error) {
+	return idx.GeoTimeIdsAtCellContext(context.Background(), c, from, to)
+}
+
+// GeoTimeIdsAtCellContext is GeoTimeIdsAtCell with a context
+func (idx *S2FlatTimeIdx) GeoTimeIdsAtCellContext(ctx context.Context, c s2.CellID, from time.Time, to time.Time) ([]GeoID, error) {
 	if c.Level() != idx.level {
 		return nil, errors.New("requested a cellID with a different level than the index")
 	}
@@ -128,14 +278,22 @@ func (idx *S2FlatTimeIdx) GeoTimeIdsAtCell(c s2.CellID, from time.Time, to time.
 	if err != nil {
 		return nil, err
 	}
+	defer kv.Close()
 
 	// iterate entries with cell's prefix
 	iter := kv.RangeIterator(startKey, stopKey)
+	defer iter.Close()
 	for {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+
 		kid, _, ok := iter.Current()
 		if !ok {
 			break
 		}
+		kid = append([]byte(nil), kid...)
+
 		_, _, id, err := idx.keyToValues(kid)
 		if err != nil {
 			return nil, errors.Wrap(err, "read back failed key from db")
@@ -148,6 +306,61 @@ func (idx *S2FlatTimeIdx) GeoTimeIdsAtCell(c s2.CellID, from time.Time, to time.
 	return res, nil
 }
 
+// cellsRanges returns the key ranges of cells within time range
+func (idx *S2FlatTimeIdx) cellsRanges(cells []s2.CellID, from time.Time, to time.Time) ([]keyRange, error) {
+	ranges := make([]keyRange, len(cells))
+	for i, c := range cells {
+		if c.Level() != idx.level {
+			return nil, errors.New("requested a cellID with a different level than the index")
+		}
+		ranges[i] = keyRange{start: idx.timePrefixKey(c, from), end: idx.timePrefixKey(c, to)}
+	}
+	return ranges, nil
+}
+
+// regionRanges returns the key ranges of the cover of region for all times
+// a coarse cell is scanned as one range instead of being expanded to its children at the index level
+func (idx *S2FlatTimeIdx) regionRanges(region s2.Region) []keyRange {
+	cu := idx.cover.atMostLevel(idx.level).covering(region)
+	ranges := make([]keyRange, len(cu))
+	for i, c := range cu {
+		ranges[i] = levelKeyRange(idx.prefix, c, idx.level)
+	}
+	return ranges
+}
+
+// regionCells returns the cover of region expanded to the index level
+// ErrRegionTooLarge is returned above maxRegionCells cells
+func (idx *S2FlatTimeIdx) regionCells(region s2.Region) (s2.CellUnion, error) {
+	cu := idx.cover.atMostLevel(idx.level).covering(region)
+	var n int
+	for _, c := range cu {
+		n += 1 << uint(2*(idx.level-c.Level()))
+		if n > maxRegionCells {
+			return nil, ErrRegionTooLarge
+		}
+	}
+	cu.Denormalize(idx.level, 1)
+	return cu, nil
+}
+
+// timeDecoder returns a keyDecoder skipping the keys outside of the time range
+func (idx *S2FlatTimeIdx) timeDecoder(from time.Time, to time.Time) keyDecoder {
+	start := int64tob(math.MaxInt64 - from.UnixNano())
+	end := int64tob(math.MaxInt64 - to.UnixNano())
+	return func(k, _ []byte) (GeoID, bool, error) {
+		_, _, id, err := idx.keyToValues(k)
+		if err != nil {
+			return nil, false, err
+		}
+		ts := k[len(idx.prefix)+8 : len(idx.prefix)+16]
+		if bytes.Compare(ts, start) < 0 || bytes.Compare(ts, end) >= 0 {
+			return nil, false, nil
+		}
+		return id, true, nil
+	}
+}
+
 // valuesToKey returns the key for a triplets cell/time/id
 func (idx *S2FlatTimeIdx) valuesToKey(c s2.CellID, t time.Time, id GeoID) []byte {
 	k := idx.timePrefixKey(c, t)
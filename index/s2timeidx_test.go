@@ -1,11 +1,14 @@
 package index
 
 import (
+	"context"
 	"testing"
 
 	"time"
 
 	"github.com/akhenakh/oureadb/index/geodata"
+	"github.com/golang/geo/s2"
+	"github.com/pkg/errors"
 	"github.com/stretchr/testify/require"
 )
 
@@ -39,9 +42,91 @@ func TestPointGeoTimeStorage(t *testing.T) {
 	require.NoError(t, err)
 	require.Len(t, res, 1)
 
+	// Querying a rect
+	res, err = idx.GeoTimeIdsRectQuery(MaxGeoTime, MinGeoTime, 48.86, 2.35, 48.85, 2.34)
+	require.NoError(t, err)
+	require.Len(t, res, 1)
+
+	// Querying the point itself
+	res, err = idx.GeoTimeIdsGeoDataQuery(MaxGeoTime, MinGeoTime, geo)
+	require.NoError(t, err)
+	require.Len(t, res, 1)
+
 	// Querying only in the past won't find anything
 	past := now.Add(-2 * time.Hour)
 	res, err = idx.GeoTimeIdsRadiusQuery(past, MinGeoTime, 48.850, 2.348, 2000)
 	require.NoError(t, err)
 	require.Len(t, res, 0)
 }
+
+func TestGeoTimeCancel(t *testing.T) {
+	s := openStore(t)
+	defer cleanup(t, s)
+
+	idx := NewS2FlatTimeIdx(s, []byte("TESTTIMEPREFIX"), s2Level)
+
+	geo := &geodata.GeoData{
+		Geometry: &geodata.Geometry{
+			Coordinates: paris,
+			Type:        geodata.Geometry_POINT,
+		},
+	}
+
+	err := idx.GeoTimeIndex(geo, time.Now(), []byte("MYTIMEPOINTID"))
+	require.NoError(t, err)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	_, err = idx.GeoTimeIdsRadiusQueryContext(ctx, MaxGeoTime, MinGeoTime, 48.850, 2.348, 2000)
+	require.Equal(t, context.Canceled, errors.Cause(err))
+
+	err = idx.GeoTimeIndexContext(ctx, geo, time.Now(), []byte("OTHER"))
+	require.Equal(t, context.Canceled, err)
+
+	_, err = idx.StreamGeoTimeIdsRegionQueryContext(ctx, MaxGeoTime, MinGeoTime, s2.CapFromPoint(s2.PointFromLatLng(s2.LatLngFromDegrees(paris[1], paris[0]))), nil, func(GeoID) bool { return true })
+	require.Equal(t, context.Canceled, err)
+}
+
+func TestGeoTimeLargeRegion(t *testing.T) {
+	s := openStore(t)
+	defer cleanup(t, s)
+
+	idx := NewS2FlatTimeIdx(s, []byte("TESTTIMEPREFIX"), s2Level, WithCoverLevels(4, s2Level), WithCoverMaxCells(8))
+
+	geo := &geodata.GeoData{
+		Geometry: &geodata.Geometry{
+			Coordinates: paris,
+			Type:        geodata.Geometry_POINT,
+		},
+	}
+	now := time.Now()
+	err := idx.GeoTimeIndex(geo, now, []byte("MYTIMEPOINTID"))
+	require.NoError(t, err)
+
+	// a 1000km radius is scanned with coarse cells ranges, not expanded to the index level
+	res, err := idx.GeoTimeIdsRadiusQuery(MaxGeoTime, MinGeoTime, 48.850, 2.348, 1000*1000)
+	require.NoError(t, err)
+	require.Len(t, res, 1)
+
+	// the time range still applies
+	res, err = idx.GeoTimeIdsRadiusQuery(now.Add(-time.Hour), MinGeoTime, 48.850, 2.348, 1000*1000)
+	require.NoError(t, err)
+	require.Len(t, res, 0)
+
+	var streamed []GeoID
+	_, err = idx.StreamGeoTimeIdsRegionQuery(MaxGeoTime, now.Add(-time.Minute), s2.CapFromCenterAngle(s2.PointFromLatLng(s2.LatLngFromDegrees(paris[1], paris[0])), metersToAngle(1000*1000)), nil, func(id GeoID) bool {
+		streamed = append(streamed, id)
+		return true
+	})
+	require.NoError(t, err)
+	require.Equal(t, []GeoID{GeoID("MYTIMEPOINTID")}, streamed)
+
+	counts, err := idx.CountAtLevelByTime(MaxGeoTime, MinGeoTime, s2.CapFromCenterAngle(s2.PointFromLatLng(s2.LatLngFromDegrees(paris[1], paris[0])), metersToAngle(1000*1000)), 4, 0)
+	require.NoError(t, err)
+	require.Len(t, counts, 1)
+
+	// the time ordered results need the cells at the index level
+	_, err = idx.GeoTimeResultsRadiusQuery(MaxGeoTime, MinGeoTime, 48.850, 2.348, 1000*1000, false)
+	require.Equal(t, ErrRegionTooLarge, err)
+}
@@ -0,0 +1,196 @@
+package index
+
+import (
+	"bytes"
+	"container/heap"
+	"context"
+	"time"
+
+	"github.com/akhenakh/oureadb/store"
+	"github.com/golang/geo/s2"
+	"github.com/pkg/errors"
+)
+
+// GeoTimeResult is an id found in a S2FlatTimeIdx with its event time and cell
+type GeoTimeResult struct {
+	ID   GeoID
+	Time time.Time
+	Cell s2.CellID
+}
+
+// GeoTimeResultsAtCells returns the results contained in the cells within time range
+// ordered from the newest to the oldest event across all cells
+// if latestOnly is true only the most recent event per id is returned
+func (idx *S2FlatTimeIdx) GeoTimeResultsAtCells(cells []s2.CellID, from time.Time, to time.Time, latestOnly bool) ([]GeoTimeResult, error) {
+	return idx.GeoTimeResultsAtCellsContext(context.Background(), cells, from, to, latestOnly)
+}
+
+// GeoTimeResultsAtCellsContext is GeoTimeResultsAtCells with a context
+func (idx *S2FlatTimeIdx) GeoTimeResultsAtCellsContext(ctx context.Context, cells []s2.CellID, from time.Time, to time.Time, latestOnly bool) ([]GeoTimeResult, error) {
+	var res []GeoTimeResult
+	err := idx.StreamGeoTimeResultsAtCellsContext(ctx, cells, from, to, latestOnly, func(r GeoTimeResult) bool {
+		res = append(res, r)
+		return true
+	})
+	return res, err
+}
+
+// GeoTimeResultsRadiusQuery query over radius in meters within time range
+// results are ordered from the newest to the oldest event
+func (idx *S2FlatTimeIdx) GeoTimeResultsRadiusQuery(from time.Time, to time.Time, lat, lng float64, radius float64, latestOnly bool) ([]GeoTimeResult, error) {
+	return idx.GeoTimeResultsRadiusQueryContext(context.Background(), from, to, lat, lng, radius, latestOnly)
+}
+
+// GeoTimeResultsRadiusQueryContext is GeoTimeResultsRadiusQuery with a context
+func (idx *S2FlatTimeIdx) GeoTimeResultsRadiusQueryContext(ctx context.Context, from time.Time, to time.Time, lat, lng float64, radius float64, latestOnly bool) ([]GeoTimeResult, error) {
+	center := s2.PointFromLatLng(s2.LatLngFromDegrees(lat, lng))
+	cap := s2.CapFromCenterArea(center, s2RadialAreaMeters(radius))
+	return idx.GeoTimeResultsRegionQueryContext(ctx, from, to, cap, latestOnly)
+}
+
+// GeoTimeResultsRegionQuery query over the cover of region within time range
+// results are ordered from the newest to the oldest event
+func (idx *S2FlatTimeIdx) GeoTimeResultsRegionQuery(from time.Time, to time.Time, region s2.Region, latestOnly bool) ([]GeoTimeResult, error) {
+	return idx.GeoTimeResultsRegionQueryContext(context.Background(), from, to, region, latestOnly)
+}
+
+// GeoTimeResultsRegionQueryContext is GeoTimeResultsRegionQuery with a context
+func (idx *S2FlatTimeIdx) GeoTimeResultsRegionQueryContext(ctx context.Context, from time.Time, to time.Time, region s2.Region, latestOnly bool) ([]GeoTimeResult, error) {
+	cu, err := idx.regionCells(region)
+	if err != nil {
+		return nil, err
+	}
+	return idx.GeoTimeResultsAtCellsContext(ctx, cu, from, to, latestOnly)
+}
+
+// StreamGeoTimeResultsAtCells streams the results contained in the cells within time range
+// from the newest to the oldest event, merging the cells scans
+// returning false from fn stops the scan
+func (idx *S2FlatTimeIdx) StreamGeoTimeResultsAtCells(cells []s2.CellID, from time.Time, to time.Time, latestOnly bool, fn func(GeoTimeResult) bool) error {
+	return idx.StreamGeoTimeResultsAtCellsContext(context.Background(), cells, from, to, latestOnly, fn)
+}
+
+// StreamGeoTimeResultsAtCellsContext is StreamGeoTimeResultsAtCells with a context
+func (idx *S2FlatTimeIdx) StreamGeoTimeResultsAtCellsContext(ctx context.Context, cells []s2.CellID, from time.Time, to time.Time, latestOnly bool, fn func(GeoTimeResult) bool) error {
+	for _, c := range cells {
+		if c.Level() != idx.level {
+			return errors.New("requested a cellID with a different level than the index")
+		}
+	}
+
+	kv, err := idx.Reader()
+	if err != nil {
+		return err
+	}
+	defer kv.Close()
+
+	h := &timeIterHeap{}
+	defer func() {
+		for _, ti := range *h {
+			ti.iter.Close()
+		}
+	}()
+
+	// one iterator per cell, all ordered from future to past
+	for _, c := range cells {
+		ti := &timeIter{iter: kv.RangeIterator(idx.timePrefixKey(c, from), idx.timePrefixKey(c, to))}
+		ok, err := idx.advance(ti)
+		if err != nil {
+			ti.iter.Close()
+			return err
+		}
+		if !ok {
+			ti.iter.Close()
+			continue
+		}
+		*h = append(*h, ti)
+	}
+	heap.Init(h)
+
+	seen := make(map[string]struct{})
+
+	for h.Len() > 0 {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		ti := (*h)[0]
+		r := ti.cur
+
+		ok, err := idx.advance(ti)
+		if err != nil {
+			return err
+		}
+		if ok {
+			heap.Fix(h, 0)
+		} else {
+			heap.Pop(h)
+			ti.iter.Close()
+		}
+
+		if latestOnly {
+			if _, ok := seen[string(r.ID)]; ok {
+				continue
+			}
+			seen[string(r.ID)] = struct{}{}
+		}
+
+		if !fn(r) {
+			return nil
+		}
+	}
+
+	return nil
+}
+
+// advance reads the current entry of ti into ti.cur then moves ti forward
+// returns false if ti is exhausted
+func (idx *S2FlatTimeIdx) advance(ti *timeIter) (bool, error) {
+	kid, _, ok := ti.iter.Current()
+	if !ok {
+		return false, nil
+	}
+	kid = append([]byte(nil), kid...)
+
+	c, t, id, err := idx.keyToValues(kid)
+	if err != nil {
+		return false, errors.Wrap(err, "read back failed key from db")
+	}
+	ti.cur = GeoTimeResult{ID: id, Time: t, Cell: c}
+	ti.iter.Next()
+	return true, nil
+}
+
+// timeIter is a cell iterator with its current result
+type timeIter struct {
+	iter store.KVIterator
+	cur  GeoTimeResult
+}
+
+// timeIterHeap is a heap of cell iterators, the newest current result on top
+type timeIterHeap []*timeIter
+
+func (h timeIterHeap) Len() int { return len(h) }
+
+func (h timeIterHeap) Less(i, j int) bool {
+	a, b := h[i].cur, h[j].cur
+	if !a.Time.Equal(b.Time) {
+		return a.Time.After(b.Time)
+	}
+	if a.Cell != b.Cell {
+		return a.Cell < b.Cell
+	}
+	return bytes.Compare(a.ID, b.ID) < 0
+}
+
+func (h timeIterHeap) Swap(i, j int) { h[i], h[j] = h[j], h[i] }
+
+func (h *timeIterHeap) Push(x interface{}) { *h = append(*h, x.(*timeIter)) }
+
+func (h *timeIterHeap) Pop() interface{} {
+	old := *h
+	n := len(old)
+	x := old[n-1]
+	*h = old[:n-1]
+	return x
+}
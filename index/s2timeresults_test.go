@@ -0,0 +1,67 @@
+package index
+
+import (
+	"testing"
+	"time"
+
+	"github.com/akhenakh/oureadb/index/geodata"
+	"github.com/golang/geo/s2"
+	"github.com/stretchr/testify/require"
+)
+
+func TestGeoTimeResults(t *testing.T) {
+	s := openStore(t)
+	defer cleanup(t, s)
+
+	idx := NewS2FlatTimeIdx(s, []byte("TESTRESULTS"), s2Level)
+
+	parisGeo := &geodata.GeoData{
+		Geometry: &geodata.Geometry{
+			Coordinates: paris,
+			Type:        geodata.Geometry_POINT,
+		},
+	}
+	quebecGeo := &geodata.GeoData{
+		Geometry: &geodata.Geometry{
+			Coordinates: quebec,
+			Type:        geodata.Geometry_POINT,
+		},
+	}
+
+	now := time.Now().Truncate(time.Second)
+
+	// the same vehicle moving between the 2 cells
+	require.NoError(t, idx.GeoTimeIndex(parisGeo, now.Add(-3*time.Minute), []byte("car")))
+	require.NoError(t, idx.GeoTimeIndex(quebecGeo, now.Add(-2*time.Minute), []byte("car")))
+	require.NoError(t, idx.GeoTimeIndex(parisGeo, now.Add(-1*time.Minute), []byte("car")))
+	require.NoError(t, idx.GeoTimeIndex(quebecGeo, now.Add(-4*time.Minute), []byte("bike")))
+
+	pc, err := idx.Covering(parisGeo)
+	require.NoError(t, err)
+	qc, err := idx.Covering(quebecGeo)
+	require.NoError(t, err)
+	cells := []s2.CellID{qc[0], pc[0]}
+
+	res, err := idx.GeoTimeResultsAtCells(cells, MaxGeoTime, MinGeoTime, false)
+	require.NoError(t, err)
+	require.Len(t, res, 4)
+
+	for i, exp := range []time.Duration{-1, -2, -3, -4} {
+		require.True(t, now.Add(exp*time.Minute).Equal(res[i].Time))
+	}
+	require.Equal(t, pc[0], res[0].Cell)
+	require.Equal(t, qc[0], res[1].Cell)
+	require.Equal(t, GeoID("bike"), res[3].ID)
+
+	res, err = idx.GeoTimeResultsAtCells(cells, MaxGeoTime, MinGeoTime, true)
+	require.NoError(t, err)
+	require.Len(t, res, 2)
+	require.Equal(t, GeoID("car"), res[0].ID)
+	require.Equal(t, pc[0], res[0].Cell)
+	require.Equal(t, GeoID("bike"), res[1].ID)
+
+	res, err = idx.GeoTimeResultsRadiusQuery(MaxGeoTime, MinGeoTime, paris[1], paris[0], 1000, true)
+	require.NoError(t, err)
+	require.Len(t, res, 1)
+	require.True(t, now.Add(-time.Minute).Equal(res[0].Time))
+}
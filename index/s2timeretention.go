@@ -0,0 +1,133 @@
+package index
+
+import (
+	"context"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// purgeBatchSize is the maximum number of keys deleted in one batch by PurgeBefore and the rebuilds
+var purgeBatchSize = 1000
+
+// PurgeBefore removes all the entries with an event time before t
+// keys are deleted in small batches so writers are not blocked
+// returns the number of removed keys
+func (idx *S2FlatTimeIdx) PurgeBefore(t time.Time) (int, error) {
+	return idx.PurgeBeforeContext(context.Background(), t)
+}
+
+// PurgeBeforeContext is PurgeBefore with a context
+func (idx *S2FlatTimeIdx) PurgeBeforeContext(ctx context.Context, t time.Time) (int, error) {
+	var count int
+
+	// cells keys are all before the meta namespace
+	start := make([]byte, len(idx.prefix))
+	copy(start, idx.prefix)
+	end := make([]byte, len(idx.prefix))
+	copy(end, idx.prefix)
+	end = append(end, metaNamespace)
+
+	for start != nil {
+		var keys [][]byte
+		var err error
+		keys, start, err = idx.expiredKeys(ctx, start, end, t, purgeBatchSize)
+		if err != nil {
+			return count, err
+		}
+
+		if len(keys) == 0 {
+			continue
+		}
+
+		kv, err := idx.KVStore.Writer()
+		if err != nil {
+			return count, err
+		}
+
+		batch := kv.NewBatch()
+		for _, k := range keys {
+			batch.Delete(k)
+		}
+		commit := idx.meta.add(batch, -len(keys))
+		err = kv.ExecuteBatch(batch)
+		batch.Close()
+		if err != nil {
+			return count, errors.Wrap(err, "deleting expired keys failed")
+		}
+		commit()
+		count += len(keys)
+	}
+
+	return count, nil
+}
+
+// expiredKeys returns at most n keys older than t found in [start, end)
+// and the key to continue from, nil if the range was fully scanned
+// the reader is closed before returning so the keys can be deleted safely
+func (idx *S2FlatTimeIdx) expiredKeys(ctx context.Context, start, end []byte, t time.Time, n int) ([][]byte, []byte, error) {
+	kv, err := idx.Reader()
+	if err != nil {
+		return nil, nil, err
+	}
+	defer kv.Close()
+
+	// keys are ordered from future to past in a cell,
+	// the expired ones are starting right after t
+	before := t.Add(-time.Nanosecond)
+
+	var keys [][]byte
+	iter := kv.RangeIterator(start, end)
+	defer iter.Close()
+	for {
+		if err := ctx.Err(); err != nil {
+			return nil, nil, err
+		}
+
+		kid, _, ok := iter.Current()
+		if !ok {
+			return keys, nil, nil
+		}
+
+		c, et, _, err := idx.keyToValues(kid)
+		if err != nil {
+			return nil, nil, errors.Wrap(err, "read back failed key from db")
+		}
+
+		if !et.Before(t) {
+			// jump to the expired entries of this cell
+			iter.Seek(idx.timePrefixKey(c, before))
+			continue
+		}
+
+		if len(keys) == n {
+			return keys, append([]byte(nil), kid...), nil
+		}
+
+		keys = append(keys, append([]byte(nil), kid...))
+		iter.Next()
+	}
+}
+
+// RetentionWorker purges every interval the entries older than maxAge, until ctx is done
+// report, if not nil, is called after each purge with the number of removed keys
+func (idx *S2FlatTimeIdx) RetentionWorker(ctx context.Context, maxAge, interval time.Duration, report func(n int, err error)) error {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		n, err := idx.PurgeBeforeContext(ctx, time.Now().Add(-maxAge))
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		if report != nil {
+			report(n, err)
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+		}
+	}
+}
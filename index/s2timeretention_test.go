@@ -0,0 +1,92 @@
+package index
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/akhenakh/oureadb/index/geodata"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPurgeBefore(t *testing.T) {
+	s := openStore(t)
+	defer cleanup(t, s)
+
+	idx := NewS2FlatTimeIdx(s, []byte("TESTPURGE"), s2Level)
+
+	paris := &geodata.GeoData{
+		Geometry: &geodata.Geometry{
+			Coordinates: paris,
+			Type:        geodata.Geometry_POINT,
+		},
+	}
+	qc := &geodata.GeoData{
+		Geometry: &geodata.Geometry{
+			Coordinates: quebec,
+			Type:        geodata.Geometry_POINT,
+		},
+	}
+
+	now := time.Now()
+	for i := 0; i < 10; i++ {
+		ts := now.Add(-time.Duration(i) * time.Hour)
+		require.NoError(t, idx.GeoTimeIndex(paris, ts, []byte{byte('a' + i)}))
+		require.NoError(t, idx.GeoTimeIndex(qc, ts, []byte{byte('A' + i)}))
+	}
+
+	// forcing several batches
+	defer func(n int) { purgeBatchSize = n }(purgeBatchSize)
+	purgeBatchSize = 3
+
+	// remove everything older than 4h30 ago, 5 events per cell
+	n, err := idx.PurgeBefore(now.Add(-4*time.Hour - 30*time.Minute))
+	require.NoError(t, err)
+	require.Equal(t, 10, n)
+
+	res, err := idx.GeoTimeIdsRadiusQuery(MaxGeoTime, MinGeoTime, paris.Geometry.Coordinates[1], paris.Geometry.Coordinates[0], 1000)
+	require.NoError(t, err)
+	require.Len(t, res, 5)
+
+	res, err = idx.GeoTimeIdsRadiusQuery(MaxGeoTime, MinGeoTime, quebec[1], quebec[0], 1000)
+	require.NoError(t, err)
+	require.Len(t, res, 5)
+
+	// nothing left to purge
+	n, err = idx.PurgeBefore(now.Add(-4*time.Hour - 30*time.Minute))
+	require.NoError(t, err)
+	require.Equal(t, 0, n)
+
+	// an event exactly at t is kept
+	n, err = idx.PurgeBefore(now)
+	require.NoError(t, err)
+	require.Equal(t, 8, n)
+}
+
+func TestRetentionWorker(t *testing.T) {
+	s := openStore(t)
+	defer cleanup(t, s)
+
+	idx := NewS2FlatTimeIdx(s, []byte("TESTPURGE"), s2Level)
+
+	geo := &geodata.GeoData{
+		Geometry: &geodata.Geometry{
+			Coordinates: paris,
+			Type:        geodata.Geometry_POINT,
+		},
+	}
+
+	now := time.Now()
+	require.NoError(t, idx.GeoTimeIndex(geo, now, []byte("new")))
+	require.NoError(t, idx.GeoTimeIndex(geo, now.Add(-2*time.Hour), []byte("old")))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	var removed int
+	err := idx.RetentionWorker(ctx, time.Hour, time.Millisecond, func(n int, err error) {
+		require.NoError(t, err)
+		removed += n
+		cancel()
+	})
+	require.Equal(t, context.Canceled, err)
+	require.Equal(t, 1, removed)
+}
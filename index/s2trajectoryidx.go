@@ -0,0 +1,369 @@
+package index
+
+import (
+	"context"
+	"encoding/binary"
+	"math"
+	"time"
+
+	"github.com/akhenakh/oureadb/index/geodata"
+	"github.com/akhenakh/oureadb/store"
+	"github.com/golang/geo/s2"
+	spb "github.com/golang/protobuf/ptypes/struct"
+	"github.com/pkg/errors"
+)
+
+const (
+	// trajectory values flags
+	trajectorySpeed   = 0x01
+	trajectoryHeading = 0x02
+)
+
+// TrajectoryPoint is a position of an object at a time
+type TrajectoryPoint struct {
+	ID   GeoID
+	Time time.Time
+
+	Lat, Lng float64
+
+	// Speed in meters per second, only stored if HasSpeed is true
+	Speed    float64
+	HasSpeed bool
+
+	// Heading in degrees, only stored if HasHeading is true
+	Heading    float64
+	HasHeading bool
+}
+
+// GeoData returns the point as a GeoData, the id, time, speed and heading are stored in its properties
+func (p *TrajectoryPoint) GeoData() *geodata.GeoData {
+	props := map[string]*spb.Value{
+		"id":   {Kind: &spb.Value_StringValue{StringValue: string(p.ID)}},
+		"time": {Kind: &spb.Value_StringValue{StringValue: p.Time.Format(time.RFC3339Nano)}},
+	}
+	if p.HasSpeed {
+		props["speed"] = &spb.Value{Kind: &spb.Value_NumberValue{NumberValue: p.Speed}}
+	}
+	if p.HasHeading {
+		props["heading"] = &spb.Value{Kind: &spb.Value_NumberValue{NumberValue: p.Heading}}
+	}
+
+	return &geodata.GeoData{
+		Geometry: &geodata.Geometry{
+			Type:        geodata.Geometry_POINT,
+			Coordinates: []float64{p.Lng, p.Lat},
+		},
+		Properties: props,
+	}
+}
+
+// TrajectoryGeoJSON returns the points as a GeoJSON LineString feature
+// using geodata.PointsToGeoJSONPolyLines, the feature has the properties of the first point
+func TrajectoryGeoJSON(points []TrajectoryPoint) ([]byte, error) {
+	geos := make([]*geodata.GeoData, len(points))
+	for i := range points {
+		geos[i] = points[i].GeoData()
+	}
+	return geodata.PointsToGeoJSONPolyLines(geos)
+}
+
+// S2TrajectoryIdx an object centric index of positions over time
+// answering where an object was during a time window and its last known position
+type S2TrajectoryIdx struct {
+	// prefix for the keys
+	prefix []byte
+
+	// persisted metadata, nil if not opened with OpenS2TrajectoryIdx or OpenOrCreateS2TrajectoryIdx
+	meta *metadata
+
+	store.KVStore
+}
+
+// NewS2TrajectoryIdx returns a new indexer
+// keys are prefix+id+reverse timestamp so the positions of an id are stored from the most recent,
+// values are the level 30 cell of the position followed by the optional speed and heading
+// the index metadata is not read nor written, see OpenOrCreateS2TrajectoryIdx
+func NewS2TrajectoryIdx(s store.KVStore, prefix []byte) *S2TrajectoryIdx {
+	return &S2TrajectoryIdx{
+		KVStore: s,
+		prefix:  prefix,
+	}
+}
+
+// OpenS2TrajectoryIdx returns an indexer after validating the metadata stored under prefix
+// returns ErrNoMetadata if the index was not created or ErrMetadataMismatch if it is another index type
+func OpenS2TrajectoryIdx(s store.KVStore, prefix []byte) (*S2TrajectoryIdx, error) {
+	return openS2TrajectoryIdx(s, prefix, false)
+}
+
+// OpenOrCreateS2TrajectoryIdx is OpenS2TrajectoryIdx creating the metadata if missing
+func OpenOrCreateS2TrajectoryIdx(s store.KVStore, prefix []byte) (*S2TrajectoryIdx, error) {
+	return openS2TrajectoryIdx(s, prefix, true)
+}
+
+func openS2TrajectoryIdx(s store.KVStore, prefix []byte, create bool) (*S2TrajectoryIdx, error) {
+	m, err := openMetadata(s, prefix, IndexMetadata{Type: S2TrajectoryIdxType}, create)
+	if err != nil {
+		return nil, err
+	}
+	idx := NewS2TrajectoryIdx(s, prefix)
+	idx.meta = m
+	return idx, nil
+}
+
+// Metadata returns the persisted metadata, nil if the index was not opened with OpenS2TrajectoryIdx or OpenOrCreateS2TrajectoryIdx
+func (idx *S2TrajectoryIdx) Metadata() *IndexMetadata {
+	return idx.meta.get()
+}
+
+// TrajectoryIndex stores the position p of p.ID at p.Time
+// a position already stored for the same id and time is replaced
+func (idx *S2TrajectoryIdx) TrajectoryIndex(p *TrajectoryPoint) error {
+	return idx.TrajectoryIndexContext(context.Background(), p)
+}
+
+// TrajectoryIndexContext is TrajectoryIndex with a context
+func (idx *S2TrajectoryIdx) TrajectoryIndexContext(ctx context.Context, p *TrajectoryPoint) error {
+	k, err := idx.pointKey(p.ID, p.Time)
+	if err != nil {
+		return err
+	}
+
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	kv, err := idx.KVStore.Writer()
+	if err != nil {
+		return err
+	}
+
+	batch := kv.NewBatch()
+	defer batch.Close()
+
+	batch.Set(k, pointValue(p))
+	commit := idx.meta.add(batch, 1)
+
+	if err := kv.ExecuteBatch(batch); err != nil {
+		return err
+	}
+	commit()
+	return nil
+}
+
+// TrajectoryIndexBulk is TrajectoryIndex adding the key to b instead of writing it
+// the key is written when b is flushed
+func (idx *S2TrajectoryIdx) TrajectoryIndexBulk(b *BulkIndexer, p *TrajectoryPoint) error {
+	return idx.TrajectoryIndexBulkContext(context.Background(), b, p)
+}
+
+// TrajectoryIndexBulkContext is TrajectoryIndexBulk with a context
+func (idx *S2TrajectoryIdx) TrajectoryIndexBulkContext(ctx context.Context, b *BulkIndexer, p *TrajectoryPoint) error {
+	k, err := idx.pointKey(p.ID, p.Time)
+	if err != nil {
+		return b.add(ctx, p.ID, nil, err)
+	}
+	return b.add(ctx, p.ID, []bulkEntry{{k: k, v: pointValue(p), meta: idx.meta}}, nil)
+}
+
+// Trajectory returns the positions of id between from and to included, ordered by time
+// the bounds can be given in any order
+func (idx *S2TrajectoryIdx) Trajectory(id GeoID, from, to time.Time) ([]TrajectoryPoint, error) {
+	return idx.TrajectoryContext(context.Background(), id, from, to)
+}
+
+// TrajectoryContext is Trajectory with a context
+func (idx *S2TrajectoryIdx) TrajectoryContext(ctx context.Context, id GeoID, from, to time.Time) ([]TrajectoryPoint, error) {
+	if from.After(to) {
+		from, to = to, from
+	}
+
+	// most recent first
+	start, err := idx.pointKey(id, to)
+	if err != nil {
+		return nil, err
+	}
+	end, err := idx.pointKey(id, from)
+	if err != nil {
+		return nil, err
+	}
+	// the smallest key greater than from
+	end = append(end, 0)
+
+	var res []TrajectoryPoint
+	err = idx.scan(ctx, start, end, func(p TrajectoryPoint) bool {
+		res = append(res, p)
+		return true
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	for i, j := 0, len(res)-1; i < j; i, j = i+1, j-1 {
+		res[i], res[j] = res[j], res[i]
+	}
+
+	return res, nil
+}
+
+// LastPosition returns the most recent position of id
+// returns ErrGeoIDNotFound if id has no position
+func (idx *S2TrajectoryIdx) LastPosition(id GeoID) (*TrajectoryPoint, error) {
+	return idx.LastPositionContext(context.Background(), id)
+}
+
+// LastPositionContext is LastPosition with a context
+func (idx *S2TrajectoryIdx) LastPositionContext(ctx context.Context, id GeoID) (*TrajectoryPoint, error) {
+	return idx.PositionAtContext(ctx, id, MaxGeoTime)
+}
+
+// PositionAt returns the last known position of id at t
+// returns ErrGeoIDNotFound if id has no position before or at t
+func (idx *S2TrajectoryIdx) PositionAt(id GeoID, t time.Time) (*TrajectoryPoint, error) {
+	return idx.PositionAtContext(context.Background(), id, t)
+}
+
+// PositionAtContext is PositionAt with a context
+func (idx *S2TrajectoryIdx) PositionAtContext(ctx context.Context, id GeoID, t time.Time) (*TrajectoryPoint, error) {
+	start, err := idx.pointKey(id, t)
+	if err != nil {
+		return nil, err
+	}
+	end, err := idx.pointKey(id, MinGeoTime)
+	if err != nil {
+		return nil, err
+	}
+	end = append(end, 0)
+
+	var res *TrajectoryPoint
+	err = idx.scan(ctx, start, end, func(p TrajectoryPoint) bool {
+		res = &p
+		return false
+	})
+	if err != nil {
+		return nil, err
+	}
+	if res == nil {
+		return nil, ErrGeoIDNotFound
+	}
+
+	return res, nil
+}
+
+// scan calls fn for every position in the keys range [start, end), returning false stops the scan
+func (idx *S2TrajectoryIdx) scan(ctx context.Context, start, end []byte, fn func(p TrajectoryPoint) bool) error {
+	kv, err := idx.Reader()
+	if err != nil {
+		return err
+	}
+	defer kv.Close()
+
+	iter := kv.RangeIterator(start, end)
+	defer iter.Close()
+	for {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		k, v, ok := iter.Current()
+		if !ok {
+			return nil
+		}
+
+		p, err := idx.keyToPoint(k, v)
+		if err != nil {
+			return errors.Wrap(err, "read back failed key from db")
+		}
+
+		if !fn(p) {
+			return nil
+		}
+		iter.Next()
+	}
+}
+
+// pointKey returns the key prefix+id+reverse timestamp
+// the id is escaped and terminated like an encoded string attribute so an id can't be the prefix of another one
+func (idx *S2TrajectoryIdx) pointKey(id GeoID, t time.Time) ([]byte, error) {
+	if len(id) == 0 || id[0] == metaNamespace {
+		return nil, errors.Errorf("invalid trajectory id %q", id)
+	}
+
+	eid, err := encodeAttrValue(string(id))
+	if err != nil {
+		return nil, err
+	}
+
+	k := make([]byte, len(idx.prefix), len(idx.prefix)+len(eid)-1+8)
+	copy(k, idx.prefix)
+	// without the string tag
+	k = append(k, eid[1:]...)
+	k = append(k, int64tob(math.MaxInt64-t.UnixNano())...)
+	return k, nil
+}
+
+// keyToPoint decodes a key and its value
+func (idx *S2TrajectoryIdx) keyToPoint(k, v []byte) (p TrajectoryPoint, err error) {
+	if len(k) <= len(idx.prefix)+8 {
+		return p, errors.New("invalid key")
+	}
+
+	// decoding the id as a string attribute
+	eid := append([]byte{attrString}, k[len(idx.prefix):len(k)-8]...)
+	id, err := decodeAttrValue(eid)
+	if err != nil {
+		return p, err
+	}
+	p.ID = GeoID(id.(string))
+
+	ts := int64(binary.BigEndian.Uint64(k[len(k)-8:]))
+	p.Time = time.Unix(0, math.MaxInt64-ts)
+
+	if len(v) < 9 {
+		return p, errors.New("invalid value")
+	}
+	ll := s2.CellID(binary.BigEndian.Uint64(v)).LatLng()
+	p.Lat, p.Lng = ll.Lat.Degrees(), ll.Lng.Degrees()
+
+	flags := v[8]
+	v = v[9:]
+	if flags&trajectorySpeed != 0 {
+		if len(v) < 8 {
+			return p, errors.New("invalid value")
+		}
+		p.Speed, p.HasSpeed = math.Float64frombits(binary.BigEndian.Uint64(v)), true
+		v = v[8:]
+	}
+	if flags&trajectoryHeading != 0 {
+		if len(v) < 8 {
+			return p, errors.New("invalid value")
+		}
+		p.Heading, p.HasHeading = math.Float64frombits(binary.BigEndian.Uint64(v)), true
+	}
+
+	return p, nil
+}
+
+// pointValue returns the value cell+flags+speed+heading of p
+func pointValue(p *TrajectoryPoint) []byte {
+	c := s2.CellIDFromLatLng(s2.LatLngFromDegrees(p.Lat, p.Lng))
+	v := make([]byte, 0, 8+1+16)
+	v = append(v, itob(uint64(c))...)
+
+	var flags byte
+	if p.HasSpeed {
+		flags |= trajectorySpeed
+	}
+	if p.HasHeading {
+		flags |= trajectoryHeading
+	}
+	v = append(v, flags)
+
+	if p.HasSpeed {
+		v = append(v, itob(math.Float64bits(p.Speed))...)
+	}
+	if p.HasHeading {
+		v = append(v, itob(math.Float64bits(p.Heading))...)
+	}
+	return v
+}
@@ -0,0 +1,91 @@
+package index
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestS2TrajectoryIdx(t *testing.T) {
+	s := openStore(t)
+	defer cleanup(t, s)
+
+	idx, err := OpenOrCreateS2TrajectoryIdx(s, []byte("TRAJ"))
+	require.NoError(t, err)
+
+	base := time.Date(2018, 3, 1, 10, 0, 0, 0, time.UTC)
+	for i := 0; i < 10; i++ {
+		p := &TrajectoryPoint{
+			ID:   []byte("bus"),
+			Time: base.Add(time.Duration(i) * 10 * time.Minute),
+			Lat:  quebec[1] + float64(i)*0.001,
+			Lng:  quebec[0],
+		}
+		if i%2 == 0 {
+			p.Speed, p.HasSpeed = float64(i), true
+			p.Heading, p.HasHeading = 90, true
+		}
+		require.NoError(t, idx.TrajectoryIndex(p))
+	}
+
+	// an id prefix of the other one
+	require.NoError(t, idx.TrajectoryIndex(&TrajectoryPoint{ID: []byte("bu"), Time: base, Lat: paris[1], Lng: paris[0]}))
+	require.Error(t, idx.TrajectoryIndex(&TrajectoryPoint{Time: base}))
+
+	// 10:00 -> 11:00 included
+	res, err := idx.Trajectory([]byte("bus"), base, base.Add(time.Hour))
+	require.NoError(t, err)
+	require.Len(t, res, 7)
+	for i, p := range res {
+		require.Equal(t, GeoID("bus"), p.ID)
+		require.True(t, p.Time.Equal(base.Add(time.Duration(i)*10*time.Minute)))
+		require.InDelta(t, quebec[1]+float64(i)*0.001, p.Lat, 1e-6)
+		require.InDelta(t, quebec[0], p.Lng, 1e-6)
+		require.Equal(t, i%2 == 0, p.HasSpeed)
+		require.Equal(t, i%2 == 0, p.HasHeading)
+		if p.HasSpeed {
+			require.Equal(t, float64(i), p.Speed)
+			require.Equal(t, 90.0, p.Heading)
+		}
+	}
+
+	// bounds in any order
+	res2, err := idx.Trajectory([]byte("bus"), base.Add(time.Hour), base)
+	require.NoError(t, err)
+	require.Equal(t, res, res2)
+
+	last, err := idx.LastPosition([]byte("bus"))
+	require.NoError(t, err)
+	require.True(t, last.Time.Equal(base.Add(90*time.Minute)))
+
+	at, err := idx.PositionAt([]byte("bus"), base.Add(25*time.Minute))
+	require.NoError(t, err)
+	require.True(t, at.Time.Equal(base.Add(20*time.Minute)))
+
+	last, err = idx.LastPosition([]byte("bu"))
+	require.NoError(t, err)
+	require.InDelta(t, paris[1], last.Lat, 1e-6)
+
+	_, err = idx.PositionAt([]byte("bus"), base.Add(-time.Minute))
+	require.Equal(t, ErrGeoIDNotFound, err)
+	_, err = idx.LastPosition([]byte("car"))
+	require.Equal(t, ErrGeoIDNotFound, err)
+
+	require.EqualValues(t, 11, idx.Metadata().Entries)
+
+	b, err := TrajectoryGeoJSON(res)
+	require.NoError(t, err)
+	var f struct {
+		Geometry struct {
+			Type        string
+			Coordinates [][]float64
+		}
+		Properties map[string]interface{}
+	}
+	require.NoError(t, json.Unmarshal(b, &f))
+	require.Equal(t, "LineString", f.Geometry.Type)
+	require.Len(t, f.Geometry.Coordinates, 7)
+	require.Equal(t, "bus", f.Properties["id"])
+}
@@ -2,13 +2,37 @@ package index
 
 import (
 	"encoding/binary"
+	"hash/fnv"
 	"math"
+	"sync"
 	"time"
+
+	"github.com/golang/geo/s1"
+	"github.com/golang/geo/s2"
+	"github.com/pkg/errors"
+)
+
+const (
+	earthCircumferenceMeter = 40075017
+	earthRadiusMeter        = earthCircumferenceMeter / (2 * math.Pi)
 )
 
-const earthCircumferenceMeter = 40075017
+const (
+	// metaNamespace is appended to an index prefix for records that are not cell keys,
+	// s2 cell ids never start with 0xFF (face > 5) so they can't collide
+	metaNamespace = 0xFF
+
+	// reverseMetaType marks the id -> cells reverse mapping records
+	reverseMetaType = 'r'
+
+	// interiorFlag is the value of a cell key fully inside the indexed geometry
+	interiorFlag = 0x01
+)
 
 var (
+	// ErrGeoIDNotFound is returned when an id is not present in an index
+	ErrGeoIDNotFound = errors.New("geo id not found in index")
+
 	// MaxGeoTime helper to query into the future
 	MaxGeoTime = time.Unix(0, math.MaxInt64)
 
@@ -31,7 +55,61 @@ func int64tob(v int64) []byte {
 	return b
 }
 
+// metersToAngle converts a distance on earth in meters to an s1.Angle
+func metersToAngle(m float64) s1.Angle {
+	return s1.Angle(m / earthRadiusMeter)
+}
+
+// angleToMeters converts an s1.Angle to a distance on earth in meters
+func angleToMeters(a s1.Angle) float64 {
+	return a.Radians() * earthRadiusMeter
+}
+
 func s2RadialAreaMeters(radius float64) float64 {
 	r := (radius / earthCircumferenceMeter) * math.Pi * 2
 	return math.Pi * r * r
 }
+
+// metaKey returns the key for a non cell record of type mt under prefix
+func metaKey(prefix []byte, mt byte, k []byte) []byte {
+	mk := make([]byte, len(prefix), len(prefix)+2+len(k))
+	copy(mk, prefix)
+	mk = append(mk, metaNamespace, mt)
+	mk = append(mk, k...)
+	return mk
+}
+
+// cellsToBytes encodes a list of cells as concatenated big endian uint64
+func cellsToBytes(cells []s2.CellID) []byte {
+	b := make([]byte, 0, len(cells)*8)
+	for _, c := range cells {
+		b = append(b, itob(uint64(c))...)
+	}
+	return b
+}
+
+// bytesToCells decodes a list of cells encoded with cellsToBytes
+func bytesToCells(b []byte) ([]s2.CellID, error) {
+	if len(b)%8 != 0 {
+		return nil, errors.New("invalid encoded cells length")
+	}
+	cells := make([]s2.CellID, len(b)/8)
+	for i := range cells {
+		cells[i] = s2.CellID(binary.BigEndian.Uint64(b[i*8:]))
+	}
+	return cells, nil
+}
+
+// idLocks serializes the writes of the same id by all the index handles of the process,
+// so the reverse mapping read and the batch write of GeoIndex, GeoReindex and GeoUnindex can't interleave
+var idLocks [256]sync.Mutex
+
+// lockID locks the writes of id under prefix, the returned func unlocks them
+func lockID(prefix []byte, id GeoID) func() {
+	h := fnv.New32a()
+	h.Write(prefix)
+	h.Write(id)
+	m := &idLocks[h.Sum32()%uint32(len(idLocks))]
+	m.Lock()
+	return m.Unlock
+}
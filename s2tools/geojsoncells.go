@@ -1,6 +1,7 @@
 package s2tools
 
 import (
+	"sort"
 	"strconv"
 
 	"github.com/golang/geo/s2"
@@ -13,31 +14,55 @@ import (
 func CellUnionToGeoJSON(cu s2.CellUnion) []byte {
 	fc := geojson.FeatureCollection{}
 	for _, cid := range cu {
-		f := &geojson.Feature{}
-		f.Properties = make(map[string]interface{})
-		f.Properties["id"] = cid.ToToken()
-		f.Properties["uid"] = strconv.FormatUint(uint64(cid), 10)
-		f.Properties["str"] = cid.String()
-		f.Properties["level"] = cid.Level()
-
-		c := s2.CellFromCellID(cid)
-		coords := make([]float64, 5*2)
-		for i := 0; i < 4; i++ {
-			p := c.Vertex(i)
-			ll := s2.LatLngFromPoint(p)
-			coords[i*2] = ll.Lng.Degrees()
-			coords[i*2+1] = ll.Lat.Degrees()
-		}
-		// last is first
-		coords[8], coords[9] = coords[0], coords[1]
-		ng := geom.NewPolygonFlat(geom.XY, coords, []int{10})
-		f.Geometry = ng
+		fc.Features = append(fc.Features, cellToFeature(cid))
+	}
+	b, _ := fc.MarshalJSON()
+	return b
+}
+
+// CellCountsToGeoJSON helpers to display density maps with GeoJSON
+// exports cells into their GeoJSON representation with a count property
+func CellCountsToGeoJSON(counts map[s2.CellID]int) []byte {
+	cu := make(s2.CellUnion, 0, len(counts))
+	for cid := range counts {
+		cu = append(cu, cid)
+	}
+	sort.Slice(cu, func(i, j int) bool { return cu[i] < cu[j] })
+
+	fc := geojson.FeatureCollection{}
+	for _, cid := range cu {
+		f := cellToFeature(cid)
+		f.Properties["count"] = counts[cid]
 		fc.Features = append(fc.Features, f)
 	}
 	b, _ := fc.MarshalJSON()
 	return b
 }
 
+// cellToFeature returns the GeoJSON feature of a cell
+func cellToFeature(cid s2.CellID) *geojson.Feature {
+	f := &geojson.Feature{}
+	f.Properties = make(map[string]interface{})
+	f.Properties["id"] = cid.ToToken()
+	f.Properties["uid"] = strconv.FormatUint(uint64(cid), 10)
+	f.Properties["str"] = cid.String()
+	f.Properties["level"] = cid.Level()
+
+	c := s2.CellFromCellID(cid)
+	coords := make([]float64, 5*2)
+	for i := 0; i < 4; i++ {
+		p := c.Vertex(i)
+		ll := s2.LatLngFromPoint(p)
+		coords[i*2] = ll.Lng.Degrees()
+		coords[i*2+1] = ll.Lat.Degrees()
+	}
+	// last is first
+	coords[8], coords[9] = coords[0], coords[1]
+	ng := geom.NewPolygonFlat(geom.XY, coords, []int{10})
+	f.Geometry = ng
+	return f
+}
+
 // CellUnionToTokens a cell union to a token string list
 func CellUnionToTokens(cu s2.CellUnion) []string {
 	res := make([]string, len(cu))
@@ -0,0 +1,26 @@
+package s2tools
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/golang/geo/s2"
+	"github.com/stretchr/testify/require"
+	"github.com/twpayne/go-geom/encoding/geojson"
+)
+
+func TestCellCountsToGeoJSON(t *testing.T) {
+	counts := map[s2.CellID]int{
+		s2.CellIDFromToken("47e664"): 3,
+		s2.CellIDFromToken("47e66c"): 1,
+	}
+
+	var fc geojson.FeatureCollection
+	err := json.Unmarshal(CellCountsToGeoJSON(counts), &fc)
+	require.NoError(t, err)
+	require.Len(t, fc.Features, 2)
+
+	require.Equal(t, "47e664", fc.Features[0].Properties["id"])
+	require.EqualValues(t, 3, fc.Features[0].Properties["count"])
+	require.EqualValues(t, 1, fc.Features[1].Properties["count"])
+}
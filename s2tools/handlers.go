@@ -1,8 +1,10 @@
 package s2tools
 
 import (
+	"bytes"
 	"encoding/json"
 	"errors"
+	"io/ioutil"
 	"net/http"
 	"strconv"
 	"strings"
@@ -36,17 +38,14 @@ func S2CellQueryHandler(w http.ResponseWriter, r *http.Request) {
 	w.Write(CellUnionToGeoJSON(cu))
 }
 
-// GeoJSONToCellHandler expect GeoJSON POST at a given URL:
+// GeoJSONToCellHandler expect GeoJSON or WKT POST at a given URL:
 // /{min_level:[0-9]+}/{max_level:[0-9]+}/{max_cells:[0-9]+}/
-// GeoJSON as body, with only one feature inside the file
+// GeoJSON as body, with only one feature inside the file, or a WKT geometry
 // curl --data "@test.geojson"  http://localhost:8000/api/geojson/4/10/0 -X POST
+// curl --data "POINT (2.35 48.85)"  http://localhost:8000/api/geojson/4/10/0 -X POST
 func GeoJSONToCellHandler(w http.ResponseWriter, r *http.Request) {
-	dec := json.NewDecoder(r.Body)
 	defer r.Body.Close()
 
-	var fc geojson.FeatureCollection
-	gd := &geodata.GeoData{}
-
 	vars := mux.Vars(r)
 
 	vals, err := func(args []string) ([]int, error) {
@@ -70,19 +69,13 @@ func GeoJSONToCellHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	err = dec.Decode(&fc)
+	body, err := ioutil.ReadAll(r.Body)
 	if err != nil {
-		http.Error(w, err.Error()+" can't unmasrhal JSON", 400)
-		return
-	}
-
-	if len(fc.Features) != 1 {
-		http.Error(w, "no or more than one feature", 400)
+		http.Error(w, err.Error(), 400)
 		return
 	}
 
-	f := fc.Features[0]
-	err = geodata.GeoJSONFeatureToGeoData(f, gd)
+	gd, err := bodyToGeoData(body)
 	if err != nil {
 		http.Error(w, err.Error(), 400)
 		return
@@ -105,3 +98,26 @@ func GeoJSONToCellHandler(w http.ResponseWriter, r *http.Request) {
 	j := CellUnionToGeoJSON(cu)
 	w.Write(j)
 }
+
+// bodyToGeoData returns the GeoData of a GeoJSON FeatureCollection with one feature or of a WKT geometry
+func bodyToGeoData(body []byte) (*geodata.GeoData, error) {
+	body = bytes.TrimSpace(body)
+	if len(body) > 0 && body[0] != '{' {
+		return geodata.GeoDataFromWKT(string(body))
+	}
+
+	var fc geojson.FeatureCollection
+	if err := json.Unmarshal(body, &fc); err != nil {
+		return nil, errors.New(err.Error() + " can't unmasrhal JSON")
+	}
+
+	if len(fc.Features) != 1 {
+		return nil, errors.New("no or more than one feature")
+	}
+
+	gd := &geodata.GeoData{}
+	if err := geodata.GeoJSONFeatureToGeoData(fc.Features[0], gd); err != nil {
+		return nil, err
+	}
+	return gd, nil
+}
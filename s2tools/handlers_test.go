@@ -54,3 +54,30 @@ func TestGeoJSONHandler(t *testing.T) {
 	}
 
 }
+
+func TestWKTHandler(t *testing.T) {
+	gd, err := bodyToGeoData([]byte(parisGeoJSON))
+	require.NoError(t, err)
+	wkt, err := gd.WKT()
+	require.NoError(t, err)
+
+	req := httptest.NewRequest("POST", "http://example.com/9/9/0", strings.NewReader(wkt))
+	w := httptest.NewRecorder()
+
+	m := mux.NewRouter()
+	m.HandleFunc("/{min_level:[0-9]+}/{max_level:[0-9]+}/{max_cells:[0-9]+}", GeoJSONToCellHandler)
+	m.ServeHTTP(w, req)
+
+	resp := w.Result()
+	require.Equal(t, 200, resp.StatusCode)
+
+	var fc geojson.FeatureCollection
+	err = json.NewDecoder(resp.Body).Decode(&fc)
+	require.NoError(t, err)
+	require.Len(t, fc.Features, 4)
+
+	req = httptest.NewRequest("POST", "http://example.com/9/9/0", strings.NewReader("POLYGON ((2.32"))
+	w = httptest.NewRecorder()
+	m.ServeHTTP(w, req)
+	require.Equal(t, 400, w.Result().StatusCode)
+}